@@ -189,6 +189,9 @@ func initGenesis(ctx *cli.Context) error {
 	if err := json.NewDecoder(file).Decode(genesis); err != nil {
 		utils.Fatalf("invalid genesis file: %v", err)
 	}
+	if err := genesis.Config.Dpos.Validate(); err != nil {
+		utils.Fatalf("invalid genesis file: %v", err)
+	}
 	log.Info("initGenesis>>>>>", "genesis struct", genesis.Config.Dpos.Validators[0].Hex())
 	mxvs := genesis.Config.Dpos.MaxValidatorSize
 	vsz := len(genesis.Config.Dpos.Validators)
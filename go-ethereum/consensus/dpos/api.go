@@ -17,18 +17,24 @@
 package dpos
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"github.com/happytoken/go-ethereum/common"
 	"github.com/happytoken/go-ethereum/consensus"
+	"github.com/happytoken/go-ethereum/core/state"
+	"github.com/happytoken/go-ethereum/core/rawdb"
 	"github.com/happytoken/go-ethereum/core/types"
 	"github.com/happytoken/go-ethereum/crypto"
 	"github.com/happytoken/go-ethereum/log"
 	"github.com/happytoken/go-ethereum/rpc"
 	"github.com/happytoken/go-ethereum/trie"
 	"math/rand"
-	"sort"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"math/big"
 )
@@ -40,50 +46,757 @@ type API struct {
 	dpos  *Dpos
 }
 
+// AdminAPI is the operator facing RPC API to control block production.
+type AdminAPI struct {
+	chain consensus.ChainReader
+	dpos  *Dpos
+}
+
+// PauseProduction halts block production of the local validator, the signer
+// stays authorized.
+func (api *AdminAPI) PauseProduction() bool {
+	api.dpos.Pause()
+	return true
+}
+
+// ResumeProduction restarts block production halted by PauseProduction.
+func (api *AdminAPI) ResumeProduction() bool {
+	api.dpos.Resume()
+	return true
+}
+
+// ProductionPaused reports whether block production is paused.
+func (api *AdminAPI) ProductionPaused() bool {
+	return api.dpos.Paused()
+}
+
+// RecomputeConfirmedBlock rebuilds the irreversible block from genesis and
+// returns the recomputed header.
+func (api *AdminAPI) RecomputeConfirmedBlock() (*types.Header, error) {
+	return api.dpos.RecomputeConfirmedBlock(api.chain)
+}
+
+// BlockNumber is the block argument of the dpos API. Besides what
+// rpc.BlockNumber accepts, it takes the "finalized" and "safe" tags.
+type BlockNumber rpc.BlockNumber
+
+const (
+	SafeBlockNumber      = BlockNumber(-4)
+	FinalizedBlockNumber = BlockNumber(-3)
+)
+
+// UnmarshalJSON parses the "finalized" and "safe" tags, anything else is left
+// to rpc.BlockNumber.
+func (bn *BlockNumber) UnmarshalJSON(data []byte) error {
+	switch strings.TrimSpace(string(data)) {
+	case `"finalized"`:
+		*bn = FinalizedBlockNumber
+		return nil
+	case `"safe"`:
+		*bn = SafeBlockNumber
+		return nil
+	}
+	return (*rpc.BlockNumber)(bn).UnmarshalJSON(data)
+}
+
+// getHeader retrieves the header of the specified block, defaulting to the
+// current head if no block number is given. The finalized block is the
+// confirmed one, the safe block is SafeDepth blocks below the head if that's
+// more recent.
+func (api *API) getHeader(number *BlockNumber) *types.Header {
+	if number == nil || rpc.BlockNumber(*number) == rpc.LatestBlockNumber {
+		return api.chain.CurrentHeader()
+	}
+	switch *number {
+	case FinalizedBlockNumber:
+		confirmed, _ := api.confirmedHeader()
+		return confirmed
+	case SafeBlockNumber:
+		return api.safeHeader()
+	}
+	return api.chain.GetHeaderByNumber(uint64(*number))
+}
+
+// confirmedHeader returns the latest irreversible block, loading it from the
+// database if the engine hasn't tracked one yet.
+func (api *API) confirmedHeader() (*types.Header, error) {
+	api.dpos.confirmedMu.Lock()
+	defer api.dpos.confirmedMu.Unlock()
+	return api.dpos.trackConfirmedHeader(api.chain)
+}
+
+// safeHeader returns the block the "safe" tag resolves to.
+func (api *API) safeHeader() *types.Header {
+	confirmed, err := api.confirmedHeader()
+	if err != nil {
+		return nil
+	}
+	if api.dpos.config == nil || api.dpos.config.SafeDepth == 0 {
+		return confirmed
+	}
+	head := api.chain.CurrentHeader()
+	if head.Number.Uint64() < api.dpos.config.SafeDepth {
+		return confirmed
+	}
+	number := head.Number.Uint64() - api.dpos.config.SafeDepth
+	if number <= confirmed.Number.Uint64() {
+		return confirmed
+	}
+	return api.chain.GetHeaderByNumber(number)
+}
+
 // GetValidators retrieves the list of the validators at specified block
-func (api *API) GetValidators(number *rpc.BlockNumber) ([]common.Address, error) {
-	var header *types.Header
-	if number == nil || *number == rpc.LatestBlockNumber {
-		header = api.chain.CurrentHeader()
-	} else {
-		header = api.chain.GetHeaderByNumber(uint64(number.Int64()))
+func (api *API) GetValidators(number *BlockNumber) ([]common.Address, error) {
+	header := api.getHeader(number)
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+
+	dposContext, err := types.OpenEpochTrieOnly(header.DposContext.EpochHash, trie.NewDatabase(api.dpos.db))
+	if err != nil {
+		return nil, err
+	}
+	validators, err := dposContext.GetValidators()
+	if err != nil {
+		return nil, err
 	}
+	return validators, nil
+}
+
+// GetSigner retrieves the address that signed the specified block, recovered
+// from its seal rather than taken from the validator it claims.
+func (api *API) GetSigner(number *BlockNumber) (common.Address, error) {
+	header := api.getHeader(number)
 	if header == nil {
+		return common.Address{}, errUnknownBlock
+	}
+	if header.Number.Sign() == 0 {
+		return common.Address{}, errGenesisHeader
+	}
+	return ecrecover(header, api.dpos.signatures)
+}
+
+// GetDposRoots retrieves the roots of the dpos tries stored in the header of the
+// specified block.
+func (api *API) GetDposRoots(number *BlockNumber) (*types.DposContextProto, error) {
+	header := api.getHeader(number)
+	if header == nil || header.DposContext == nil {
 		return nil, errUnknownBlock
 	}
+	return header.DposContext, nil
+}
 
-	trieDB := trie.NewDatabase(api.dpos.db)
-	epochTrie, err := types.NewEpochTrie(header.DposContext.EpochHash, trieDB)
+// GetAllVoters retrieves the addresses of all delegators currently voting for a
+// candidate at the specified block.
+func (api *API) GetAllVoters(number *BlockNumber) ([]common.Address, error) {
+	header := api.getHeader(number)
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	voteTrie, err := types.NewVoteTrie(header.DposContext.VoteHash, trie.NewDatabase(api.dpos.db))
+	if err != nil {
+		return nil, err
+	}
+	voters := make([]common.Address, 0)
+	prefix := types.VotePrefix()
+	iter := trie.NewIterator(voteTrie.PrefixIterator(nil))
+	for iter.Next() {
+		voters = append(voters, common.BytesToAddress(iter.Key[len(prefix):]))
+	}
+	if iter.Err != nil {
+		return nil, iter.Err
+	}
+	return voters, nil
+}
+
+// Allocation is the stake of a delegator backing a candidate.
+type Allocation struct {
+	Candidate common.Address `json:"candidate"`
+	Weight    *big.Int       `json:"weight"`
+}
+
+// GetAccountDelegations retrieves the candidates the delegator backs at the
+// specified block along with the stake backing each. A delegator votes for a
+// single candidate with its whole balance, so there's at most one allocation.
+func (api *API) GetAccountDelegations(delegator common.Address, number *BlockNumber) ([]Allocation, error) {
+	header := api.getHeader(number)
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	dposContext, err := types.NewDposContextFromProto(trie.NewDatabase(api.dpos.db), header.DposContext)
+	if err != nil {
+		return nil, err
+	}
+	candidate, err := dposContext.GetVote(delegator)
+	if err != nil {
+		return nil, err
+	}
+	allocations := make([]Allocation, 0, 1)
+	if candidate == (common.Address{}) {
+		return allocations, nil
+	}
+	statedb, err := state.New(header.Root, state.NewDatabase(api.dpos.db))
+	if err != nil {
+		return nil, err
+	}
+	return append(allocations, Allocation{Candidate: candidate, Weight: statedb.GetBalance(delegator)}), nil
+}
 
+// EpochInfo is an overview of the state of an epoch.
+type EpochInfo struct {
+	Epoch          int64            `json:"epoch"`          // Number of the epoch
+	StartTime      int64            `json:"startTime"`      // Timestamp the epoch starts at
+	EndTime        int64            `json:"endTime"`        // Timestamp the next epoch starts at
+	Validators     []common.Address `json:"validators"`     // Validators of the epoch
+	MintedBlocks   int64            `json:"mintedBlocks"`   // Blocks minted in the epoch so far
+	ExpectedBlocks int64            `json:"expectedBlocks"` // Slots available in the whole epoch
+}
+
+// GetEpochInfo retrieves an overview of the epoch the specified block is in.
+func (api *API) GetEpochInfo(number *BlockNumber) (*EpochInfo, error) {
+	header := api.getHeader(number)
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	genesis := api.chain.GetHeaderByNumber(0)
+	if genesis == nil || genesis.BlockInterval == 0 {
+		return nil, errUnknownBlock
+	}
+	dposContext, err := types.NewDposContextFromProto(trie.NewDatabase(api.dpos.db), header.DposContext)
 	if err != nil {
 		return nil, err
 	}
-	dposContext := types.DposContext{}
-	dposContext.SetEpoch(epochTrie)
 	validators, err := dposContext.GetValidators()
 	if err != nil {
 		return nil, err
 	}
-	return validators, nil
+	epoch := HeaderEpochID(api.dpos.config, header)
+	epochBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(epochBytes, uint64(epoch))
+
+	minted := int64(0)
+	iter := trie.NewIterator(dposContext.MintCntTrie().PrefixIterator(epochBytes))
+	for iter.Next() {
+		minted += int64(binary.BigEndian.Uint64(iter.Value))
+	}
+	expected := epochBlocks(api.dpos.config)
+	if expected == 0 {
+		expected = epochInterval / int64(genesis.BlockInterval)
+	}
+	return &EpochInfo{
+		Epoch:          epoch,
+		StartTime:      epochStart(api.dpos.config, epoch),
+		EndTime:        epochStart(api.dpos.config, epoch+1),
+		Validators:     validators,
+		MintedBlocks:   minted,
+		ExpectedBlocks: expected,
+	}, nil
 }
 
-// GetConfirmedBlockNumber retrieves the latest irreversible block
-func (api *API) GetConfirmedBlockNumber() (*big.Int, error) {
-	var err error
-	header := api.dpos.confirmedBlockHeader
+// GenesisDposParams are the consensus parameters declared by the genesis block.
+type GenesisDposParams struct {
+	BlockInterval    uint64 `json:"blockInterval"`    // Seconds between two slots
+	MaxValidatorSize uint64 `json:"maxValidatorSize"` // Maximum number of validators per epoch
+	EpochInterval    int64  `json:"epochInterval"`    // Seconds between two elections
+	EpochOffset      int64  `json:"epochOffset"`      // Offset of the epoch boundaries from multiples of the interval
+}
+
+// GetGenesisDposParams retrieves the consensus parameters the genesis header
+// declares, along with the epoch timing derived from the chain config.
+func (api *API) GetGenesisDposParams() (*GenesisDposParams, error) {
+	genesis := api.chain.GetHeaderByNumber(0)
+	if genesis == nil {
+		return nil, errUnknownBlock
+	}
+	return &GenesisDposParams{
+		BlockInterval:    genesis.BlockInterval,
+		MaxValidatorSize: genesis.MaxValidatorSize,
+		EpochInterval:    epochInterval,
+		EpochOffset:      epochOffset(api.dpos.config),
+	}, nil
+}
+
+// Status is a short summary of the consensus state of the node.
+type Status struct {
+	Validator       common.Address `json:"validator"`       // Validator of the current slot
+	IsValidator     bool           `json:"isValidator"`     // Whether this node signs for the current slot
+	Epoch           int64          `json:"epoch"`           // Number of the current epoch
+	ConfirmedNumber uint64         `json:"confirmedNumber"` // Number of the latest irreversible block
+	ConfirmedLag    uint64         `json:"confirmedLag"`    // Blocks between the head and the irreversible block
+	BlockInterval   uint64         `json:"blockInterval"`   // Seconds between two slots
+	ValidatorCount  int            `json:"validatorCount"`  // Number of validators of the current epoch
+}
+
+// Status retrieves a summary of the consensus state at the current time.
+func (api *API) Status() (*Status, error) {
+	return api.status(time.Now().Unix())
+}
+
+func (api *API) status(now int64) (*Status, error) {
+	head := api.chain.CurrentHeader()
+	genesis := api.chain.GetHeaderByNumber(0)
+	if head == nil || genesis == nil || genesis.BlockInterval == 0 {
+		return nil, errUnknownBlock
+	}
+	dposContext, err := types.OpenEpochTrieOnly(head.DposContext.EpochHash, trie.NewDatabase(api.dpos.db))
+	if err != nil {
+		return nil, err
+	}
+	validators, err := dposContext.GetValidators()
+	if err != nil {
+		return nil, err
+	}
+	slot := now - now%int64(genesis.BlockInterval)
+	epochContext := &EpochContext{DposContext: dposContext, config: api.dpos.config}
+	validator, err := epochContext.lookupValidator(slot, genesis.BlockInterval)
+	if err != nil {
+		return nil, err
+	}
+	confirmed, err := api.GetConfirmedBlockNumber()
+	if err != nil {
+		return nil, err
+	}
+	api.dpos.mu.RLock()
+	signer := api.dpos.signer
+	api.dpos.mu.RUnlock()
+
+	status := &Status{
+		Validator:       validator,
+		IsValidator:     validator == signer,
+		Epoch:           EpochID(api.dpos.config, now),
+		ConfirmedNumber: confirmed.Uint64(),
+		BlockInterval:   genesis.BlockInterval,
+		ValidatorCount:  len(validators),
+	}
+	if number := head.Number.Uint64(); number > status.ConfirmedNumber {
+		status.ConfirmedLag = number - status.ConfirmedNumber
+	}
+	return status, nil
+}
+
+// MissedSlots retrieves the number of consecutive slots that went by without a
+// block since the head of the chain.
+func (api *API) MissedSlots() int {
+	return api.dpos.MissedSlots(api.chain, time.Now().Unix())
+}
+
+// SlotInfo is the position of the current slot within its epoch.
+type SlotInfo struct {
+	Index         int64          `json:"index"`
+	SlotsPerEpoch int64          `json:"slotsPerEpoch"`
+	Validator     common.Address `json:"validator"`
+}
+
+// CurrentSlot retrieves the position of the current slot within the epoch and
+// the validator expected to mint in it.
+func (api *API) CurrentSlot() (*SlotInfo, error) {
+	index, slots, validator, err := api.dpos.CurrentSlot(api.chain, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return &SlotInfo{Index: index, SlotsPerEpoch: slots, Validator: validator}, nil
+}
+
+// ElectionCountdown is the time left until the next election.
+type ElectionCountdown struct {
+	Seconds int64 `json:"seconds"`
+	Blocks  int64 `json:"blocks"` // Approximate, assumes no slot is missed
+}
+
+// BlocksUntilElection retrieves the seconds and about how many blocks are left
+// until the next epoch holds its election.
+func (api *API) BlocksUntilElection() (*ElectionCountdown, error) {
+	seconds, blocks, err := api.dpos.BlocksUntilElection(api.chain, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return &ElectionCountdown{Seconds: seconds, Blocks: blocks}, nil
+}
+
+// NewElection creates a subscription that is notified with the epoch and the
+// validators every time a block electing a new validator set becomes the head.
+func (api *API) NewElection(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	rpcSub := notifier.CreateSubscription()
+
+	elections := make(chan ElectionEvent)
+	electionSub := api.dpos.SubscribeElection(elections)
+	go func() {
+		defer electionSub.Unsubscribe()
+		for {
+			select {
+			case ev := <-elections:
+				notifier.Notify(rpcSub.ID, ev)
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			case <-electionSub.Err():
+				return
+			}
+		}
+	}()
+	return rpcSub, nil
+}
+
+// GetEpochReward retrieves the total rewards paid to validators in the given
+// epoch as of the specified block. Rewards are only recorded from the
+// EpochHistoryBlock on, and for the recent epochs of the history window.
+func (api *API) GetEpochReward(epoch int64, number *BlockNumber) (*big.Int, error) {
+	header := api.getHeader(number)
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	dposContext, err := types.OpenEpochTrieOnly(header.DposContext.EpochHash, trie.NewDatabase(api.dpos.db))
+	if err != nil {
+		return nil, err
+	}
+	return dposContext.GetEpochReward(epoch)
+}
+
+// BlockRewardInfo breaks down what the validator of a block earned with it.
+type BlockRewardInfo struct {
+	Validator common.Address `json:"validator"`
+	Payout    common.Address `json:"payout"`  // address the subsidy was paid to
+	Subsidy   *big.Int       `json:"subsidy"` // block reward after the rank curve, election bonus and epoch cap
+	Fees      *big.Int       `json:"fees"`    // transaction fees of the block
+	Burnt     *big.Int       `json:"burnt"`   // share of the fees burnt per BaseFeeBurnRatio
+	Net       *big.Int       `json:"net"`     // subsidy plus the fees that weren't burnt
+}
+
+// GetBlockReward retrieves the reward the validator of the specified block
+// earned with it. The fees are taken from the block's transactions and
+// receipts, the subsidy is recomputed on the dpos state of the parent the way
+// the block was finalized.
+func (api *API) GetBlockReward(number *BlockNumber) (*BlockRewardInfo, error) {
+	header := api.getHeader(number)
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	if header.Number.Sign() == 0 {
+		return nil, errGenesisHeader
+	}
+	parent := api.chain.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+	if parent == nil {
+		return nil, consensus.ErrUnknownAncestor
+	}
+	body := rawdb.ReadBody(api.dpos.db, header.Hash(), header.Number.Uint64())
+	if body == nil {
+		return nil, errUnknownBlock
+	}
+	receipts := rawdb.ReadReceipts(api.dpos.db, header.Hash(), header.Number.Uint64())
+	if len(receipts) != len(body.Transactions) {
+		return nil, fmt.Errorf("missing receipts of block %d", header.Number)
+	}
+	db := trie.NewDatabase(api.dpos.db)
+	dposContext, err := types.OpenEpochTrieOnly(header.DposContext.EpochHash, db)
+	if err != nil {
+		return nil, err
+	}
+	parentContext, err := types.OpenEpochTrieOnly(parent.DposContext.EpochHash, db)
+	if err != nil {
+		return nil, err
+	}
+	election := HeaderEpochID(api.dpos.config, parent) != HeaderEpochID(api.dpos.config, header)
+	info := &BlockRewardInfo{
+		Validator: header.Validator,
+		Payout:    payoutAddress(header, dposContext),
+		Subsidy:   blockSubsidy(api.chain.Config(), header, parentContext, election),
+		Fees:      blockFees(body.Transactions, receipts),
+	}
+	info.Burnt = burntShare(api.dpos.config, info.Fees)
+	info.Net = new(big.Int).Add(info.Subsidy, info.Fees)
+	info.Net.Sub(info.Net, info.Burnt)
+	return info, nil
+}
+
+// GetElectionInput retrieves the candidates the election of the given epoch was
+// held among, with the vote weights they stood for election with, in the order
+// they ranked. The input is only recorded from the EpochHistoryBlock on, and
+// for the recent epochs of the history window.
+func (api *API) GetElectionInput(epoch int64) ([]types.CandidateWeight, error) {
+	header := api.chain.CurrentHeader()
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	dposContext, err := types.OpenEpochTrieOnly(header.DposContext.EpochHash, trie.NewDatabase(api.dpos.db))
+	if err != nil {
+		return nil, err
+	}
+	return dposContext.GetElectionInput(epoch)
+}
+
+// GetVoteHistory retrieves the recent vote changes of the delegator, oldest
+// first. Vote changes are only recorded on chains keeping a vote history.
+func (api *API) GetVoteHistory(delegator common.Address) ([]types.VoteChange, error) {
+	header := api.chain.CurrentHeader()
 	if header == nil {
-		header, err = api.dpos.loadConfirmedBlockHeader(api.chain)
+		return nil, errUnknownBlock
+	}
+	dposContext, err := types.OpenEpochTrieOnly(header.DposContext.EpochHash, trie.NewDatabase(api.dpos.db))
+	if err != nil {
+		return nil, err
+	}
+	return dposContext.GetVoteHistory(delegator)
+}
+
+// Reasons given by ExplainElection for the outcome of an election.
+const (
+	electionElected     = "elected"
+	electionOverridden  = "replaced by a validator override"
+	electionNoCandidate = "not a candidate"
+	electionKickedOut   = "kicked out for low productivity"
+	electionWarmingUp   = "registered too recently"
+	electionTooFewVotes = "vote weight below the minimum"
+	electionBelowCutoff = "vote weight below the cutoff"
+)
+
+// ElectionExplanation details how a candidate fared in the election of an epoch.
+type ElectionExplanation struct {
+	Candidate common.Address `json:"candidate"`
+	Epoch     int64          `json:"epoch"`
+	Elected   bool           `json:"elected"`
+	Reason    string         `json:"reason"`    // Why the candidate was or wasn't elected
+	Weight    *big.Int       `json:"weight"`    // Vote weight of the candidate at the election
+	Rank      int            `json:"rank"`      // Position among the eligible candidates, 0 if not eligible
+	Cutoff    *big.Int       `json:"cutoff"`    // Vote weight of the last candidate making the cut
+	KickedOut bool           `json:"kickedOut"` // Whether it was kicked out right before the election
+	WarmingUp bool           `json:"warmingUp"` // Whether it registered too recently to be eligible
+}
+
+// ExplainElection replays the election of the given epoch on the state it was
+// held on and reports how the candidate fared in it.
+func (api *API) ExplainElection(candidate common.Address, epoch int64) (*ElectionExplanation, error) {
+	if api.dpos.provider != nil {
+		return nil, errNotVoteElected
+	}
+	genesis := api.chain.GetHeaderByNumber(0)
+	parent, header, err := api.electionHeaders(genesis, epoch)
+	if err != nil {
+		return nil, err
+	}
+	trieDB := trie.NewDatabase(api.dpos.db)
+	dposContext, err := types.NewDposContextFromProto(trieDB, parent.DposContext)
+	if err != nil {
+		return nil, err
+	}
+	statedb, err := state.New(parent.Root, state.NewDatabase(api.dpos.db))
+	if err != nil {
+		return nil, err
+	}
+	epochContext := &EpochContext{
+		TimeStamp:   header.Time.Int64(),
+		number:      header.Number.Int64(),
+		DposContext: dposContext,
+		statedb:     statedb,
+		config:      api.dpos.config,
+	}
+	explanation := &ElectionExplanation{Candidate: candidate, Epoch: epoch, Weight: new(big.Int), Cutoff: new(big.Int)}
+
+	// votes of kicked out candidates are dropped by the election, tally first
+	votes, err := api.dpos.weights.get(parent.Hash(), epochContext.countVotes)
+	if err != nil && err != errNoCandidates {
+		return nil, err
+	}
+	if weight, ok := votes[candidate]; ok {
+		explanation.Weight = weight
+	}
+	registered, err := dposContext.CandidateTrie().TryGet(candidate.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if err := epochContext.tryElect(genesis, parent); err != nil {
+		return nil, err
+	}
+	remaining, err := dposContext.CandidateTrie().TryGet(candidate.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	explanation.KickedOut = registered != nil && remaining == nil
+	if remaining != nil {
+		registeredEpoch, err := dposContext.CandidateEpoch(candidate)
 		if err != nil {
 			return nil, err
 		}
+		explanation.WarmingUp = !epochContext.isWarmedUp(registeredEpoch, epoch)
+	}
+	eligible, err := epochContext.votedCandidates(epoch)
+	if err != nil {
+		return nil, err
+	}
+	for i, elected := range eligible {
+		if elected.address == candidate {
+			explanation.Rank = i + 1
+		}
+	}
+	if size := int(genesis.MaxValidatorSize); len(eligible) > 0 {
+		if len(eligible) < size {
+			size = len(eligible)
+		}
+		explanation.Cutoff = eligible[size-1].weight
+	}
+
+	// the outcome is taken from the chain, admin overrides may have replaced it
+	result, err := types.OpenEpochTrieOnly(header.DposContext.EpochHash, trieDB)
+	if err != nil {
+		return nil, err
+	}
+	validators, err := result.GetValidators()
+	if err != nil {
+		return nil, err
+	}
+	for _, validator := range validators {
+		if validator == candidate {
+			explanation.Elected = true
+		}
+	}
+	switch {
+	case explanation.Elected:
+		explanation.Reason = electionElected
+	case explanation.KickedOut:
+		explanation.Reason = electionKickedOut
+	case registered == nil:
+		explanation.Reason = electionNoCandidate
+	case explanation.WarmingUp:
+		explanation.Reason = electionWarmingUp
+	case !epochContext.hasElectableWeight(explanation.Weight):
+		explanation.Reason = electionTooFewVotes
+	case explanation.Rank > 0 && explanation.Rank <= int(genesis.MaxValidatorSize):
+		explanation.Reason = electionOverridden
+	default:
+		explanation.Reason = electionBelowCutoff
+	}
+	return explanation, nil
+}
+
+// candidateWeightsTTL is how long the RPC API reuses the candidate weights
+// tallied on the state of a block.
+const candidateWeightsTTL = 10 * time.Second
+
+// candidateWeightCache keeps the candidate weights last tallied by the RPC API,
+// sparing repeated calls the iteration of the tries. The entry is reused for
+// the same block within candidateWeightsTTL and dropped on every new head.
+type candidateWeightCache struct {
+	mu      sync.Mutex
+	hash    common.Hash
+	weights map[common.Address]*big.Int
+	expires time.Time
+}
+
+// get returns the candidate weights tallied on the state of the block with the
+// given hash, calling tally if they aren't cached. The returned map is shared
+// and must not be modified.
+func (c *candidateWeightCache) get(hash common.Hash, tally func() (map[common.Address]*big.Int, error)) (map[common.Address]*big.Int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.weights != nil && c.hash == hash && time.Now().Before(c.expires) {
+		return c.weights, nil
+	}
+	weights, err := tally()
+	if err != nil {
+		return weights, err
+	}
+	c.hash, c.weights, c.expires = hash, weights, time.Now().Add(candidateWeightsTTL)
+	return weights, nil
+}
+
+// invalidate drops the cached weights.
+func (c *candidateWeightCache) invalidate() {
+	c.mu.Lock()
+	c.weights = nil
+	c.mu.Unlock()
+}
+
+// electionHeaders finds the canonical block that held the election of the
+// given epoch along with its parent, whose state the election was held on.
+func (api *API) electionHeaders(genesis *types.Header, epoch int64) (*types.Header, *types.Header, error) {
+	head := api.chain.CurrentHeader()
+	if head == nil || genesis == nil {
+		return nil, nil, errUnknownBlock
+	}
+	if HeaderEpochID(api.dpos.config, head) < epoch {
+		return nil, nil, errEpochNotElected
+	}
+	// block times are monotonic, look for the first block of the epoch
+	number := sort.Search(int(head.Number.Int64()), func(i int) bool {
+		header := api.chain.GetHeaderByNumber(uint64(i + 1))
+		return header == nil || HeaderEpochID(api.dpos.config, header) >= epoch
+	}) + 1
+	header := api.chain.GetHeaderByNumber(uint64(number))
+	if header == nil {
+		return nil, nil, errUnknownBlock
+	}
+	parent := api.chain.GetHeader(header.ParentHash, uint64(number-1))
+	if parent == nil {
+		return nil, nil, errUnknownBlock
+	}
+	// the first election after genesis only elects the epoch of its block
+	prevEpoch := HeaderEpochID(api.dpos.config, parent)
+	if prevEpoch >= epoch || (prevEpoch == HeaderEpochID(api.dpos.config, genesis) && epoch != HeaderEpochID(api.dpos.config, header)) {
+		return nil, nil, errEpochNotElected
+	}
+	return parent, header, nil
+}
+
+// pendingContext returns the dpos state of the block being mined.
+func (api *API) pendingContext() (*types.DposContext, error) {
+	api.dpos.mu.RLock()
+	pending := api.dpos.pending
+	api.dpos.mu.RUnlock()
+
+	if pending == nil {
+		return nil, errNoPendingBlock
+	}
+	dposContext := pending()
+	if dposContext == nil {
+		return nil, errNoPendingBlock
+	}
+	return dposContext, nil
+}
+
+// GetPendingVote retrieves the candidate the delegator votes for in the block
+// being mined, including votes not yet committed to the chain.
+func (api *API) GetPendingVote(delegator common.Address) (common.Address, error) {
+	dposContext, err := api.pendingContext()
+	if err != nil {
+		return common.Address{}, err
+	}
+	return dposContext.GetVote(delegator)
+}
+
+// GetPendingDelegators retrieves the delegators voting for the candidate in the
+// block being mined, including votes not yet committed to the chain. The
+// delegators are sorted by address.
+func (api *API) GetPendingDelegators(candidate common.Address) ([]common.Address, error) {
+	dposContext, err := api.pendingContext()
+	if err != nil {
+		return nil, err
+	}
+	delegators := make([]common.Address, 0)
+	iter := trie.NewIterator(dposContext.DelegateTrie().PrefixIterator(candidate.Bytes()))
+	for iter.Next() {
+		delegators = append(delegators, common.BytesToAddress(iter.Value))
+	}
+	return delegators, nil
+}
+
+// GetConfirmedBlockNumber retrieves the latest irreversible block
+func (api *API) GetConfirmedBlockNumber() (*big.Int, error) {
+	header, err := api.confirmedHeader()
+	if err != nil {
+		return nil, err
 	}
 	return header.Number, nil
 }
 func (ec *EpochContext) tryElect(genesis, parent *types.Header) error {
 
-	genesisEpoch := genesis.Time.Int64() / epochInterval   //genesisEpoch is 0
-	prevEpoch := parent.Time.Int64() / epochInterval
-	currentEpoch := ec.TimeStamp / epochInterval
+	genesisEpoch := HeaderEpochID(ec.config, genesis)   //genesisEpoch is 0
+	prevEpoch := HeaderEpochID(ec.config, parent)
+	currentEpoch := ec.epoch()
 
 	prevEpochIsGenesis := prevEpoch == genesisEpoch  		// bool type
 	if prevEpochIsGenesis && prevEpoch < currentEpoch {
@@ -105,55 +818,103 @@ func (ec *EpochContext) tryElect(genesis, parent *types.Header) error {
 		// if prevEpoch is not genesis, kickout not active candidate
 		// 如果前一个周期不是创世周期，触发踢出候选人规则
 		// 踢出规则主要是看上一周期是否存在候选人出块少于特定阈值(50%), 如果存在则踢出
-		if !prevEpochIsGenesis && iter.Next() {
+		if ec.provider == nil && !prevEpochIsGenesis && iter.Next() {
 			if err := ec.kickoutValidator(prevEpoch,genesis); err != nil {
 				return err
 			}
 		}
-		// 对候选人进行计票后按照票数由高到低来排序, 选出前 N 个
-		// 这里需要注意的是当前对于成为候选人没有门槛限制很容易被恶意攻击
-		votes, err := ec.countVotes()
-		if err != nil {
-			return err
-		}
 		//add
 		maxValidatorSize := int(genesis.MaxValidatorSize)
 		safeSize := maxValidatorSize*2/3+1
-		candidates := sortableAddresses{}
-		for candidate, cnt := range votes {
-			candidates = append(candidates, &sortableAddress{candidate, cnt})
+		var (
+			candidates sortableAddresses
+			err        error
+		)
+		if ec.provider != nil {
+			candidates, err = ec.providedCandidates(i + 1)
+		} else {
+			candidates, err = ec.votedCandidates(i + 1)
+		}
+		if err != nil {
+			return err
+		}
+		// admins may have forced the validator set of the epoch
+		override, err := ec.DposContext.GetValidatorOverride(i + 1)
+		if err != nil {
+			return err
+		}
+		if len(override) > 0 {
+			log.Warn("Validator set overridden by admins", "epoch", i+1, "validators", len(override))
+			if err := ec.DposContext.SetValidatorOverride(i+1, nil); err != nil {
+				return err
+			}
+			if err := ec.recordElection(i+1, candidates.weights(), override, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(candidates) == 0 {
+			// nobody could be elected, keep the chain alive with the old set
+			validators, err := ec.fallbackValidators()
+			if err != nil {
+				return err
+			}
+			log.Error("No candidates to elect, retaining previous validators", "epoch", i+1, "validators", len(validators))
+			if err := checkValidatorSetSize(validators, genesis.MaxValidatorSize); err != nil {
+				return err
+			}
+			if err := ec.recordElection(i+1, candidates.weights(), validators, nil); err != nil {
+				return err
+			}
+			continue
 		}
 		if len(candidates) < safeSize {
 			//fmt.Print("whteaaa!!!!!",safeSize)
 			return errors.New("too few candidates")
 		}
-		sort.Sort(candidates)
+		// candidates are totally ordered, ties at the cutoff are decided the
+		// same way on every node
+		electionInput := candidates.weights()
 		if len(candidates) > maxValidatorSize {
 			candidates = candidates[:maxValidatorSize]
 		}
 
-		// shuffle candidates
-		// 打乱验证人列表，由于使用 seed 是由父块的 hash 以及当前周期编号组成，
-		// 所以每个节点计算出来的验证人列表也会一致
-		seed := int64(binary.LittleEndian.Uint32(crypto.Keccak512(parent.Hash().Bytes()))) + i
-		r := rand.New(rand.NewSource(seed))
-		for i := len(candidates) - 1; i > 0; i-- {
-			j := int(r.Int31n(int32(i + 1)))
-			candidates[i], candidates[j] = candidates[j], candidates[i]
-		}
-		sortedValidators := make([]common.Address, 0)
+		rankedValidators := make([]common.Address, 0, len(candidates))
 		for _, candidate := range candidates {
-			sortedValidators = append(sortedValidators, candidate.address)
+			rankedValidators = append(rankedValidators, candidate.address)
 		}
 
-		epochTrie, _ := types.NewEpochTrie(common.Hash{}, ec.DposContext.DB())
-		ec.DposContext.SetEpoch(epochTrie)
-		ec.DposContext.SetValidators(sortedValidators)
+		sortedValidators := shuffleValidators(candidates, parent.Hash(), i)
+		if err := checkValidatorSetSize(sortedValidators, genesis.MaxValidatorSize); err != nil {
+			return err
+		}
+		if ec.config == nil || len(ec.config.RankRewardCurve) == 0 {
+			rankedValidators = nil
+		}
+		if err := ec.recordElection(i+1, electionInput, sortedValidators, rankedValidators); err != nil {
+			return err
+		}
 		log.Info("Come to new epoch", "prevEpoch", i, "nextEpoch", i+1)
 	}
 	return nil
 }
 
-
-
-
+// shuffleValidators shuffles the elected candidates into the order they mint
+// in. The seed is derived from the parent hash and the epoch, so every node
+// computes the same order.
+func shuffleValidators(candidates sortableAddresses, parentHash common.Hash, prevEpoch int64) []common.Address {
+	// shuffle candidates
+	// 打乱验证人列表，由于使用 seed 是由父块的 hash 以及当前周期编号组成，
+	// 所以每个节点计算出来的验证人列表也会一致
+	seed := int64(binary.LittleEndian.Uint32(crypto.Keccak512(parentHash.Bytes()))) + prevEpoch
+	r := rand.New(rand.NewSource(seed))
+	for i := len(candidates) - 1; i > 0; i-- {
+		j := int(r.Int31n(int32(i + 1)))
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+	sortedValidators := make([]common.Address, 0)
+	for _, candidate := range candidates {
+		sortedValidators = append(sortedValidators, candidate.address)
+	}
+	return sortedValidators
+}
@@ -0,0 +1,730 @@
+package dpos
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/core/rawdb"
+	"github.com/happytoken/go-ethereum/core/state"
+	"github.com/happytoken/go-ethereum/core/types"
+	"github.com/happytoken/go-ethereum/crypto"
+	"github.com/happytoken/go-ethereum/ethdb"
+	"github.com/happytoken/go-ethereum/params"
+	"github.com/happytoken/go-ethereum/rpc"
+	"github.com/happytoken/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+// testChainReader is an in-memory consensus.ChainReader over a list of headers
+// indexed by their block number.
+type testChainReader struct {
+	config  *params.ChainConfig
+	headers []*types.Header
+}
+
+func (c *testChainReader) Config() *params.ChainConfig { return c.config }
+
+func (c *testChainReader) CurrentHeader() *types.Header {
+	if len(c.headers) == 0 {
+		return nil
+	}
+	return c.headers[len(c.headers)-1]
+}
+
+func (c *testChainReader) GetHeader(hash common.Hash, number uint64) *types.Header {
+	if header := c.GetHeaderByNumber(number); header != nil && header.Hash() == hash {
+		return header
+	}
+	return nil
+}
+
+func (c *testChainReader) GetHeaderByNumber(number uint64) *types.Header {
+	if number >= uint64(len(c.headers)) {
+		return nil
+	}
+	return c.headers[number]
+}
+
+func (c *testChainReader) GetHeaderByHash(hash common.Hash) *types.Header {
+	for _, header := range c.headers {
+		if header.Hash() == hash {
+			return header
+		}
+	}
+	return nil
+}
+
+func (c *testChainReader) GetBlock(hash common.Hash, number uint64) *types.Block {
+	if header := c.GetHeader(hash, number); header != nil {
+		return types.NewBlockWithHeader(header)
+	}
+	return nil
+}
+
+func TestAPIGetDposRoots(t *testing.T) {
+	chain := &testChainReader{config: params.DposChainConfig}
+	for i := 0; i < 3; i++ {
+		chain.headers = append(chain.headers, &types.Header{
+			Number: big.NewInt(int64(i)),
+			DposContext: &types.DposContextProto{
+				EpochHash:     common.BytesToHash([]byte{byte(i), 1}),
+				DelegateHash:  common.BytesToHash([]byte{byte(i), 2}),
+				CandidateHash: common.BytesToHash([]byte{byte(i), 3}),
+				VoteHash:      common.BytesToHash([]byte{byte(i), 4}),
+				MintCntHash:   common.BytesToHash([]byte{byte(i), 5}),
+			},
+		})
+	}
+	api := &API{chain: chain, dpos: New(nil, ethdb.NewMemDatabase())}
+
+	number := BlockNumber(1)
+	roots, err := api.GetDposRoots(&number)
+	assert.Nil(t, err)
+	assert.Equal(t, chain.headers[1].DposContext, roots)
+
+	// latest block by default
+	roots, err = api.GetDposRoots(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, chain.headers[2].DposContext, roots)
+
+	// roots are exposed under the gencodec json names
+	blob, err := json.Marshal(roots)
+	assert.Nil(t, err)
+	fields := map[string]common.Hash{}
+	assert.Nil(t, json.Unmarshal(blob, &fields))
+	assert.Equal(t, roots.EpochHash, fields["epochRoot"])
+	assert.Equal(t, roots.DelegateHash, fields["delegateRoot"])
+	assert.Equal(t, roots.CandidateHash, fields["candidateRoot"])
+	assert.Equal(t, roots.VoteHash, fields["voteRoot"])
+	assert.Equal(t, roots.MintCntHash, fields["mintCntRoot"])
+
+	// missing headers are reported
+	number = BlockNumber(10)
+	_, err = api.GetDposRoots(&number)
+	assert.Equal(t, errUnknownBlock, err)
+}
+
+func TestAPIGetEpochInfo(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	validators := []common.Address{
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	assert.Nil(t, dposContext.SetValidators(validators))
+
+	// blocks minted in the previous epoch don't count towards the current one
+	epoch := int64(3)
+	setMintCntTrie(epoch-1, validators[0], dposContext.MintCntTrie(), 7)
+	setMintCntTrie(epoch, validators[0], dposContext.MintCntTrie(), 4)
+	setMintCntTrie(epoch, validators[1], dposContext.MintCntTrie(), 3)
+	setMintCntTrie(epoch, validators[2], dposContext.MintCntTrie(), 5)
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+	genesis.DposContext = &types.DposContextProto{}
+	head := &types.Header{
+		Number:      big.NewInt(1),
+		Time:        big.NewInt(epoch*epochInterval + epochInterval/2),
+		DposContext: proto,
+	}
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis, head}}
+	api := &API{chain: chain, dpos: New(nil, db)}
+
+	info, err := api.GetEpochInfo(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, epoch, info.Epoch)
+	assert.Equal(t, epoch*epochInterval, info.StartTime)
+	assert.Equal(t, (epoch+1)*epochInterval, info.EndTime)
+	assert.Equal(t, validators, info.Validators)
+	assert.Equal(t, int64(12), info.MintedBlocks)
+	assert.Equal(t, epochInterval/blockInterval, info.ExpectedBlocks)
+
+	number := BlockNumber(5)
+	_, err = api.GetEpochInfo(&number)
+	assert.Equal(t, errUnknownBlock, err)
+
+	// block based epochs have a fixed number of blocks
+	api.dpos = New(&params.DposConfig{EpochMode: params.BlockBased, BlocksPerEpoch: 100}, db)
+	info, err = api.GetEpochInfo(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), info.ExpectedBlocks)
+}
+
+func TestAPIGetGenesisDposParams(t *testing.T) {
+	api := &API{chain: &testChainReader{config: params.DposChainConfig}, dpos: New(&params.DposConfig{EpochOffset: 3600}, ethdb.NewMemDatabase())}
+	_, err := api.GetGenesisDposParams()
+	assert.Equal(t, errUnknownBlock, err)
+
+	genesis := newGenesisHeader(0)
+	api.chain = &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis}}
+	genesisParams, err := api.GetGenesisDposParams()
+	assert.Nil(t, err)
+	assert.Equal(t, &GenesisDposParams{
+		BlockInterval:    uint64(blockInterval),
+		MaxValidatorSize: uint64(maxValidatorSize),
+		EpochInterval:    epochInterval,
+		EpochOffset:      3600,
+	}, genesisParams)
+}
+
+func TestAPIGetAllVoters(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+	genesis.DposContext = dposContext.ToProto()
+
+	candidates := []common.Address{common.StringToAddress("candidate1"), common.StringToAddress("candidate2")}
+	for _, candidate := range candidates {
+		assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	}
+	voters := map[common.Address]bool{}
+	for i := 0; i < 5; i++ {
+		voter := common.StringToAddress("voter" + strconv.Itoa(i))
+		assert.Nil(t, dposContext.Delegate(voter, candidates[i%len(candidates)]))
+		voters[voter] = true
+	}
+	// changing a vote doesn't duplicate the voter
+	assert.Nil(t, dposContext.Delegate(common.StringToAddress("voter0"), candidates[1]))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	head := &types.Header{Number: big.NewInt(1), DposContext: proto}
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis, head}}
+	api := &API{chain: chain, dpos: New(nil, db)}
+
+	result, err := api.GetAllVoters(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(voters), len(result))
+	for _, voter := range result {
+		assert.True(t, voters[voter])
+	}
+
+	// no voters yields an empty list
+	number := BlockNumber(0)
+	result, err = api.GetAllVoters(&number)
+	assert.Nil(t, err)
+	assert.NotNil(t, result)
+	assert.Empty(t, result)
+}
+
+func TestAPIStatus(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	validators := []common.Address{
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	assert.Nil(t, dposContext.SetValidators(validators))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+	epoch := int64(2)
+	times := []int64{epoch * epochInterval, epoch*epochInterval + blockInterval, epoch*epochInterval + 2*blockInterval}
+	chain := newTestChain(genesis, validators, times, proto)
+
+	engine := New(nil, db)
+	engine.Authorize(validators[1], nil)
+	engine.confirmedBlockHeader = chain.headers[1]
+	api := &API{chain: chain, dpos: engine}
+
+	// mid slot of the node's own turn
+	status, err := api.status(epoch*epochInterval + blockInterval + blockInterval/2)
+	assert.Nil(t, err)
+	assert.Equal(t, &Status{
+		Validator:       validators[1],
+		IsValidator:     true,
+		Epoch:           epoch,
+		ConfirmedNumber: 1,
+		ConfirmedLag:    2,
+		BlockInterval:   uint64(blockInterval),
+		ValidatorCount:  len(validators),
+	}, status)
+
+	blob, err := json.Marshal(status)
+	assert.Nil(t, err)
+	fields := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(blob, &fields))
+	assert.Equal(t, validators[1].Hex(), common.HexToAddress(fields["validator"].(string)).Hex())
+	assert.Equal(t, true, fields["isValidator"])
+	assert.Equal(t, float64(epoch), fields["epoch"])
+	assert.Equal(t, float64(1), fields["confirmedNumber"])
+	assert.Equal(t, float64(2), fields["confirmedLag"])
+	assert.Equal(t, float64(blockInterval), fields["blockInterval"])
+	assert.Equal(t, float64(len(validators)), fields["validatorCount"])
+
+	// another validator's slot
+	status, err = api.status(epoch*epochInterval + 2*blockInterval)
+	assert.Nil(t, err)
+	assert.Equal(t, validators[2], status.Validator)
+	assert.False(t, status.IsValidator)
+}
+
+func TestAPIPendingDelegations(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	candidate := common.StringToAddress("candidate")
+	voter := common.StringToAddress("voter")
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	head := &types.Header{Number: big.NewInt(0), DposContext: proto}
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{head}}
+	engine := New(nil, db)
+	api := &API{chain: chain, dpos: engine}
+
+	// nothing pending without a miner
+	_, err = api.GetPendingVote(voter)
+	assert.Equal(t, errNoPendingBlock, err)
+	_, err = api.GetPendingDelegators(candidate)
+	assert.Equal(t, errNoPendingBlock, err)
+
+	var pending *types.DposContext
+	engine.SetPendingContext(func() *types.DposContext { return pending })
+	_, err = api.GetPendingVote(voter)
+	assert.Equal(t, errNoPendingBlock, err)
+
+	// an uncommitted vote shows up in the pending state only
+	pending = dposContext.Copy()
+	assert.Nil(t, pending.Delegate(voter, candidate))
+
+	vote, err := api.GetPendingVote(voter)
+	assert.Nil(t, err)
+	assert.Equal(t, candidate, vote)
+	delegators, err := api.GetPendingDelegators(candidate)
+	assert.Nil(t, err)
+	assert.Equal(t, []common.Address{voter}, delegators)
+
+	voters, err := api.GetAllVoters(nil)
+	assert.Nil(t, err)
+	assert.Empty(t, voters)
+
+	// no vote is reported as the zero address
+	vote, err = api.GetPendingVote(common.StringToAddress("nobody"))
+	assert.Nil(t, err)
+	assert.Equal(t, common.Address{}, vote)
+}
+
+func TestAPIExplainElection(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+
+	genesis := newGenesisHeader(0)
+	genesis.MaxValidatorSize = 4
+	epoch := int64(2)
+
+	// three productive validators and an idle one, all elected last epoch
+	validators := []common.Address{
+		common.StringToAddress("validator0"),
+		common.StringToAddress("validator1"),
+		common.StringToAddress("validator2"),
+		common.StringToAddress("idle"),
+	}
+	expected := epochInterval / blockInterval / int64(genesis.MaxValidatorSize)
+	for i, validator := range validators {
+		assert.Nil(t, dposContext.BecomeCandidate(validator))
+		if i < 3 {
+			setMintCntTrie(epoch-1, validator, dposContext.MintCntTrie(), expected)
+		}
+	}
+	assert.Nil(t, dposContext.SetValidators(validators))
+	var (
+		low   = common.StringToAddress("low")
+		mid   = common.StringToAddress("mid")
+		fresh = common.StringToAddress("fresh")
+	)
+	assert.Nil(t, dposContext.BecomeCandidate(low))
+	assert.Nil(t, dposContext.BecomeCandidate(mid))
+	assert.Nil(t, dposContext.RegisterCandidate(fresh, epoch-1))
+
+	weights := map[common.Address]int64{validators[0]: 40, validators[1]: 30, validators[2]: 20, validators[3]: 50, mid: 10, fresh: 60}
+	for candidate, weight := range weights {
+		voter := common.BytesToAddress(append([]byte("voter"), candidate[15:]...))
+		stateDB.AddBalance(voter, big.NewInt(weight))
+		assert.Nil(t, dposContext.Delegate(voter, candidate))
+	}
+	root, err := stateDB.Commit(true)
+	assert.Nil(t, err)
+	assert.Nil(t, stateDB.Database().TrieDB().Commit(root, false))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis.DposContext = proto
+	parent := &types.Header{
+		ParentHash:  genesis.Hash(),
+		Number:      big.NewInt(1),
+		Time:        big.NewInt((epoch - 1) * epochInterval),
+		Root:        root,
+		DposContext: proto,
+	}
+	config := &params.DposConfig{CandidateWarmupEpochs: 1}
+
+	// hold the election the way the first block of the epoch did
+	elected, err := types.NewDposContextFromProto(trie.NewDatabase(db), proto)
+	assert.Nil(t, err)
+	header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2), Time: big.NewInt(epoch * epochInterval)}
+	epochContext := &EpochContext{TimeStamp: header.Time.Int64(), DposContext: elected, statedb: stateDB, config: config}
+	assert.Nil(t, epochContext.tryElect(genesis, parent))
+	header.DposContext, err = elected.Commit()
+	assert.Nil(t, err)
+
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis, parent, header}}
+	engine := New(config, db)
+	api := &API{chain: chain, dpos: engine}
+
+	tests := []struct {
+		candidate common.Address
+		elected   bool
+		reason    string
+		weight    int64
+		rank      int
+	}{
+		{validators[0], true, electionElected, 40, 1},
+		{mid, true, electionElected, 10, 4},
+		{low, false, electionBelowCutoff, 0, 5},
+		{validators[3], false, electionKickedOut, 50, 0},
+		{fresh, false, electionWarmingUp, 60, 0},
+		{common.StringToAddress("nobody"), false, electionNoCandidate, 0, 0},
+	}
+	for _, test := range tests {
+		explanation, err := api.ExplainElection(test.candidate, epoch)
+		assert.Nil(t, err)
+		assert.Equal(t, test.elected, explanation.Elected, test.reason)
+		assert.Equal(t, test.reason, explanation.Reason)
+		assert.Equal(t, big.NewInt(test.weight), explanation.Weight, test.reason)
+		assert.Equal(t, test.rank, explanation.Rank, test.reason)
+		assert.Equal(t, big.NewInt(10), explanation.Cutoff, test.reason)
+	}
+	explanation, err := api.ExplainElection(validators[3], epoch)
+	assert.Nil(t, err)
+	assert.True(t, explanation.KickedOut)
+	explanation, err = api.ExplainElection(fresh, epoch)
+	assert.Nil(t, err)
+	assert.True(t, explanation.WarmingUp)
+
+	// no election has been held for epochs past the head
+	_, err = api.ExplainElection(low, epoch+1)
+	assert.Equal(t, errEpochNotElected, err)
+	_, err = api.ExplainElection(low, 0)
+	assert.Equal(t, errEpochNotElected, err)
+}
+
+func TestAPINewElection(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	chain := newSealedTestChain(t, db, 3, 2)
+	engine := New(nil, db)
+	defer engine.Close()
+
+	server := rpc.NewServer()
+	assert.Nil(t, server.RegisterName("dpos", &API{chain: chain, dpos: engine}))
+	client := rpc.DialInProc(server)
+	defer client.Close()
+
+	elections := make(chan ElectionEvent, 4)
+	sub, err := client.Subscribe(context.Background(), "dpos", elections, "newElection")
+	assert.Nil(t, err)
+	defer sub.Unsubscribe()
+	// the server activates the subscription only after replying with its id
+	time.Sleep(100 * time.Millisecond)
+
+	// only the first blocks of the later epochs elect validators
+	for _, header := range chain.headers {
+		assert.Nil(t, engine.NewHead(chain, header))
+	}
+	for epoch := int64(1); epoch < 3; epoch++ {
+		select {
+		case ev := <-elections:
+			expected, err := types.OpenEpochTrieOnly(chain.headers[2*epoch+1].DposContext.EpochHash, trie.NewDatabase(db))
+			assert.Nil(t, err)
+			validators, err := expected.GetValidators()
+			assert.Nil(t, err)
+			assert.Equal(t, epoch, ev.Epoch)
+			assert.Equal(t, validators, ev.Validators)
+		case err := <-sub.Err():
+			t.Fatalf("subscription failed: %v", err)
+		case <-time.After(time.Second):
+			t.Fatalf("no election of epoch %d", epoch)
+		}
+	}
+	select {
+	case ev := <-elections:
+		t.Fatalf("unexpected election of epoch %d", ev.Epoch)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAPIGetAccountDelegations(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+
+	candidates := []common.Address{common.StringToAddress("candidate0"), common.StringToAddress("candidate1")}
+	for _, candidate := range candidates {
+		assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	}
+	delegator := common.StringToAddress("delegator")
+	stateDB.AddBalance(delegator, big.NewInt(100))
+	assert.Nil(t, dposContext.Delegate(delegator, candidates[0]))
+	root, err := stateDB.Commit(true)
+	assert.Nil(t, err)
+	assert.Nil(t, stateDB.Database().TrieDB().Commit(root, false))
+	voted, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	// voting for another candidate moves the whole stake
+	assert.Nil(t, dposContext.Delegate(delegator, candidates[1]))
+	revoted, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+	genesis.DposContext = voted
+	genesis.Root = root
+	head := &types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), Time: big.NewInt(blockInterval), Root: root, DposContext: revoted}
+	api := &API{chain: &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis, head}}, dpos: New(nil, db)}
+
+	number := BlockNumber(0)
+	allocations, err := api.GetAccountDelegations(delegator, &number)
+	assert.Nil(t, err)
+	assert.Equal(t, []Allocation{{Candidate: candidates[0], Weight: big.NewInt(100)}}, allocations)
+
+	allocations, err = api.GetAccountDelegations(delegator, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []Allocation{{Candidate: candidates[1], Weight: big.NewInt(100)}}, allocations)
+
+	// accounts that don't vote back nobody
+	allocations, err = api.GetAccountDelegations(candidates[0], nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(allocations))
+}
+
+func TestAPIGetSigner(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	chain := newSealedTestChain(t, db, 2, 3)
+	api := &API{chain: chain, dpos: New(nil, db)}
+
+	for _, header := range chain.headers[1:] {
+		number := BlockNumber(header.Number.Int64())
+		signer, err := api.GetSigner(&number)
+		assert.Nil(t, err)
+		assert.Equal(t, header.Validator, signer)
+	}
+
+	// the signer is recovered from the seal, whatever validator the header claims
+	key, _ := crypto.GenerateKey()
+	head := chain.CurrentHeader()
+	signTestHeader(t, head, key)
+	signer, err := api.GetSigner(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, crypto.PubkeyToAddress(key.PublicKey), signer)
+	assert.NotEqual(t, head.Validator, signer)
+
+	genesis := BlockNumber(0)
+	_, err = api.GetSigner(&genesis)
+	assert.Equal(t, errGenesisHeader, err)
+}
+
+func TestAPIFinalizedAndSafeTags(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	chain := newSealedTestChain(t, db, 2, 3)
+	engine := New(&params.DposConfig{SafeDepth: 2}, db)
+	api := &API{chain: chain, dpos: engine}
+	finalized, safe := FinalizedBlockNumber, SafeBlockNumber
+
+	// nothing confirmed nor stored yet
+	_, err := api.GetSigner(&finalized)
+	assert.Equal(t, errUnknownBlock, err)
+
+	confirmed := chain.headers[2]
+	engine.confirmedBlockHeader = confirmed
+	assert.Equal(t, confirmed, api.getHeader(&finalized))
+	signer, err := api.GetSigner(&finalized)
+	assert.Nil(t, err)
+	assert.Equal(t, confirmed.Validator, signer)
+	roots, err := api.GetDposRoots(&finalized)
+	assert.Nil(t, err)
+	assert.Equal(t, confirmed.DposContext, roots)
+
+	// the safe block trails the head by the safe depth...
+	head := chain.CurrentHeader()
+	assert.Equal(t, chain.headers[head.Number.Uint64()-2], api.getHeader(&safe))
+
+	// ...unless the confirmed block is more recent
+	engine.confirmedBlockHeader = chain.headers[head.Number.Uint64()-1]
+	assert.Equal(t, engine.confirmedBlockHeader, api.getHeader(&safe))
+
+	// without a safe depth it's the confirmed block
+	engine.config = &params.DposConfig{}
+	engine.confirmedBlockHeader = confirmed
+	assert.Equal(t, confirmed, api.getHeader(&safe))
+
+	// the tags are understood by the dpos API, the shared block number is untouched
+	server := rpc.NewServer()
+	assert.Nil(t, server.RegisterName("dpos", api))
+	client := rpc.DialInProc(server)
+	defer client.Close()
+	for _, tag := range []string{"finalized", "safe"} {
+		var signer common.Address
+		assert.Nil(t, client.Call(&signer, "dpos_getSigner", tag))
+		assert.Equal(t, confirmed.Validator, signer)
+
+		var number rpc.BlockNumber
+		assert.NotNil(t, json.Unmarshal([]byte(`"`+tag+`"`), &number))
+	}
+	var number BlockNumber
+	assert.Nil(t, json.Unmarshal([]byte(`"0x2"`), &number))
+	assert.Equal(t, BlockNumber(2), number)
+}
+
+func TestCandidateWeightCache(t *testing.T) {
+	engine := New(nil, ethdb.NewMemDatabase())
+	tallies := 0
+	tally := func() (map[common.Address]*big.Int, error) {
+		tallies++
+		return map[common.Address]*big.Int{common.StringToAddress("candidate"): big.NewInt(int64(tallies))}, nil
+	}
+	block, other := common.HexToHash("0x01"), common.HexToHash("0x02")
+
+	// repeated calls for the same block are served from the cache
+	first, err := engine.weights.get(block, tally)
+	assert.Nil(t, err)
+	second, err := engine.weights.get(block, tally)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, tallies)
+	assert.Equal(t, first, second)
+
+	// other blocks are tallied anew
+	_, err = engine.weights.get(other, tally)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, tallies)
+
+	// as are blocks whose weights expired
+	engine.weights.expires = time.Now()
+	_, err = engine.weights.get(other, tally)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, tallies)
+
+	// failed tallies aren't cached
+	_, err = engine.weights.get(block, func() (map[common.Address]*big.Int, error) { return nil, errNoCandidates })
+	assert.Equal(t, errNoCandidates, err)
+	_, err = engine.weights.get(block, tally)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, tallies)
+
+	// a new head invalidates the cache
+	genesis := newGenesisHeader(0)
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis}}
+	assert.Nil(t, engine.NewHead(chain, genesis))
+	_, err = engine.weights.get(block, tally)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, tallies)
+}
+
+func TestAPIGetBlockReward(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	validator := common.StringToAddress("validator")
+	payout := common.StringToAddress("payout")
+	subsidy := new(big.Int).Set(byzantiumBlockReward)
+	epoch := int64(3)
+	// the cap leaves a third of the subsidy to the second block of the epoch
+	config := *params.DposChainConfig
+	config.Dpos = &params.DposConfig{BaseFeeBurnRatio: 50, EpochRewardCap: big.NewInt(4e18)}
+	capped := big.NewInt(1e18)
+
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.RegisterCandidate(validator, 0))
+	genesisProto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+	genesis.DposContext = genesisProto
+	chain := &testChainReader{config: &config, headers: []*types.Header{genesis}}
+	// addBlock records the block the way Finalize accounts its rewards
+	addBlock := func(time int64, txs []*types.Transaction, receipts types.Receipts, credited *big.Int) {
+		parent := chain.headers[len(chain.headers)-1]
+		assert.Nil(t, dposContext.AddEpochReward(EpochID(nil, time), credited))
+		proto, err := dposContext.Commit()
+		assert.Nil(t, err)
+		header := &types.Header{
+			ParentHash:  parent.Hash(),
+			Number:      new(big.Int).Add(parent.Number, common.Big1),
+			Time:        big.NewInt(time),
+			Validator:   validator,
+			Coinbase:    validator,
+			DposContext: proto,
+		}
+		rawdb.WriteBody(db, header.Hash(), header.Number.Uint64(), &types.Body{Transactions: txs})
+		rawdb.WriteReceipts(db, header.Hash(), header.Number.Uint64(), receipts)
+		chain.headers = append(chain.headers, header)
+	}
+	newTx := func(gasPrice int64, gasUsed uint64) (*types.Transaction, *types.Receipt) {
+		receipt := types.NewReceipt(nil, false, gasUsed)
+		receipt.GasUsed = gasUsed
+		return types.NewTransaction(types.Binary, 0, common.Address{}, new(big.Int), gasUsed, big.NewInt(gasPrice), nil), receipt
+	}
+	// a block without transactions earns the subsidy
+	addBlock(epoch*epochInterval+blockInterval, nil, nil, subsidy)
+
+	// fees are added on top, less the burnt share, the rewards go to the payout address
+	tx1, receipt1 := newTx(2, 21000)
+	tx2, receipt2 := newTx(3, 50000)
+	fees := big.NewInt(2*21000 + 3*50000)
+	burnt := new(big.Int).Div(fees, big.NewInt(2))
+	assert.Nil(t, dposContext.SetPayout(validator, payout))
+	addBlock(epoch*epochInterval+2*blockInterval, types.Transactions{tx1, tx2}, types.Receipts{receipt1, receipt2},
+		new(big.Int).Add(capped, new(big.Int).Sub(fees, burnt)))
+
+	// the first block of an epoch starts its rewards over
+	addBlock((epoch+1)*epochInterval, nil, nil, subsidy)
+
+	api := &API{chain: chain, dpos: New(config.Dpos, db)}
+	number := BlockNumber(1)
+	info, err := api.GetBlockReward(&number)
+	assert.Nil(t, err)
+	assert.Equal(t, &BlockRewardInfo{Validator: validator, Payout: validator, Subsidy: subsidy, Fees: new(big.Int), Burnt: new(big.Int), Net: subsidy}, info)
+
+	number = BlockNumber(2)
+	info, err = api.GetBlockReward(&number)
+	assert.Nil(t, err)
+	assert.Equal(t, payout, info.Payout)
+	assert.Equal(t, capped, info.Subsidy)
+	assert.Equal(t, fees, info.Fees)
+	assert.Equal(t, burnt, info.Burnt)
+	assert.Equal(t, new(big.Int).Add(capped, burnt), info.Net)
+
+	number = BlockNumber(3)
+	info, err = api.GetBlockReward(&number)
+	assert.Nil(t, err)
+	assert.Equal(t, subsidy, info.Subsidy)
+	assert.Equal(t, subsidy, info.Net)
+
+	// omitting the number refers to the latest block
+	info, err = api.GetBlockReward(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, subsidy, info.Subsidy)
+
+	number = BlockNumber(0)
+	_, err = api.GetBlockReward(&number)
+	assert.Equal(t, errGenesisHeader, err)
+	number = BlockNumber(4)
+	_, err = api.GetBlockReward(&number)
+	assert.Equal(t, errUnknownBlock, err)
+}
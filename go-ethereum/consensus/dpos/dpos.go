@@ -3,9 +3,16 @@ package dpos
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"math"
 	"math/big"
+	"math/rand"
+	"strconv"
 	"sync"
 	"time"
 
@@ -18,6 +25,7 @@ import (
 	"github.com/happytoken/go-ethereum/crypto"
 	"github.com/happytoken/go-ethereum/crypto/sha3"
 	"github.com/happytoken/go-ethereum/ethdb"
+	"github.com/happytoken/go-ethereum/event"
 	"github.com/happytoken/go-ethereum/log"
 	"github.com/happytoken/go-ethereum/params"
 	"github.com/happytoken/go-ethereum/rlp"
@@ -31,9 +39,14 @@ const (
 	extraVanity        = 32   // Fixed number of extra-data prefix bytes reserved for signer vanity
 	extraSeal          = 65   // Fixed number of extra-data suffix bytes reserved for signer seal
 	inmemorySignatures = 4096 // Number of recent block signatures to keep in memory
+	confirmationWalk   = 1024 // Number of headers below the head searched for the block to confirm
+	epochHistoryWindow = 64   // Number of epochs whose validators, election input and rewards are kept
+
+	defaultMintDeadlineGrace = uint64(1) // Default seconds before the next slot to stop waiting for the previous block
+	defaultStallSlots        = uint64(10) // Default number of consecutive missed slots to report the chain as stalled
 
 	//blockInterval    = int64(10)  	//出块间隔
-	epochInterval    = int64(86400)  //选举周期间隔24 *60*60 s
+	epochInterval    = int64(params.DposEpochInterval)  //选举周期间隔24 *60*60 s
 	//maxValidatorSize = 21
 	//safeSize         =  15	//maxValidatorSize*2/3 + 1
 	//consensusSize    =  15 	//maxValidatorSize*2/3 + 1
@@ -51,13 +64,17 @@ var (
 
 	timeOfFirstBlock = int64(0)
 
-	confirmedBlockHead = []byte("confirmed-block-head")
+	confirmedBlockHead   = []byte("confirmed-block-head")
+	confirmedHeaderPrefix = []byte("confirmed-header-") // confirmedHeaderPrefix + num (uint64 big endian) -> rlp(header)
 )
 
 var (
 	// errUnknownBlock is returned when the list of signers is requested for a block
 	// that is not part of the local blockchain.
 	errUnknownBlock = errors.New("unknown block")
+	// errGenesisHeader is returned if the genesis header is verified, there is
+	// no parent to verify it against.
+	errGenesisHeader = errors.New("genesis header can't be verified")
 	// errMissingVanity is returned if a block's extra-data section is shorter than
 	// 32 bytes, which is required to store the signer vanity.
 	errMissingVanity = errors.New("extra-data 32 byte vanity prefix missing")
@@ -70,8 +87,8 @@ var (
 	errInvalidUncleHash  = errors.New("non empty uncle hash")
 	errInvalidDifficulty = errors.New("invalid difficulty")
 
-	// ErrInvalidTimestamp is returned if the timestamp of a block is lower than
-	// the previous block's timestamp + the minimum block period.
+	// ErrInvalidTimestamp is returned if the timestamp of a block isn't in a
+	// later slot than the previous block's timestamp.
 	ErrInvalidTimestamp           = errors.New("invalid timestamp")
 	ErrWaitForPrevBlock           = errors.New("wait for last block arrived")
 	ErrMintFutureBlock            = errors.New("mint the future block")
@@ -79,22 +96,81 @@ var (
 	ErrInvalidBlockValidator      = errors.New("invalid block validator")
 	ErrInvalidMintBlockTime       = errors.New("invalid time to mint the block")
 	ErrNilBlockHeader             = errors.New("nil block header returned")
+	// ErrCoinbaseValidatorMismatch is returned if a block pays its rewards to an
+	// address other than its validator on chains requiring them to match.
+	ErrCoinbaseValidatorMismatch = errors.New("coinbase differs from validator")
+	// ErrSignerNotAuthorized is returned if a block is sealed before a signer
+	// was authorized.
+	ErrSignerNotAuthorized = errors.New("signer not authorized")
+	// ErrProductionPaused is returned if a block is to be minted while block
+	// production is paused by the operator.
+	ErrProductionPaused = errors.New("block production paused")
+	// ErrNotActivated is returned if a block is to be minted before the
+	// activation time of the chain.
+	ErrNotActivated = errors.New("block production not activated yet")
+	// ErrDposRootMismatch is returned if the dpos roots declared by a block differ
+	// from the ones of its recomputed dpos state.
+	ErrDposRootMismatch = errors.New("dpos root mismatch")
+	// ErrInvalidValidatorSetSize is returned if a validator set is empty or
+	// larger than the maximum validator size of the chain.
+	ErrInvalidValidatorSetSize = errors.New("invalid validator set size")
+	// ErrInvalidGasLimit is returned if the gas limit of a block moved too far
+	// from its parent's on chains bounding the change.
+	ErrInvalidGasLimit = errors.New("invalid gas limit")
+	// ErrReorgTooDeep is returned if a reorg would drop more canonical blocks
+	// than MaxAllowedReorgDepth allows.
+	ErrReorgTooDeep = errors.New("reorg too deep")
+
+	// errNoPendingBlock is returned if the pending dpos state is requested while
+	// no block is being mined.
+	errNoPendingBlock = errors.New("no block being mined")
+	// errNoSlotSchedule is returned if the slot schedule of an epoch is
+	// requested on a chain with block based epochs.
+	errNoSlotSchedule = errors.New("block based epochs have no slot schedule")
+	// errEpochNotElected is returned if an election is explained for an epoch
+	// the local chain hasn't held an election for.
+	errEpochNotElected = errors.New("epoch not elected")
+	// errNotVoteElected is returned if an election is explained on a chain whose
+	// validators come from a validator provider instead of votes.
+	errNotVoteElected = errors.New("validators not elected by votes")
 )
 var (
 	uncleHash = types.CalcUncleHash(nil) // Always Keccak256(RLP([])) as uncles are meaningless outside of PoW.
 )
 
+// Dpos is the delegated-proof-of-stake consensus engine. Everything it keeps in
+// memory is either persisted as it changes, like the confirmed block, derived
+// deterministically from the chain, like the signature and weight caches, or
+// set up anew by the operator after a restart, like the signer and a pause.
+// A node killed at any point thus behaves the same after restarting.
 type Dpos struct {
 	config *params.DposConfig // Consensus engine configuration parameters
 	db      ethdb.Database     // Database to store and retrieve snapshot checkpoints
 
 	signer               common.Address
+	account              accounts.Account // Signing account, including the wallet URL if known
 	signFn               SignerFn
 	signatures           *lru.ARCCache // Signatures of recent blocks to speed up mining
-	confirmedBlockHeader *types.Header
+	confirmedBlockHeader *types.Header // Irreversible block, guarded by confirmedMu
+	provider             ValidatorProvider // Optional validator set source replacing the vote election
+	pending              func() *types.DposContext // Dpos state of the block being mined, if any
+	paused               bool                      // Whether block production is paused by the operator
+	weights              candidateWeightCache      // Candidate weights last tallied by the RPC API
+
+	mu          sync.RWMutex
+	confirmedMu sync.Mutex // Serializes every access to the confirmed block
+	stop      chan bool // Closed when the engine is closed
+	closeOnce sync.Once
 
-	mu   sync.RWMutex
-	stop chan bool
+	electionFeed event.Feed
+	scope        event.SubscriptionScope
+}
+
+// ElectionEvent is posted when a block electing the validators of a new epoch
+// became the head of the chain.
+type ElectionEvent struct {
+	Epoch      int64            `json:"epoch"`
+	Validators []common.Address `json:"validators"`
 }
 
 type SignerFn func(accounts.Account, []byte) ([]byte, error)
@@ -107,44 +183,118 @@ type SignerFn func(accounts.Account, []byte) ([]byte, error)
 // Note, the method requires the extra data to be at least 65 bytes, otherwise it
 // panics. This is done to avoid accidentally using both forms (signature present
 // or not), which could be abused to produce different hashes for the same header.
-func sigHash(header *types.Header) (hash common.Hash) {
-	hasher := sha3.NewKeccak256()
-
-	rlp.Encode(hasher, []interface{}{
-		header.ParentHash,
-		header.UncleHash,
-		header.Validator,
-		header.Coinbase,
-		header.Root,
-		header.TxHash,
-		header.ReceiptHash,
-		header.Bloom,
-		header.Difficulty,
-		header.Number,
-		header.GasLimit,
-		header.GasUsed,
-		header.Time,
-		header.Extra[:len(header.Extra)-65], // Yes, this will panic if extra is too short
-		header.MixDigest,
-		header.Nonce,
-		header.DposContext.Root(),
-		header.MaxValidatorSize,			//add MaxValidatorSize
-	})
-	hasher.Sum(hash[:0])
+func sigHash(header *types.Header) (h common.Hash) {
+	hasher := sigHasherPool.Get().(keccakState)
+	defer sigHasherPool.Put(hasher)
+	hasher.Reset()
 
-	return hash
+	fields := sigFieldsPool.Get().(*sigFields)
+	defer sigFieldsPool.Put(fields)
+	*fields = sigFields{
+		ParentHash:       header.ParentHash,
+		UncleHash:        header.UncleHash,
+		Validator:        header.Validator,
+		Coinbase:         header.Coinbase,
+		Root:             header.Root,
+		TxHash:           header.TxHash,
+		ReceiptHash:      header.ReceiptHash,
+		Bloom:            header.Bloom,
+		Difficulty:       header.Difficulty,
+		Number:           header.Number,
+		GasLimit:         header.GasLimit,
+		GasUsed:          header.GasUsed,
+		Time:             header.Time,
+		Extra:            header.Extra[:len(header.Extra)-65], // Yes, this will panic if extra is too short
+		MixDigest:        header.MixDigest,
+		Nonce:            header.Nonce,
+		DposRoot:         header.DposContext.Root(),
+		MaxValidatorSize: header.MaxValidatorSize, //add MaxValidatorSize
+	}
+	rlp.Encode(hasher, fields)
+	hasher.Read(h[:])
+
+	return h
 }
 
+// sigFields are the header fields covered by the seal, in signing order. The
+// struct encodes to the same RLP list as the fields listed one by one, without
+// boxing each of them.
+type sigFields struct {
+	ParentHash       common.Hash
+	UncleHash        common.Hash
+	Validator        common.Address
+	Coinbase         common.Address
+	Root             common.Hash
+	TxHash           common.Hash
+	ReceiptHash      common.Hash
+	Bloom            types.Bloom
+	Difficulty       *big.Int
+	Number           *big.Int
+	GasLimit         uint64
+	GasUsed          uint64
+	Time             *big.Int
+	Extra            []byte
+	MixDigest        common.Hash
+	Nonce            types.BlockNonce
+	DposRoot         common.Hash
+	MaxValidatorSize uint64
+}
+
+// keccakState is a keccak hasher that can also be read from, which unlike Sum
+// doesn't copy the hasher state. It has to be reset before reuse though.
+type keccakState interface {
+	hash.Hash
+	Read([]byte) (int, error)
+}
+
+var (
+	sigHasherPool = sync.Pool{New: func() interface{} { return sha3.NewKeccak256().(keccakState) }}
+	sigFieldsPool = sync.Pool{New: func() interface{} { return new(sigFields) }}
+)
+
 func New(config *params.DposConfig, db ethdb.Database) *Dpos {
+	// Set any missing consensus parameters to their defaults
+	conf := params.DposConfig{}
+	if config != nil {
+		conf = *config
+	}
+	if conf.MintDeadlineGrace == 0 {
+		conf.MintDeadlineGrace = defaultMintDeadlineGrace
+	}
+	if conf.StallSlots == 0 {
+		conf.StallSlots = defaultStallSlots
+	}
 	signatures, _ := lru.NewARC(inmemorySignatures)
 
+	var provider ValidatorProvider
+	if conf.ValidatorContract != nil {
+		provider = NewContractValidatorProvider(*conf.ValidatorContract)
+	}
 	return &Dpos{
-		config:     config,
+		config:     &conf,
 		db:         db,
 		signatures: signatures,
+		provider:   provider,
+		stop:       make(chan bool),
 	}
 }
 
+// SetValidatorProvider replaces the vote based election with the validator set
+// returned by the given provider. A nil provider restores the vote election.
+func (d *Dpos) SetValidatorProvider(provider ValidatorProvider) {
+	d.mu.Lock()
+	d.provider = provider
+	d.mu.Unlock()
+}
+
+// SetPendingContext sets the source of the dpos state of the block currently
+// being mined, exposed by the pending queries of the API.
+func (d *Dpos) SetPendingContext(pending func() *types.DposContext) {
+	d.mu.Lock()
+	d.pending = pending
+	d.mu.Unlock()
+}
+
 func (d *Dpos) Author(header *types.Header) (common.Address, error) {
 	return header.Validator, nil
 }
@@ -159,6 +309,9 @@ func (d *Dpos) verifyHeader(chain consensus.ChainReader, header *types.Header, p
 		return errUnknownBlock
 	}
 	number := header.Number.Uint64()
+	if number == 0 {
+		return errGenesisHeader
+	}
 	// Unnecssary to verify the block from feature
 	if header.Time.Cmp(big.NewInt(time.Now().Unix())) > 0 {
 		return consensus.ErrFutureBlock
@@ -185,6 +338,9 @@ func (d *Dpos) verifyHeader(chain consensus.ChainReader, header *types.Header, p
 	if header.UncleHash != uncleHash {
 		return errInvalidUncleHash
 	}
+	if d.config.RequireCoinbaseEqualsValidator && header.Coinbase != header.Validator {
+		return ErrCoinbaseValidatorMismatch
+	}
 	// If all checks passed, validate any special fields for hard forks
 	if err := misc.VerifyForkHashes(chain.Config(), header, false); err != nil {
 		return err
@@ -199,9 +355,58 @@ func (d *Dpos) verifyHeader(chain consensus.ChainReader, header *types.Header, p
 	if parent == nil || parent.Number.Uint64() != number-1 || parent.Hash() != header.ParentHash {
 		return consensus.ErrUnknownAncestor
 	}
-	if parent.Time.Uint64()+blockInterval> header.Time.Uint64() {
+	// Blocks have to be in a later slot than their parent. Slots rather than
+	// raw times are compared, a block is only as early as the slot it's in.
+	if blockInterval == 0 {
+		if parent.Time.Cmp(header.Time) > 0 {
+			return ErrInvalidTimestamp
+		}
+	} else if slotStart(d.config, parent.Time.Int64(), blockInterval)+int64(blockInterval) > slotStart(d.config, header.Time.Int64(), blockInterval) {
 		return ErrInvalidTimestamp
 	}
+	if err := d.verifyGasLimit(parent, header); err != nil {
+		return err
+	}
+	return d.verifyHeaderValidator(parent, header, blockInterval)
+}
+
+// verifyGasLimit checks that the gas limit of the header stays within the
+// configured bound of its parent's, like ethash does.
+func (d *Dpos) verifyGasLimit(parent, header *types.Header) error {
+	if d.config == nil || d.config.GasLimitBoundDivisor == 0 {
+		return nil
+	}
+	diff := int64(parent.GasLimit) - int64(header.GasLimit)
+	if diff < 0 {
+		diff *= -1
+	}
+	limit := parent.GasLimit / d.config.GasLimitBoundDivisor
+	if uint64(diff) >= limit || header.GasLimit < params.MinGasLimit {
+		return ErrInvalidGasLimit
+	}
+	return nil
+}
+
+// verifyHeaderValidator rejects headers claiming a validator other than the one
+// of their slot, before the costly signature recovery of the seal check. The
+// check is skipped if the parent's dpos state isn't available locally, e.g.
+// during header-only sync.
+func (d *Dpos) verifyHeaderValidator(parent, header *types.Header, blockInterval uint64) error {
+	if parent.DposContext == nil {
+		return nil
+	}
+	dposContext, err := types.OpenEpochTrieOnly(parent.DposContext.EpochHash, trie.NewDatabase(d.db))
+	if err != nil {
+		return nil
+	}
+	epochContext := &EpochContext{DposContext: dposContext, config: d.config}
+	validator, err := epochContext.lookupValidator(header.Time.Int64(), blockInterval)
+	if err != nil {
+		return err
+	}
+	if validator != header.Validator {
+		return ErrInvalidBlockValidator
+	}
 	return nil
 }
 
@@ -241,8 +446,44 @@ func (d *Dpos) VerifySeal(chain consensus.ChainReader, currentheader, genesishea
 }
 
 func (d *Dpos) verifySeal(chain consensus.ChainReader, currentheader, genesisheader *types.Header, parents []*types.Header) error {
+	return d.NewSealVerifier(genesisheader).Verify(chain, currentheader, parents)
+}
+
+// VerifySeals checks the seals of a batch of consecutive headers whose parents'
+// dpos state is available, e.g. during sync. The validator set is read once for
+// every epoch trie the batch spans instead of once per header.
+func (d *Dpos) VerifySeals(chain consensus.ChainReader, headers []*types.Header, genesisheader *types.Header) []error {
+	verifier := d.NewSealVerifier(genesisheader)
+	errs := make([]error, len(headers))
+	for i, header := range headers {
+		errs[i] = verifier.Verify(chain, header, headers[:i])
+	}
+	return errs
+}
+
+// SealVerifier checks the seals of headers against the validators of their
+// parents' epoch trie. The validator set is kept for as long as consecutive
+// headers share the epoch trie, which is usually the case within an epoch, so
+// a verifier should be reused across the headers of a chain segment.
+type SealVerifier struct {
+	engine           *Dpos
+	blockInterval    uint64
+	maxValidatorSize uint64
+
+	epochHash  common.Hash      // Epoch trie the validators were read from
+	validators []common.Address // Validator set of the epoch trie, nil if not read yet
+}
+
+// NewSealVerifier creates a seal verifier for the chain of the given genesis.
+func (d *Dpos) NewSealVerifier(genesisheader *types.Header) *SealVerifier {
+	return &SealVerifier{engine: d, blockInterval: genesisheader.BlockInterval, maxValidatorSize: genesisheader.MaxValidatorSize}
+}
+
+// Verify checks the seal of the header. The parent is taken from the end of
+// parents if any are given, otherwise it's looked up in the chain.
+func (v *SealVerifier) Verify(chain consensus.ChainReader, header *types.Header, parents []*types.Header) error {
 	// Verifying the genesis block is not supported
-	number := currentheader.Number.Uint64()
+	number := header.Number.Uint64()
 	if number == 0 {
 		return errUnknownBlock
 	}
@@ -250,26 +491,40 @@ func (d *Dpos) verifySeal(chain consensus.ChainReader, currentheader, genesishea
 	if len(parents) > 0 {
 		parent = parents[len(parents)-1]
 	} else {
-		parent = chain.GetHeader(currentheader.ParentHash, number-1)
+		parent = chain.GetHeader(header.ParentHash, number-1)
 	}
-
-	trieDB := trie.NewDatabase(d.db)
-	dposContext, err := types.NewDposContextFromProto(trieDB, parent.DposContext) //todo nil
-
-	if err != nil {
-		return err
+	if parent == nil || parent.DposContext == nil {
+		return consensus.ErrUnknownAncestor
 	}
-	epochContext := &EpochContext{DposContext: dposContext}
-	blockInterVal := genesisheader.BlockInterval
-	validator, err := epochContext.lookupValidator(currentheader.Time.Int64(),blockInterVal)
+	if v.validators == nil || v.epochHash != parent.DposContext.EpochHash {
+		dposContext, err := types.OpenEpochTrieOnly(parent.DposContext.EpochHash, trie.NewDatabase(v.engine.db))
+		if err != nil {
+			return err
+		}
+		validators, err := dposContext.GetValidators()
+		if err != nil {
+			return err
+		}
+		if err := checkValidatorSetSize(validators, v.maxValidatorSize); err != nil {
+			return err
+		}
+		v.epochHash, v.validators = parent.DposContext.EpochHash, validators
+	}
+	validator, err := slotValidator(v.engine.config, v.validators, header.Time.Int64(), v.blockInterval)
 	if err != nil {
 		return err
 	}
 	//出块者签名验证
-	if err := d.verifyBlockSigner(validator, currentheader); err != nil {
-		return err
+	return v.engine.verifyBlockSigner(validator, header)
+}
+
+// checkValidatorSetSize checks that the validator set isn't empty and doesn't
+// exceed the maximum validator size.
+func checkValidatorSetSize(validators []common.Address, maxValidatorSize uint64) error {
+	if len(validators) == 0 || uint64(len(validators)) > maxValidatorSize {
+		return ErrInvalidValidatorSetSize
 	}
-	return d.updateConfirmedBlockHeader(chain)
+	return nil
 }
 
 func (d *Dpos) verifyBlockSigner(validator common.Address, header *types.Header) error {
@@ -286,55 +541,146 @@ func (d *Dpos) verifyBlockSigner(validator common.Address, header *types.Header)
 	return nil
 }
 
-func (d *Dpos) updateConfirmedBlockHeader(chain consensus.ChainReader) error {
-	if d.confirmedBlockHeader == nil {
-		header, err := d.loadConfirmedBlockHeader(chain)
-		if err != nil {
-			header = chain.GetHeaderByNumber(0)
-			if header == nil {
-				return err
-			}
+// VerifyDposRoots checks the dpos roots declared by the header against the ones
+// of the dpos state recomputed by processing its block.
+func VerifyDposRoots(header *types.Header, dposContext *types.DposContext) error {
+	if header.DposContext == nil {
+		return ErrDposRootMismatch
+	}
+	remote, local := header.DposContext, dposContext.ToProto()
+	for _, root := range []struct {
+		name          string
+		remote, local common.Hash
+	}{
+		{"epoch", remote.EpochHash, local.EpochHash},
+		{"delegate", remote.DelegateHash, local.DelegateHash},
+		{"candidate", remote.CandidateHash, local.CandidateHash},
+		{"vote", remote.VoteHash, local.VoteHash},
+		{"mintCnt", remote.MintCntHash, local.MintCntHash},
+	} {
+		if root.remote != root.local {
+			log.Warn("Dpos root mismatch", "number", header.Number, "trie", root.name, "remote", root.remote, "local", root.local)
+			return ErrDposRootMismatch
+		}
+	}
+	return nil
+}
+
+// UpdateConfirmedBlockHeader advances the irreversible block towards the head
+// of the chain. It has to be called once a block became the new head, seal
+// verification leaves the confirmation untouched.
+func (d *Dpos) UpdateConfirmedBlockHeader(chain consensus.ChainReader) error {
+	d.confirmedMu.Lock()
+	defer d.confirmedMu.Unlock()
+	return d.confirmBlocks(chain, chain.CurrentHeader())
+}
+
+// confirmBlocks advances the irreversible block towards the given head by the
+// configured finality rule. The caller has to hold confirmedMu.
+func (d *Dpos) confirmBlocks(chain consensus.ChainReader, curHeader *types.Header) error {
+	if _, err := d.trackConfirmedHeader(chain); err != nil {
+		header := chain.GetHeaderByNumber(0)
+		if header == nil {
+			return err
 		}
 		d.confirmedBlockHeader = header
 	}
+	confirmed, err := d.nextConfirmed(chain, d.confirmedBlockHeader, curHeader)
+	if err != nil || confirmed == d.confirmedBlockHeader {
+		return err
+	}
+	d.confirmedBlockHeader = confirmed
+	if err := d.storeConfirmedBlockHeader(d.db); err != nil {
+		return err
+	}
+	log.Debug("dpos set confirmed block header success", "currentHeader", confirmed.Number.String())
+	return nil
+}
+
+// nextConfirmed returns the irreversible block once the given head is added on
+// top of the confirmed one, which is returned as is if it doesn't advance.
+func (d *Dpos) nextConfirmed(chain consensus.ChainReader, confirmed, curHeader *types.Header) (*types.Header, error) {
+	if d.config.FinalityMode == params.FixedDepth {
+		return d.confirmDepth(chain, confirmed, curHeader)
+	}
 
-	curHeader := chain.CurrentHeader()
+	consensusSize := d.consensusSize(chain.GetHeaderByNumber(0), curHeader)
 
-	fmt.Println("+++++++++++++++++++555555++++++++++++++++++++++\n")
-	genesisHeader := chain.GetHeaderByNumber(0)
-	fmt.Println("+++++++++++++++++++from genesisBlock to get Maxvalidatorsize++++++++++++++++++++++\n")
-	epoch := int64(-1)
-	validatorMap := make(map[common.Address]bool)
-	for d.confirmedBlockHeader.Hash() != curHeader.Hash() &&
-		d.confirmedBlockHeader.Number.Uint64() < curHeader.Number.Uint64() {
-		curEpoch := curHeader.Time.Int64() / epochInterval
-		if curEpoch != epoch {
-			epoch = curEpoch
-			validatorMap = make(map[common.Address]bool)
+	// Count the distinct validators building on top of each block. The count
+	// deliberately carries across epoch boundaries, otherwise a window spanning
+	// an election could never gather enough signers in small validator sets.
+	// The walk ends once consensusSize validators are found, which bounds the
+	// set, and after confirmationWalk headers, which bounds the time spent on
+	// chains that haven't confirmed a block for long.
+	validatorMap := make(map[common.Address]bool, consensusSize)
+	for walked := 0; confirmed.Hash() != curHeader.Hash() &&
+		confirmed.Number.Uint64() < curHeader.Number.Uint64(); walked++ {
+		if walked == confirmationWalk {
+			log.Debug("Dpos confirmation walk exhausted", "current", curHeader.Number.String(), "confirmed", confirmed.Number.String(), "witnessCount", len(validatorMap))
+			return confirmed, nil
 		}
 		// fast return
 		// if block number difference less consensusSize-witnessNum
 		// there is no need to check block is confirmed
-		consensusSize :=int(genesisHeader.MaxValidatorSize*2/3+1)
-		if curHeader.Number.Int64()-d.confirmedBlockHeader.Number.Int64() < int64(consensusSize-len(validatorMap)) {
-			log.Debug("Dpos fast return", "current", curHeader.Number.String(), "confirmed", d.confirmedBlockHeader.Number.String(), "witnessCount", len(validatorMap))
-			return nil
+		if curHeader.Number.Int64()-confirmed.Number.Int64() < int64(consensusSize-len(validatorMap)) {
+			log.Debug("Dpos fast return", "current", curHeader.Number.String(), "confirmed", confirmed.Number.String(), "witnessCount", len(validatorMap))
+			return confirmed, nil
 		}
 		validatorMap[curHeader.Validator] = true
 		if len(validatorMap) >= consensusSize {
-			d.confirmedBlockHeader = curHeader
-			if err := d.storeConfirmedBlockHeader(d.db); err != nil {
-				return err
-			}
-			log.Debug("dpos set confirmed block header success", "currentHeader", curHeader.Number.String())
-			return nil
+			return curHeader, nil
 		}
 		curHeader = chain.GetHeaderByHash(curHeader.ParentHash)
 		if curHeader == nil {
-			return ErrNilBlockHeader
+			return nil, ErrNilBlockHeader
 		}
 	}
-	return nil
+	return confirmed, nil
+}
+
+// confirmDepth returns the ancestor of the given head lying FinalityDepth
+// blocks below it, or the confirmed block if that one isn't above it.
+func (d *Dpos) confirmDepth(chain consensus.ChainReader, confirmed, curHeader *types.Header) (*types.Header, error) {
+	depth := d.config.FinalityDepth
+	if curHeader.Number.Uint64() < depth || curHeader.Number.Uint64()-depth <= confirmed.Number.Uint64() {
+		return confirmed, nil
+	}
+	for i := uint64(0); i < depth; i++ {
+		curHeader = chain.GetHeader(curHeader.ParentHash, curHeader.Number.Uint64()-1)
+		if curHeader == nil {
+			return nil, ErrNilBlockHeader
+		}
+	}
+	return curHeader, nil
+}
+
+// consensusSize returns the number of distinct validators that have to mint on
+// top of a block to confirm it: two thirds plus one of the validators of the
+// given header's epoch, never more than the genesis maximum allows for.
+func (d *Dpos) consensusSize(genesis, header *types.Header) int {
+	size := int(genesis.MaxValidatorSize)
+	if header.DposContext != nil {
+		if dposContext, err := types.OpenEpochTrieOnly(header.DposContext.EpochHash, trie.NewDatabase(d.db)); err == nil {
+			if validators, err := dposContext.GetValidators(); err == nil && len(validators) > 0 && len(validators) < size {
+				size = len(validators)
+			}
+		}
+	}
+	return size*2/3 + 1
+}
+
+// trackConfirmedHeader returns the irreversible block tracked by the engine,
+// loading it from the database if none is tracked yet. The caller has to hold
+// confirmedMu.
+func (d *Dpos) trackConfirmedHeader(chain consensus.ChainReader) (*types.Header, error) {
+	if d.confirmedBlockHeader == nil {
+		header, err := d.loadConfirmedBlockHeader(chain)
+		if err != nil {
+			return nil, err
+		}
+		d.confirmedBlockHeader = header
+	}
+	return d.confirmedBlockHeader, nil
 }
 
 func (s *Dpos) loadConfirmedBlockHeader(chain consensus.ChainReader) (*types.Header, error) {
@@ -349,11 +695,41 @@ func (s *Dpos) loadConfirmedBlockHeader(chain consensus.ChainReader) (*types.Hea
 	return header, nil
 }
 
-// store inserts the snapshot into the database.
+// store inserts the snapshot into the database, keeping the header itself as
+// a finality checkpoint retrievable by number. The caller has to hold
+// confirmedMu.
 func (s *Dpos) storeConfirmedBlockHeader(db ethdb.Database) error {
+	blob, err := rlp.EncodeToBytes(s.confirmedBlockHeader)
+	if err != nil {
+		return err
+	}
+	if err := db.Put(confirmedHeaderKey(s.confirmedBlockHeader.Number.Uint64()), blob); err != nil {
+		return err
+	}
 	return db.Put(confirmedBlockHead, s.confirmedBlockHeader.Hash().Bytes())
 }
 
+// ConfirmedHeaderByNumber retrieves the header confirmed at the given number,
+// if that block has ever been a finality checkpoint of this node.
+func (s *Dpos) ConfirmedHeaderByNumber(number uint64) (*types.Header, error) {
+	blob, err := s.db.Get(confirmedHeaderKey(number))
+	if err != nil || len(blob) == 0 {
+		return nil, errUnknownBlock
+	}
+	header := new(types.Header)
+	if err := rlp.DecodeBytes(blob, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func confirmedHeaderKey(number uint64) []byte {
+	key := make([]byte, len(confirmedHeaderPrefix)+8)
+	copy(key, confirmedHeaderPrefix)
+	binary.BigEndian.PutUint64(key[len(confirmedHeaderPrefix):], number)
+	return key
+}
+
 func (d *Dpos) Prepare(chain consensus.ChainReader, header *types.Header) error {
 	header.Nonce = types.BlockNonce{}
 	number := header.Number.Uint64()
@@ -366,35 +742,173 @@ func (d *Dpos) Prepare(chain consensus.ChainReader, header *types.Header) error
 	if parent == nil {
 		return consensus.ErrUnknownAncestor
 	}
+	// Align the block time to the slot it will be minted in, so that anything
+	// time dependent during block assembly sees the eventual block time.
+	if blockInterval := int64(chain.GetHeaderByNumber(0).BlockInterval); blockInterval > 0 {
+		now := time.Now().Unix()
+		if header.Time != nil {
+			now = header.Time.Int64()
+		}
+		slot := NextSlot(now, uint64(blockInterval))
+		if earliest := parent.Time.Int64() + blockInterval; slot < earliest {
+			slot = NextSlot(earliest, uint64(blockInterval))
+		}
+		header.Time = big.NewInt(slot)
+	}
 	header.Difficulty = d.CalcDifficulty(chain, header.Time.Uint64(), parent)
 	header.Validator = d.signer
+	if d.config.RequireCoinbaseEqualsValidator {
+		header.Coinbase = d.signer
+	}
 	return nil
 }
 
-func AccumulateRewards(config *params.ChainConfig, state *state.StateDB, header *types.Header, uncles []*types.Header) {
+// AccumulateRewards credits the block subsidy to the coinbase of the block, or
+// to the payout address of its validator if set, and returns the amount credited.
+func AccumulateRewards(config *params.ChainConfig, state *state.StateDB, header *types.Header, uncles []*types.Header, dposContext *types.DposContext, election bool) *big.Int {
+	reward := blockSubsidy(config, header, dposContext, election)
+	state.AddBalance(payoutAddress(header, dposContext), reward)
+	return reward
+}
+
+// blockSubsidy returns the subsidy of the block, read off the dpos state the
+// block is finalized on.
+func blockSubsidy(config *params.ChainConfig, header *types.Header, dposContext *types.DposContext, election bool) *big.Int {
 	// Select the correct block reward based on chain progression
 	blockReward := frontierBlockReward
-	if config.IsByzantium(header.Number) {
+	if config.IsByzantium(header.Number) && (config.Dpos == nil || !config.Dpos.DisableForkRewardSwitch) {
 		blockReward = byzantiumBlockReward
 	}
 	// Accumulate the rewards for the miner and any included uncles
 	reward := new(big.Int).Set(blockReward)
-	state.AddBalance(header.Coinbase, reward)
+	if config.Dpos != nil && len(config.Dpos.RankRewardCurve) > 0 {
+		reward = rankReward(config.Dpos.RankRewardCurve, reward, header.Validator, dposContext)
+	}
+	// compensate the validator of the block holding the election
+	if election && config.Dpos != nil && config.Dpos.ElectionBlockBonus != nil {
+		reward.Add(reward, config.Dpos.ElectionBlockBonus)
+	}
+	if config.Dpos != nil && config.Dpos.EpochRewardCap != nil {
+		reward = cappedReward(config.Dpos.EpochRewardCap, reward, HeaderEpochID(config.Dpos, header), dposContext)
+	}
+	return reward
+}
+
+// blockFees returns the transaction fees credited to the coinbase of a block.
+func blockFees(txs []*types.Transaction, receipts []*types.Receipt) *big.Int {
+	fees := new(big.Int)
+	for i, tx := range txs {
+		if i < len(receipts) {
+			fees.Add(fees, new(big.Int).Mul(new(big.Int).SetUint64(receipts[i].GasUsed), tx.GasPrice()))
+		}
+	}
+	return fees
+}
+
+// burnFees burns the configured share of the transaction fees of a block from
+// the account the transactions credited them to, and returns the amount burnt.
+func burnFees(config *params.DposConfig, state *state.StateDB, recipient common.Address, fees *big.Int) *big.Int {
+	if config == nil || config.BaseFeeBurnRatio == 0 {
+		return new(big.Int)
+	}
+	burnt := burntShare(config, fees)
+	state.SubBalance(recipient, burnt)
+	return burnt
+}
+
+// burntShare returns the share of the fees burnt per BaseFeeBurnRatio.
+func burntShare(config *params.DposConfig, fees *big.Int) *big.Int {
+	if config == nil || config.BaseFeeBurnRatio == 0 {
+		return new(big.Int)
+	}
+	burnt := new(big.Int).Mul(fees, new(big.Int).SetUint64(config.BaseFeeBurnRatio))
+	return burnt.Div(burnt, big.NewInt(100))
+}
+
+// payoutAddress returns the address the block rewards of the header go to.
+func payoutAddress(header *types.Header, dposContext *types.DposContext) common.Address {
+	if dposContext == nil {
+		return header.Coinbase
+	}
+	payout, err := dposContext.GetPayout(header.Validator)
+	if err != nil {
+		log.Warn("Failed to read payout address", "validator", header.Validator, "err", err)
+		return header.Coinbase
+	}
+	if payout == (common.Address{}) {
+		return header.Coinbase
+	}
+	return payout
+}
+
+// cappedReward cuts the reward to what's left of the limit after the rewards
+// already paid out in the epoch.
+func cappedReward(limit, reward *big.Int, epoch int64, dposContext *types.DposContext) *big.Int {
+	if dposContext == nil {
+		return reward
+	}
+	paid, err := dposContext.GetEpochReward(epoch)
+	if err != nil {
+		log.Warn("Failed to read epoch reward", "epoch", epoch, "err", err)
+		return reward
+	}
+	remaining := new(big.Int).Sub(limit, paid)
+	if remaining.Sign() <= 0 {
+		return new(big.Int)
+	}
+	if remaining.Cmp(reward) < 0 {
+		return remaining
+	}
+	return reward
+}
+
+// rankReward scales the reward by the curve entry of the rank the validator was
+// elected with. Validators without a recorded rank receive the flat reward.
+func rankReward(curve []uint64, reward *big.Int, validator common.Address, dposContext *types.DposContext) *big.Int {
+	if dposContext == nil {
+		return reward
+	}
+	ranks, err := dposContext.GetValidatorRanks()
+	if err != nil {
+		log.Warn("Failed to read validator ranks", "err", err)
+		return reward
+	}
+	for rank, ranked := range ranks {
+		if ranked != validator {
+			continue
+		}
+		if rank >= len(curve) {
+			rank = len(curve) - 1
+		}
+		reward.Mul(reward, new(big.Int).SetUint64(curve[rank]))
+		return reward.Div(reward, big.NewInt(100))
+	}
+	return reward
 }
 
 //将出块周期内的交易打包进新的区块中
 func (d *Dpos) Finalize(chain consensus.ChainReader, header *types.Header, state *state.StateDB, txs []*types.Transaction,
 	uncles []*types.Header, receipts []*types.Receipt, dposContext *types.DposContext) (*types.Block, error) {
+	parent := chain.GetHeaderByHash(header.ParentHash)
+
 	// Accumulate block rewards and commit the final state root
-	AccumulateRewards(chain.Config(), state, header, uncles)
+	election := HeaderEpochID(d.config, parent) != HeaderEpochID(d.config, header)
+	reward := AccumulateRewards(chain.Config(), state, header, uncles, dposContext, election)
+	fees := blockFees(txs, receipts)
+	// the fees went to the coinbase of the EVM, which is the block author
+	author, _ := d.Author(header)
+	fees.Sub(fees, burnFees(d.config, state, author, fees))
 	header.Root = state.IntermediateRoot(chain.Config().IsEIP158(header.Number))
-
-	parent := chain.GetHeaderByHash(header.ParentHash)
+	d.mu.RLock()
 	epochContext := &EpochContext{
 		statedb:     state,
 		DposContext: dposContext,
 		TimeStamp:   header.Time.Int64(),
+		number:      header.Number.Int64(),
+		provider:    d.provider,
+		config:      d.config,
 	}
+	d.mu.RUnlock()
 	if timeOfFirstBlock == 0 {
 		if firstBlockHeader := chain.GetHeaderByNumber(1); firstBlockHeader != nil {
 			timeOfFirstBlock = firstBlockHeader.Time.Int64()
@@ -408,9 +922,22 @@ func (d *Dpos) Finalize(chain consensus.ChainReader, header *types.Header, state
 	if err != nil {
 		return nil, fmt.Errorf("got error when elect next epoch, err: %s", err)
 	}
+	// admin overrides replace the election result of the next epoch
+	if err := recordValidatorOverrides(d.config, genesis, header, txs, dposContext); err != nil {
+		return nil, err
+	}
+
+	// account the subsidy and fees to the epoch of the block, the epoch reward
+	// cap needs them even before the chain keeps epoch history
+	if d.config.IsEpochHistory(header.Number) || d.config.EpochRewardCap != nil {
+		if err := dposContext.AddEpochReward(HeaderEpochID(d.config, header), reward.Add(reward, fees)); err != nil {
+			return nil, err
+		}
+	}
 
 	//update mint count trie
-	updateMintCnt(parent.Time.Int64(), header.Time.Int64(), header.Validator, dposContext)
+	updateMintCnt(HeaderEpochID(d.config, parent), HeaderEpochID(d.config, header), header.Validator, dposContext)
+	d.checkIntegrity(header, dposContext)
 	header.DposContext = dposContext.ToProto()
 	return types.NewBlock(header, txs, uncles, receipts), nil
 }
@@ -422,23 +949,32 @@ func (d *Dpos) checkDeadline(lastBlock *types.Block, now int64, blockInterval ui
 		return ErrMintFutureBlock
 	}
 	// last block was arrived, or time's up
-	if lastBlock.Time().Int64() == prevSlot || nextSlot-now <= 1 {
+	if lastBlock.Time().Int64() == prevSlot || nextSlot-now <= int64(d.config.MintDeadlineGrace) {
 		return nil
 	}
 	return ErrWaitForPrevBlock
 }
 
 //检查当前的验证人是否在当前的节点上
+// Only the validator of the slot starting at now may mint, so a chain with a
+// genesis far in the past resumes at the current slot rather than catching up
+// on the slots missed since.
 func (d *Dpos) CheckValidator(lastBlock *types.Block, now int64,blockInterval uint64) error {
+	if d.Paused() {
+		return ErrProductionPaused
+	}
+	if now < int64(d.config.ActivationTime) {
+		return ErrNotActivated
+	}
 	if err := d.checkDeadline(lastBlock, now, blockInterval); err != nil {
 		return err
 	}
 	//lastBlock.DposContext.DB()修改trie.NewDatabase(d.db)，解决没有创世块启动报错
-	dposContext, err := types.NewDposContextFromProto(trie.NewDatabase(d.db), lastBlock.Header().DposContext)
+	dposContext, err := types.OpenEpochTrieOnly(lastBlock.Header().DposContext.EpochHash, trie.NewDatabase(d.db))
 	if err != nil {
 		return err
 	}
-	epochContext := &EpochContext{DposContext: dposContext}
+	epochContext := &EpochContext{DposContext: dposContext, config: d.config}
 	validator, err := epochContext.lookupValidator(now,blockInterval)
 	if err != nil {
 		return err
@@ -459,8 +995,19 @@ func (d *Dpos) Seal(chain consensus.ChainReader, block *types.Block, stop <-chan
 	if number == 0 {
 		return nil, errUnknownBlock
 	}
+	d.mu.RLock()
+	account, signFn := d.account, d.signFn
+	d.mu.RUnlock()
+	if signFn == nil || account.Address == (common.Address{}) {
+		return nil, ErrSignerNotAuthorized
+	}
+	if d.Paused() {
+		return nil, ErrProductionPaused
+	}
+	blockInterval := chain.GetHeaderByNumber(0).BlockInterval
 	now := time.Now().Unix()
-	delay := NextSlot(now,chain.GetHeaderByNumber(0).BlockInterval) - now
+	slot := NextSlot(now, blockInterval)
+	delay := slot - now
 	if delay > 0 {
 		select {
 		case <-stop:
@@ -468,11 +1015,21 @@ func (d *Dpos) Seal(chain consensus.ChainReader, block *types.Block, stop <-chan
 		case <-time.After(time.Duration(delay) * time.Second):
 		}
 	}
-	block.Header().Time.SetInt64(time.Now().Unix())
-
+	// smooth out the broadcast of blocks across validators
+	if jitter := d.sealJitter(slot, time.Now(), blockInterval); jitter > 0 {
+		select {
+		case <-stop:
+			return nil, nil
+		case <-time.After(jitter):
+		}
+	}
+	// the operator may have paused production while waiting for the slot
+	if d.Paused() {
+		return nil, ErrProductionPaused
+	}
 	// time's up, sign the block
 	// 对新块进行签名
-	sighash, err := d.signFn(accounts.Account{Address: d.signer}, sigHash(header).Bytes())
+	sighash, err := signFn(account, sigHash(header).Bytes())
 	if err != nil {
 		return nil, err
 	}
@@ -480,6 +1037,26 @@ func (d *Dpos) Seal(chain consensus.ChainReader, block *types.Block, stop <-chan
 	return block.WithSeal(header), nil
 }
 
+// sealJitter returns a random delay of at most SealJitterMs to wait before
+// sealing the block of the given slot. The delay is cut short so that the block
+// is out before the next validator stops waiting for it, and skipped entirely
+// if that deadline has already passed.
+func (d *Dpos) sealJitter(slot int64, now time.Time, blockInterval uint64) time.Duration {
+	if d.config.SealJitterMs == 0 {
+		return 0
+	}
+	deadline := time.Unix(slot+int64(blockInterval)-int64(d.config.MintDeadlineGrace), 0)
+	budget := deadline.Sub(now)
+	if budget <= 0 {
+		return 0
+	}
+	limit := time.Duration(d.config.SealJitterMs) * time.Millisecond
+	if limit > budget {
+		limit = budget
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
 func (d *Dpos) CalcDifficulty(chain consensus.ChainReader, time uint64, parent *types.Header) *big.Int {
 	return big.NewInt(1)
 }
@@ -490,20 +1067,211 @@ func (d *Dpos) APIs(chain consensus.ChainReader) []rpc.API {
 		Version:   "1.0",
 		Service:   &API{chain: chain, dpos: d},
 		Public:    true,
+	}, {
+		Namespace: "admin",
+		Version:   "1.0",
+		Service:   &AdminAPI{chain: chain, dpos: d},
 	}}
 }
 
 func (d *Dpos) Authorize(signer common.Address, signFn SignerFn) {
+	d.AuthorizeAccount(accounts.Account{Address: signer}, signFn)
+}
+
+// Pause halts block production until Resume is called. The authorized signer is
+// kept, blocks are merely not minted in the meantime.
+func (d *Dpos) Pause() {
 	d.mu.Lock()
-	d.signer = signer
+	d.paused = true
+	d.mu.Unlock()
+}
+
+// Resume restarts block production halted by Pause.
+func (d *Dpos) Resume() {
+	d.mu.Lock()
+	d.paused = false
+	d.mu.Unlock()
+}
+
+// Paused reports whether block production is paused.
+func (d *Dpos) Paused() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.paused
+}
+
+// AuthorizeAccount injects the signing account and function like Authorize. The
+// account is handed to signFn as given, so wallets needing more than the address
+// to sign, e.g. the derivation path of a hardware wallet, can find the key.
+func (d *Dpos) AuthorizeAccount(account accounts.Account, signFn SignerFn) {
+	d.mu.Lock()
+	d.signer = account.Address
+	d.account = account
 	d.signFn = signFn
 	d.mu.Unlock()
 }
 
-func (d *Dpos) Close() error {
+// EvictOrphans drops the cached signers of blocks orphaned by a chain reorg, so
+// that heavy fork activity doesn't fill the signature cache with dead headers.
+func (d *Dpos) EvictOrphans(orphans []*types.Header) {
+	for _, header := range orphans {
+		d.signatures.Remove(header.Hash())
+	}
+}
+
+// Reorg drops the state derived from blocks orphaned by a chain reorg. If the
+// irreversible block was among them, confirmation restarts from genesis and is
+// recomputed on the new canonical chain ending in head.
+func (d *Dpos) Reorg(chain consensus.ChainReader, head *types.Header, orphans []*types.Header) error {
+	d.EvictOrphans(orphans)
+	d.confirmedMu.Lock()
+	defer d.confirmedMu.Unlock()
+	if header, err := d.trackConfirmedHeader(chain); err == nil {
+		confirmed := header.Hash()
+		for _, header := range orphans {
+			if header.Hash() != confirmed {
+				continue
+			}
+			log.Warn("Confirmed block orphaned by reorg", "number", header.Number, "hash", confirmed)
+			d.confirmedBlockHeader = chain.GetHeaderByNumber(0)
+			if d.confirmedBlockHeader == nil {
+				return ErrNilBlockHeader
+			}
+			if err := d.storeConfirmedBlockHeader(d.db); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return d.confirmBlocks(chain, head)
+}
+
+// MaxAllowedReorgDepth returns the number of canonical blocks a reorg may drop:
+// the blocks above the confirmed block plus ReorgDepthMargin. Without
+// LimitReorgDepth the depth is unlimited.
+func (d *Dpos) MaxAllowedReorgDepth(chain consensus.ChainReader) uint64 {
+	if !d.config.LimitReorgDepth {
+		return math.MaxUint64
+	}
+	d.confirmedMu.Lock()
+	confirmed, err := d.trackConfirmedHeader(chain)
+	d.confirmedMu.Unlock()
+	if err != nil {
+		confirmed = chain.GetHeaderByNumber(0)
+	}
+	head := chain.CurrentHeader()
+	if confirmed == nil || head == nil || head.Number.Cmp(confirmed.Number) <= 0 {
+		return d.config.ReorgDepthMargin
+	}
+	return head.Number.Uint64() - confirmed.Number.Uint64() + d.config.ReorgDepthMargin
+}
+
+// VerifyReorg checks whether a reorg dropping depth blocks of the canonical
+// chain is allowed, the chain has to call it before switching to the new
+// chain.
+func (d *Dpos) VerifyReorg(chain consensus.ChainReader, depth uint64) error {
+	if limit := d.MaxAllowedReorgDepth(chain); depth > limit {
+		log.Warn("Refusing deep reorg", "depth", depth, "limit", limit)
+		return ErrReorgTooDeep
+	}
+	return nil
+}
+
+// RecomputeConfirmedBlock rebuilds the irreversible block by replaying the
+// confirmation of every block of the canonical chain up to the current head,
+// repairing a lost or corrupted confirmed-block-head entry. The replay starts
+// from the stored confirmed block if it is canonical, from genesis otherwise.
+// The recomputed header is stored and returned, on failure the engine is left
+// untouched. If block import confirmed a newer canonical block during the
+// replay, that one is kept and stored instead.
+func (d *Dpos) RecomputeConfirmedBlock(chain consensus.ChainReader) (*types.Header, error) {
+	confirmed, err := d.loadConfirmedBlockHeader(chain)
+	if err != nil || !isCanonical(chain, confirmed) {
+		if confirmed = chain.GetHeaderByNumber(0); confirmed == nil {
+			return nil, ErrNilBlockHeader
+		}
+	}
+	head := chain.CurrentHeader().Number.Uint64()
+	for number := confirmed.Number.Uint64() + 1; number <= head; number++ {
+		header := chain.GetHeaderByNumber(number)
+		if header == nil {
+			return nil, ErrNilBlockHeader
+		}
+		if confirmed, err = d.nextConfirmed(chain, confirmed, header); err != nil {
+			return nil, err
+		}
+	}
+	d.confirmedMu.Lock()
+	defer d.confirmedMu.Unlock()
+	if current := d.confirmedBlockHeader; current != nil && current.Number.Cmp(confirmed.Number) > 0 && isCanonical(chain, current) {
+		confirmed = current
+	}
+	d.confirmedBlockHeader = confirmed
+	if err := d.storeConfirmedBlockHeader(d.db); err != nil {
+		return nil, err
+	}
+	log.Info("Recomputed confirmed block", "number", confirmed.Number, "hash", confirmed.Hash())
+	return confirmed, nil
+}
+
+// isCanonical reports whether the header is part of the canonical chain.
+func isCanonical(chain consensus.ChainReader, header *types.Header) bool {
+	canonical := chain.GetHeaderByNumber(header.Number.Uint64())
+	return canonical != nil && canonical.Hash() == header.Hash()
+}
+
+// NewHead posts an ElectionEvent if the given block, which just became the head
+// of the chain, is the first of a new epoch and thus elected its validators. It
+// also drops the candidate weights cached by the RPC API.
+func (d *Dpos) NewHead(chain consensus.ChainReader, head *types.Header) error {
+	d.weights.invalidate()
+
+	number := head.Number.Uint64()
+	if number == 0 {
+		return nil
+	}
+	parent := chain.GetHeader(head.ParentHash, number-1)
+	if parent == nil {
+		return consensus.ErrUnknownAncestor
+	}
+	epoch := HeaderEpochID(d.config, head)
+	if epoch == HeaderEpochID(d.config, parent) {
+		return nil
+	}
+	dposContext, err := types.OpenEpochTrieOnly(head.DposContext.EpochHash, trie.NewDatabase(d.db))
+	if err != nil {
+		return err
+	}
+	validators, err := dposContext.GetValidators()
+	if err != nil {
+		return err
+	}
+	d.electionFeed.Send(ElectionEvent{Epoch: epoch, Validators: validators})
 	return nil
 }
 
+// SubscribeElection registers a subscription of ElectionEvent.
+func (d *Dpos) SubscribeElection(ch chan<- ElectionEvent) event.Subscription {
+	return d.scope.Track(d.electionFeed.Subscribe(ch))
+}
+
+// Close stops the engine and flushes the confirmed block to the database. The
+// confirmed block is persisted whenever it advances already, flushing it again
+// merely guards against a write lost in between.
+func (d *Dpos) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.stop)
+		d.scope.Close()
+		d.confirmedMu.Lock()
+		if d.confirmedBlockHeader != nil && d.db != nil {
+			err = d.storeConfirmedBlockHeader(d.db)
+		}
+		d.confirmedMu.Unlock()
+	})
+	return err
+}
+
 // ecrecover extracts the Ethereum account address from a signed header.
 func ecrecover(header *types.Header, sigcache *lru.ARCCache) (common.Address, error) {
 	// If the signature's already cached, return that
@@ -527,6 +1295,52 @@ func ecrecover(header *types.Header, sigcache *lru.ARCCache) (common.Address, er
 	return signer, nil
 }
 
+// EpochID returns the number of the epoch the given timestamp falls into.
+func EpochID(config *params.DposConfig, timestamp int64) int64 {
+	return (timestamp - epochOffset(config)) / epochInterval
+}
+
+// HeaderEpochID returns the number of the epoch the given block belongs to, by
+// its timestamp or, with block based epochs, by its number.
+func HeaderEpochID(config *params.DposConfig, header *types.Header) int64 {
+	if blocksPerEpoch := epochBlocks(config); blocksPerEpoch > 0 {
+		return header.Number.Int64() / blocksPerEpoch
+	}
+	return EpochID(config, header.Time.Int64())
+}
+
+// blockEpochID returns the number of the epoch of the block with the given
+// number and timestamp.
+func blockEpochID(config *params.DposConfig, number, timestamp int64) int64 {
+	if blocksPerEpoch := epochBlocks(config); blocksPerEpoch > 0 {
+		return number / blocksPerEpoch
+	}
+	return EpochID(config, timestamp)
+}
+
+// epochBlocks returns the number of blocks per epoch if epochs are block based,
+// zero otherwise.
+func epochBlocks(config *params.DposConfig) int64 {
+	if config == nil || config.EpochMode != params.BlockBased {
+		return 0
+	}
+	return int64(config.BlocksPerEpoch)
+}
+
+// epochStart returns the timestamp the given epoch starts at.
+func epochStart(config *params.DposConfig, epoch int64) int64 {
+	return epoch*epochInterval + epochOffset(config)
+}
+
+// epochOffset returns how many seconds the epochs start after multiples of the
+// epoch interval.
+func epochOffset(config *params.DposConfig) int64 {
+	if config == nil {
+		return 0
+	}
+	return int64(config.EpochOffset % uint64(epochInterval))
+}
+
 func PrevSlot(now int64, blockInterval uint64) int64 {
 	return int64((now-1)/int64(blockInterval)) * int64(blockInterval)
 }
@@ -535,16 +1349,147 @@ func NextSlot(now int64, blockInterval uint64) int64 {
 	return int64((now+int64(blockInterval)-1)/int64(blockInterval)) * int64(blockInterval)
 }
 
+// slotStart returns the start of the slot the timestamp falls in.
+func slotStart(config *params.DposConfig, timestamp int64, blockInterval uint64) int64 {
+	offset := (timestamp - epochOffset(config)) % int64(blockInterval)
+	if offset < 0 {
+		offset += int64(blockInterval)
+	}
+	return timestamp - offset
+}
+
+// CurrentSlot returns the position of the slot in progress at now within its
+// epoch, the number of slots per epoch and the validator expected to mint in
+// the slot. With block based epochs the position is the one of the next block.
+func (d *Dpos) CurrentSlot(chain consensus.ChainReader, now int64) (slotIndex, slotsPerEpoch int64, validator common.Address, err error) {
+	head := chain.CurrentHeader()
+	genesis := chain.GetHeaderByNumber(0)
+	if head == nil || genesis == nil || head.DposContext == nil {
+		return 0, 0, common.Address{}, ErrNilBlockHeader
+	}
+	interval := int64(genesis.BlockInterval)
+	if interval == 0 {
+		return 0, 0, common.Address{}, ErrInvalidMintBlockTime
+	}
+	slot := slotStart(d.config, now, genesis.BlockInterval)
+	if blocksPerEpoch := epochBlocks(d.config); blocksPerEpoch > 0 {
+		slotIndex, slotsPerEpoch = (head.Number.Int64()+1)%blocksPerEpoch, blocksPerEpoch
+	} else {
+		slotIndex, slotsPerEpoch = (slot-epochStart(d.config, EpochID(d.config, slot)))/interval, epochInterval/interval
+	}
+	dposContext, err := types.OpenEpochTrieOnly(head.DposContext.EpochHash, trie.NewDatabase(d.db))
+	if err != nil {
+		return 0, 0, common.Address{}, err
+	}
+	epochContext := &EpochContext{DposContext: dposContext, config: d.config}
+	validator, err = epochContext.lookupValidator(slot, genesis.BlockInterval)
+	if err != nil {
+		return 0, 0, common.Address{}, err
+	}
+	return slotIndex, slotsPerEpoch, validator, nil
+}
+
+// BlocksUntilElection returns the seconds left at now until the next epoch
+// starts and holds its election, and about how many blocks are minted before
+// then, assuming no slot is missed. With block based epochs the block count is
+// exact and the time is estimated from it instead.
+func (d *Dpos) BlocksUntilElection(chain consensus.ChainReader, now int64) (seconds int64, approxBlocks int64, err error) {
+	genesis := chain.GetHeaderByNumber(0)
+	if genesis == nil {
+		return 0, 0, ErrNilBlockHeader
+	}
+	interval := int64(genesis.BlockInterval)
+	if interval == 0 {
+		return 0, 0, ErrInvalidMintBlockTime
+	}
+	if blocksPerEpoch := epochBlocks(d.config); blocksPerEpoch > 0 {
+		head := chain.CurrentHeader()
+		if head == nil {
+			return 0, 0, ErrNilBlockHeader
+		}
+		approxBlocks = blocksPerEpoch - 1 - head.Number.Int64()%blocksPerEpoch
+		seconds = head.Time.Int64() + (approxBlocks+1)*interval - now
+		if seconds < 0 {
+			seconds = 0
+		}
+		return seconds, approxBlocks, nil
+	}
+	seconds = epochStart(d.config, EpochID(d.config, now)+1) - now
+	// the slots left to start before the next epoch does, the slots being aligned
+	// to the epoch start
+	return seconds, seconds / interval, nil
+}
+
+// ScheduleSlot is a slot of an epoch and the validator assigned to it.
+type ScheduleSlot struct {
+	Slot      int64          `json:"slot"`      // Index of the slot within the epoch
+	Time      int64          `json:"time"`      // Timestamp the slot starts at
+	Validator common.Address `json:"validator"` // Validator expected to mint in the slot
+}
+
+// ExportSchedule writes the validator of every slot of the epoch to w, as a
+// JSON array of ScheduleSlot or as CSV with a header row, depending on format
+// being "json" or "csv". The validators are the ones of the head if the epoch
+// is the current one, otherwise the ones recorded for the epoch. Block based
+// epochs have no fixed slots and can't be exported.
+func (d *Dpos) ExportSchedule(chain consensus.ChainReader, epoch int64, w io.Writer, format string) error {
+	if format != "json" && format != "csv" {
+		return fmt.Errorf("unknown schedule format %q", format)
+	}
+	if epochBlocks(d.config) > 0 {
+		return errNoSlotSchedule
+	}
+	head := chain.CurrentHeader()
+	genesis := chain.GetHeaderByNumber(0)
+	if head == nil || genesis == nil || head.DposContext == nil {
+		return ErrNilBlockHeader
+	}
+	if genesis.BlockInterval == 0 {
+		return ErrInvalidMintBlockTime
+	}
+	dposContext, err := types.OpenEpochTrieOnly(head.DposContext.EpochHash, trie.NewDatabase(d.db))
+	if err != nil {
+		return err
+	}
+	var validators []common.Address
+	if epoch == HeaderEpochID(d.config, head) {
+		validators, err = dposContext.GetValidators()
+	} else {
+		validators, err = dposContext.GetEpochValidators(epoch)
+	}
+	if err != nil {
+		return err
+	}
+	interval := int64(genesis.BlockInterval)
+	slots := make([]ScheduleSlot, 0, epochInterval/interval)
+	for slot, start := int64(0), epochStart(d.config, epoch); slot < epochInterval/interval; slot++ {
+		timestamp := start + slot*interval
+		validator, err := slotValidator(d.config, validators, timestamp, genesis.BlockInterval)
+		if err != nil {
+			return err
+		}
+		slots = append(slots, ScheduleSlot{Slot: slot, Time: timestamp, Validator: validator})
+	}
+	if format == "json" {
+		return json.NewEncoder(w).Encode(slots)
+	}
+	out := csv.NewWriter(w)
+	out.Write([]string{"slot", "time", "validator"})
+	for _, slot := range slots {
+		out.Write([]string{strconv.FormatInt(slot.Slot, 10), strconv.FormatInt(slot.Time, 10), slot.Validator.Hex()})
+	}
+	out.Flush()
+	return out.Error()
+}
+
 // update counts in MintCntTrie for the miner of newBlock
 // 更新周期内验证人出块数目
-func updateMintCnt(parentBlockTime, currentBlockTime int64, validator common.Address, dposContext *types.DposContext) {
+func updateMintCnt(currentEpoch, newEpoch int64, validator common.Address, dposContext *types.DposContext) {
 	currentMintCntTrie := dposContext.MintCntTrie()
-	currentEpoch := parentBlockTime / epochInterval
 	currentEpochBytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(currentEpochBytes, uint64(currentEpoch))
 
 	cnt := int64(1)
-	newEpoch := currentBlockTime / epochInterval
 	// still during the currentEpochID
 	if currentEpoch == newEpoch {
 		iter := trie.NewIterator(currentMintCntTrie.NodeIterator(currentEpochBytes))
@@ -553,9 +1498,11 @@ func updateMintCnt(parentBlockTime, currentBlockTime int64, validator common.Add
 		if iter.Next() {
 			cntBytes := currentMintCntTrie.Get(append(currentEpochBytes, validator.Bytes()...))
 
-			// not the first time to mint
-			if cntBytes != nil {
+			// not the first time to mint, a corrupted count restarts from zero
+			if len(cntBytes) == 8 {
 				cnt = int64(binary.BigEndian.Uint64(cntBytes)) + 1
+			} else if cntBytes != nil {
+				log.Warn("Malformed mint count, resetting", "validator", validator, "epoch", currentEpoch, "len", len(cntBytes))
 			}
 		}
 	}
@@ -2,16 +2,38 @@ package dpos
 
 import (
 	"testing"
+	"time"
 
+	"bytes"
+	"crypto/ecdsa"
 	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"sync"
 
+	"github.com/happytoken/go-ethereum/accounts"
 	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/core/state"
 	"github.com/happytoken/go-ethereum/core/types"
+	"github.com/happytoken/go-ethereum/crypto"
+	"github.com/happytoken/go-ethereum/crypto/sha3"
 	"github.com/happytoken/go-ethereum/ethdb"
+	"github.com/happytoken/go-ethereum/params"
+	"github.com/happytoken/go-ethereum/rlp"
 	"github.com/happytoken/go-ethereum/trie"
 	"github.com/stretchr/testify/assert"
 )
 
+const (
+	blockInterval    = int64(10)
+	maxValidatorSize = 21
+	safeSize         = maxValidatorSize*2/3 + 1
+)
+
 var (
 	MockEpoch = []string{
 		"0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e",
@@ -91,7 +113,7 @@ func TestUpdateMintCnt(t *testing.T) {
 	blockTime := int64(epochInterval + blockInterval)
 
 	beforeUpdateCnt := getMintCnt(blockTime/epochInterval, miner, dposContext.MintCntTrie())
-	updateMintCnt(lastTime, blockTime, miner, dposContext)
+	updateMintCnt(EpochID(nil, lastTime), EpochID(nil, blockTime), miner, dposContext)
 	afterUpdateCnt := getMintCnt(blockTime/epochInterval, miner, dposContext.MintCntTrie())
 	assert.Equal(t, int64(0), beforeUpdateCnt)
 	assert.Equal(t, int64(1), afterUpdateCnt)
@@ -103,7 +125,7 @@ func TestUpdateMintCnt(t *testing.T) {
 
 	// currentBlock has recorded the count for the newMiner before UpdateMintCnt
 	beforeUpdateCnt = getMintCnt(blockTime/epochInterval, miner, dposContext.MintCntTrie())
-	updateMintCnt(lastTime, blockTime, miner, dposContext)
+	updateMintCnt(EpochID(nil, lastTime), EpochID(nil, blockTime), miner, dposContext)
 	afterUpdateCnt = getMintCnt(blockTime/epochInterval, miner, dposContext.MintCntTrie())
 	assert.Equal(t, int64(1), beforeUpdateCnt)
 	assert.Equal(t, int64(2), afterUpdateCnt)
@@ -112,8 +134,1945 @@ func TestUpdateMintCnt(t *testing.T) {
 	blockTime = epochInterval * 2
 
 	beforeUpdateCnt = getMintCnt(blockTime/epochInterval, miner, dposContext.MintCntTrie())
-	updateMintCnt(lastTime, blockTime, miner, dposContext)
+	updateMintCnt(EpochID(nil, lastTime), EpochID(nil, blockTime), miner, dposContext)
 	afterUpdateCnt = getMintCnt(blockTime/epochInterval, miner, dposContext.MintCntTrie())
 	assert.Equal(t, int64(0), beforeUpdateCnt)
 	assert.Equal(t, int64(1), afterUpdateCnt)
 }
+
+func TestUpdateMintCntMalformed(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	dposContext := mockNewDposContext(db)
+
+	lastTime := int64(epochInterval)
+	blockTime := int64(epochInterval + blockInterval)
+	miner := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+
+	// a short count value restarts the count instead of panicking
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(blockTime/epochInterval))
+	dposContext.MintCntTrie().TryUpdate(append(key, miner.Bytes()...), []byte{0x01, 0x02})
+	assert.NotPanics(t, func() { updateMintCnt(EpochID(nil, lastTime), EpochID(nil, blockTime), miner, dposContext) })
+	assert.Equal(t, int64(1), getMintCnt(blockTime/epochInterval, miner, dposContext.MintCntTrie()))
+
+	// the repaired value counts up normally again
+	updateMintCnt(EpochID(nil, lastTime), EpochID(nil, blockTime+blockInterval), miner, dposContext)
+	assert.Equal(t, int64(2), getMintCnt(blockTime/epochInterval, miner, dposContext.MintCntTrie()))
+}
+
+func TestSealJitter(t *testing.T) {
+	slot := int64(epochInterval)
+	start := time.Unix(slot, 0)
+
+	// disabled by default
+	d := New(nil, ethdb.NewMemDatabase())
+	assert.Equal(t, time.Duration(0), d.sealJitter(slot, start, uint64(blockInterval)))
+
+	d = New(&params.DposConfig{SealJitterMs: 500}, ethdb.NewMemDatabase())
+	for i := 0; i < 100; i++ {
+		jitter := d.sealJitter(slot, start, uint64(blockInterval))
+		assert.True(t, jitter >= 0 && jitter < 500*time.Millisecond)
+	}
+
+	// bounded by the mint deadline of the next slot
+	d = New(&params.DposConfig{SealJitterMs: 60000}, ethdb.NewMemDatabase())
+	deadline := time.Unix(slot+blockInterval-int64(defaultMintDeadlineGrace), 0)
+	for i := 0; i < 100; i++ {
+		now := start.Add(time.Duration(i) * 50 * time.Millisecond)
+		jitter := d.sealJitter(slot, now, uint64(blockInterval))
+		assert.True(t, jitter >= 0 && !now.Add(jitter).After(deadline))
+	}
+
+	// skipped once the deadline has passed
+	assert.Equal(t, time.Duration(0), d.sealJitter(slot, deadline, uint64(blockInterval)))
+	assert.Equal(t, time.Duration(0), d.sealJitter(slot, deadline.Add(time.Second), uint64(blockInterval)))
+}
+
+func mockGenesisHeader(time int64) *types.Header {
+	return &types.Header{
+		Time:             big.NewInt(time),
+		MaxValidatorSize: maxValidatorSize,
+		BlockInterval:    uint64(blockInterval),
+	}
+}
+
+// newGenesisHeader returns mockGenesisHeader numbered as block 0.
+func newGenesisHeader(time int64) *types.Header {
+	genesis := mockGenesisHeader(time)
+	genesis.Number = big.NewInt(0)
+	return genesis
+}
+
+func TestCheckDeadline(t *testing.T) {
+	slot := blockInterval * 100
+	tests := []struct {
+		grace uint64
+		last  int64 // timestamp of the last block
+		now   int64
+		err   error
+	}{
+		// previous block arrived on time, mint right away
+		{0, slot - blockInterval, slot - 5, nil},
+		// previous block is late, default grace only allows the last second
+		{0, slot - 2*blockInterval, slot - blockInterval + 1, ErrWaitForPrevBlock},
+		{0, slot - 2*blockInterval, slot - 2, ErrWaitForPrevBlock},
+		{0, slot - 2*blockInterval, slot - 1, nil},
+		// a wider grace gives up on the late block earlier
+		{3, slot - 2*blockInterval, slot - 4, ErrWaitForPrevBlock},
+		{3, slot - 2*blockInterval, slot - 3, nil},
+		{3, slot - 2*blockInterval, slot - 1, nil},
+		{uint64(blockInterval), slot - 2*blockInterval, slot - blockInterval + 1, nil},
+		// a block already minted for the upcoming slot must not be minted again
+		{0, slot, slot - 1, ErrMintFutureBlock},
+		{uint64(blockInterval), slot, slot - 1, ErrMintFutureBlock},
+	}
+	for i, tt := range tests {
+		engine := New(&params.DposConfig{MintDeadlineGrace: tt.grace}, ethdb.NewMemDatabase())
+		lastBlock := types.NewBlockWithHeader(&types.Header{Time: big.NewInt(tt.last)})
+		if err := engine.checkDeadline(lastBlock, tt.now, uint64(blockInterval)); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestPrepareAlignsTimeToSlot(t *testing.T) {
+	genesis := newGenesisHeader(0)
+	parent := &types.Header{
+		ParentHash: genesis.Hash(),
+		Number:     big.NewInt(1),
+		Time:       big.NewInt(blockInterval * 10),
+	}
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis, parent}}
+	engine := New(nil, ethdb.NewMemDatabase())
+
+	tests := []struct {
+		time int64
+		want int64
+	}{
+		// rounded up to the next slot
+		{blockInterval*12 + 3, blockInterval * 13},
+		{blockInterval*13 - 1, blockInterval * 13},
+		// already on a slot
+		{blockInterval * 12, blockInterval * 12},
+		// never earlier than one interval after the parent
+		{blockInterval * 10, blockInterval * 11},
+		{blockInterval*9 + 1, blockInterval * 11},
+	}
+	for i, tt := range tests {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2), Time: big.NewInt(tt.time)}
+		assert.Nil(t, engine.Prepare(chain, header))
+		if header.Time.Int64() != tt.want {
+			t.Errorf("test %d: time mismatch: have %v, want %v", i, header.Time, tt.want)
+		}
+	}
+	// without a time the current time is aligned to its next slot
+	header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2)}
+	now := time.Now().Unix()
+	assert.Nil(t, engine.Prepare(chain, header))
+	assert.Equal(t, int64(0), header.Time.Int64()%blockInterval)
+	assert.True(t, header.Time.Int64() >= now)
+	assert.True(t, header.Time.Int64() < now+2*blockInterval)
+}
+
+// signTestHeader seals the header with the given key like Seal would.
+func signTestHeader(t testing.TB, header *types.Header, key *ecdsa.PrivateKey) {
+	header.Extra = make([]byte, extraVanity+extraSeal)
+	if header.DposContext == nil {
+		header.DposContext = &types.DposContextProto{}
+	}
+	sig, err := crypto.Sign(sigHash(header).Bytes(), key)
+	if err != nil {
+		t.Fatalf("failed to sign header: %v", err)
+	}
+	copy(header.Extra[len(header.Extra)-extraSeal:], sig)
+}
+
+// legacySigHash is the reference encoding sigHash has to stay identical to.
+func legacySigHash(header *types.Header) (hash common.Hash) {
+	hasher := sha3.NewKeccak256()
+	rlp.Encode(hasher, []interface{}{
+		header.ParentHash,
+		header.UncleHash,
+		header.Validator,
+		header.Coinbase,
+		header.Root,
+		header.TxHash,
+		header.ReceiptHash,
+		header.Bloom,
+		header.Difficulty,
+		header.Number,
+		header.GasLimit,
+		header.GasUsed,
+		header.Time,
+		header.Extra[:len(header.Extra)-65],
+		header.MixDigest,
+		header.Nonce,
+		header.DposContext.Root(),
+		header.MaxValidatorSize,
+	})
+	hasher.Sum(hash[:0])
+	return hash
+}
+
+func newSigHashTestHeader(i int64) *types.Header {
+	header := &types.Header{
+		ParentHash:       common.BigToHash(big.NewInt(i)),
+		UncleHash:        uncleHash,
+		Validator:        common.BigToAddress(big.NewInt(i + 1)),
+		Coinbase:         common.BigToAddress(big.NewInt(i + 2)),
+		Root:             common.BigToHash(big.NewInt(i + 3)),
+		TxHash:           common.BigToHash(big.NewInt(i + 4)),
+		ReceiptHash:      common.BigToHash(big.NewInt(i + 5)),
+		DposContext:      &types.DposContextProto{EpochHash: common.BigToHash(big.NewInt(i + 6))},
+		Difficulty:       big.NewInt(1),
+		Number:           big.NewInt(i),
+		GasLimit:         uint64(i) * 1000,
+		GasUsed:          uint64(i) * 10,
+		Time:             big.NewInt(i * blockInterval),
+		Extra:            make([]byte, extraVanity+int(i)%3+extraSeal),
+		MixDigest:        common.BigToHash(big.NewInt(i + 7)),
+		Nonce:            types.EncodeNonce(uint64(i)),
+		MaxValidatorSize: uint64(i) % maxValidatorSize,
+		BlockInterval:    uint64(blockInterval),
+	}
+	header.Bloom[i%types.BloomByteLength] = byte(i)
+	header.Extra[0] = byte(i)
+	return header
+}
+
+func TestSigHashEncoding(t *testing.T) {
+	for i := int64(0); i < 64; i++ {
+		header := newSigHashTestHeader(i)
+		assert.Equal(t, legacySigHash(header), sigHash(header), "header %d", i)
+	}
+	// values needing the long rlp forms
+	header := newSigHashTestHeader(1)
+	header.Extra = make([]byte, 1024+extraSeal)
+	header.Difficulty = new(big.Int).Lsh(big.NewInt(1), 200)
+	header.GasLimit = ^uint64(0)
+	assert.Equal(t, legacySigHash(header), sigHash(header))
+}
+
+func BenchmarkSigHash(b *testing.B) {
+	header := newSigHashTestHeader(1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sigHash(header)
+	}
+}
+
+func TestEvictOrphans(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+	engine := New(nil, ethdb.NewMemDatabase())
+
+	canonical := &types.Header{Number: big.NewInt(1), Time: big.NewInt(0)}
+	signTestHeader(t, canonical, key)
+	addr, err := ecrecover(canonical, engine.signatures)
+	assert.Nil(t, err)
+	assert.Equal(t, signer, addr)
+
+	// simulate a heavy fork whose headers all get recovered and then orphaned
+	orphans := make([]*types.Header, 0, 256)
+	for i := 0; i < cap(orphans); i++ {
+		header := &types.Header{Number: big.NewInt(1), Time: big.NewInt(int64(i + 1))}
+		signTestHeader(t, header, key)
+		_, err := ecrecover(header, engine.signatures)
+		assert.Nil(t, err)
+		orphans = append(orphans, header)
+	}
+	assert.Equal(t, len(orphans)+1, engine.signatures.Len())
+
+	engine.EvictOrphans(orphans)
+	assert.Equal(t, 1, engine.signatures.Len())
+	for _, header := range orphans {
+		assert.False(t, engine.signatures.Contains(header.Hash()))
+	}
+	assert.True(t, engine.signatures.Contains(canonical.Hash()))
+}
+
+// newTestChain builds a chain on top of genesis with one block per given
+// validator and timestamp.
+func newTestChain(genesis *types.Header, validators []common.Address, times []int64, dposContext *types.DposContextProto) *testChainReader {
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis}}
+	for i, validator := range validators {
+		parent := chain.headers[len(chain.headers)-1]
+		chain.headers = append(chain.headers, &types.Header{
+			ParentHash:  parent.Hash(),
+			Number:      big.NewInt(int64(i + 1)),
+			Time:        big.NewInt(times[i]),
+			Validator:   validator,
+			DposContext: dposContext,
+		})
+	}
+	return chain
+}
+
+func TestUpdateConfirmedBlockHeaderSmallValidatorSet(t *testing.T) {
+	validators := []common.Address{
+		common.StringToAddress("addr0"),
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators(validators))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	// the genesis maximum is far larger than the four elected validators
+	genesis := newGenesisHeader(0)
+
+	// three distinct validators confirm a block, even if the window spans an epoch change
+	engine := New(nil, db)
+	times := []int64{epochInterval - 3*blockInterval, epochInterval - 2*blockInterval, epochInterval - blockInterval, epochInterval}
+	chain := newTestChain(genesis, validators, times, proto)
+	assert.Nil(t, engine.UpdateConfirmedBlockHeader(chain))
+	assert.Equal(t, uint64(2), engine.confirmedBlockHeader.Number.Uint64())
+
+	// the confirmed block is persisted
+	confirmed, err := engine.loadConfirmedBlockHeader(chain)
+	assert.Nil(t, err)
+	assert.Equal(t, chain.headers[2].Hash(), confirmed.Hash())
+
+	// repeated signers don't count twice
+	engine = New(nil, db)
+	assert.Equal(t, 3, engine.consensusSize(genesis, chain.CurrentHeader()))
+	repeated := []common.Address{validators[1], validators[0], validators[1], validators[0]}
+	chain = newTestChain(genesis, repeated, times, proto)
+	assert.Nil(t, engine.UpdateConfirmedBlockHeader(chain))
+	assert.Equal(t, uint64(0), engine.confirmedBlockHeader.Number.Uint64())
+}
+
+func TestReorgRecomputesConfirmation(t *testing.T) {
+	validators := []common.Address{
+		common.StringToAddress("addr0"),
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators(validators))
+	oldProto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+
+	engine := New(nil, db)
+	oldTimes := []int64{blockInterval, 2 * blockInterval, 3 * blockInterval, 4 * blockInterval}
+	oldChain := newTestChain(genesis, validators, oldTimes, oldProto)
+	assert.Nil(t, engine.UpdateConfirmedBlockHeader(oldChain))
+	assert.Equal(t, oldChain.headers[2].Hash(), engine.confirmedBlockHeader.Hash())
+
+	// the new canonical chain forks off genesis and minted its own blocks
+	for i, validator := range validators {
+		setMintCntTrie(0, validator, dposContext.MintCntTrie(), int64(i+1))
+	}
+	newProto, err := dposContext.Commit()
+	assert.Nil(t, err)
+	signers := append(validators, validators[0])
+	newTimes := []int64{blockInterval + 1, 2*blockInterval + 1, 3*blockInterval + 1, 4*blockInterval + 1, 5*blockInterval + 1}
+	newChain := newTestChain(genesis, signers, newTimes, newProto)
+
+	assert.Nil(t, engine.Reorg(newChain, newChain.CurrentHeader(), oldChain.headers[1:]))
+	assert.Equal(t, newChain.headers[3].Hash(), engine.confirmedBlockHeader.Hash())
+	confirmed, err := engine.loadConfirmedBlockHeader(newChain)
+	assert.Nil(t, err)
+	assert.Equal(t, newChain.headers[3].Hash(), confirmed.Hash())
+
+	api := &API{chain: newChain, dpos: engine}
+	number, err := api.GetConfirmedBlockNumber()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), number.Uint64())
+	info, err := api.GetEpochInfo(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), info.MintedBlocks)
+
+	// a reorg above the confirmed block keeps it
+	engine = New(nil, db)
+	assert.Nil(t, engine.UpdateConfirmedBlockHeader(newChain))
+	assert.Nil(t, engine.Reorg(newChain, newChain.CurrentHeader(), []*types.Header{oldChain.headers[4]}))
+	assert.Equal(t, newChain.headers[3].Hash(), engine.confirmedBlockHeader.Hash())
+}
+
+func TestMaxAllowedReorgDepth(t *testing.T) {
+	validators := []common.Address{
+		common.StringToAddress("addr0"),
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators(validators))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+	times := []int64{blockInterval, 2 * blockInterval, 3 * blockInterval, 4 * blockInterval}
+	chain := newTestChain(genesis, validators, times, proto)
+
+	// without the limit any reorg goes
+	engine := New(nil, db)
+	assert.Equal(t, uint64(math.MaxUint64), engine.MaxAllowedReorgDepth(chain))
+	assert.Nil(t, engine.VerifyReorg(chain, 4))
+
+	// nothing is confirmed yet, the reorg may reach down to genesis plus the margin
+	engine = New(&params.DposConfig{LimitReorgDepth: true, ReorgDepthMargin: 1}, db)
+	assert.Equal(t, uint64(5), engine.MaxAllowedReorgDepth(chain))
+
+	// block 2 is confirmed by the head at 4
+	assert.Nil(t, engine.UpdateConfirmedBlockHeader(chain))
+	assert.Equal(t, chain.headers[2].Hash(), engine.confirmedBlockHeader.Hash())
+	assert.Equal(t, uint64(3), engine.MaxAllowedReorgDepth(chain))
+	assert.Nil(t, engine.VerifyReorg(chain, 2))
+	assert.Nil(t, engine.VerifyReorg(chain, 3))
+	assert.Equal(t, ErrReorgTooDeep, engine.VerifyReorg(chain, 4))
+
+	// without a margin the confirmed block can't be orphaned
+	engine = New(&params.DposConfig{LimitReorgDepth: true}, db)
+	assert.Equal(t, uint64(2), engine.MaxAllowedReorgDepth(chain))
+	assert.Equal(t, ErrReorgTooDeep, engine.VerifyReorg(chain, 3))
+}
+
+func TestConfirmedHeaderByNumber(t *testing.T) {
+	validators := []common.Address{
+		common.StringToAddress("addr0"),
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators(validators))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+
+	var (
+		signers []common.Address
+		times   []int64
+	)
+	for i := 0; i < 12; i++ {
+		signers = append(signers, validators[i%len(validators)])
+		times = append(times, int64(i+1)*blockInterval)
+	}
+	full := newTestChain(genesis, signers, times, proto)
+
+	// advance finality a few times by growing the chain
+	engine := New(nil, db)
+	var checkpoints []*types.Header
+	for _, length := range []int{3, 6, 9, 12} {
+		chain := &testChainReader{config: full.config, headers: full.headers[:length+1]}
+		assert.Nil(t, engine.UpdateConfirmedBlockHeader(chain))
+		checkpoints = append(checkpoints, engine.confirmedBlockHeader)
+	}
+	for _, checkpoint := range checkpoints {
+		header, err := engine.ConfirmedHeaderByNumber(checkpoint.Number.Uint64())
+		assert.Nil(t, err)
+		assert.Equal(t, checkpoint.Hash(), header.Hash())
+	}
+	// with three signers required, finality trails the head by two blocks
+	for i, checkpoint := range checkpoints {
+		assert.Equal(t, uint64(3*i+1), checkpoint.Number.Uint64())
+	}
+
+	// blocks that never were a checkpoint are unknown
+	_, err = engine.ConfirmedHeaderByNumber(2)
+	assert.Equal(t, errUnknownBlock, err)
+	_, err = engine.ConfirmedHeaderByNumber(100)
+	assert.Equal(t, errUnknownBlock, err)
+}
+
+// countingChainReader indexes the headers of a test chain by hash and counts
+// the lookups by hash.
+type countingChainReader struct {
+	*testChainReader
+	byHash  map[common.Hash]*types.Header
+	lookups int
+}
+
+func (c *countingChainReader) GetHeaderByHash(hash common.Hash) *types.Header {
+	c.lookups++
+	return c.byHash[hash]
+}
+
+func TestConfirmationWalkBounded(t *testing.T) {
+	validators := []common.Address{
+		common.StringToAddress("addr0"),
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators(validators))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+
+	// two validators alone can't confirm anything, the chain grows unconfirmed
+	var (
+		signers []common.Address
+		times   []int64
+	)
+	for i := 0; i < 2*confirmationWalk; i++ {
+		signers = append(signers, validators[i%2])
+		times = append(times, int64(i+1)*blockInterval)
+	}
+	signers = append(signers, validators[2], validators[3])
+	times = append(times, int64(len(times)+1)*blockInterval, int64(len(times)+2)*blockInterval)
+	full := newTestChain(genesis, signers, times, proto)
+	byHash := make(map[common.Hash]*types.Header, len(full.headers))
+	for _, header := range full.headers {
+		byHash[header.Hash()] = header
+	}
+
+	engine := New(nil, db)
+	engine.confirmedBlockHeader = genesis
+	unconfirmed := &countingChainReader{testChainReader: &testChainReader{config: full.config, headers: full.headers[:len(full.headers)-2]}, byHash: byHash}
+	assert.Nil(t, engine.UpdateConfirmedBlockHeader(unconfirmed))
+	assert.Equal(t, genesis.Hash(), engine.confirmedBlockHeader.Hash())
+	assert.True(t, unconfirmed.lookups <= confirmationWalk, "%d lookups", unconfirmed.lookups)
+
+	// the other validators joining confirms the block below them
+	chain := &countingChainReader{testChainReader: full, byHash: byHash}
+	assert.Nil(t, engine.UpdateConfirmedBlockHeader(chain))
+	assert.Equal(t, full.headers[len(full.headers)-3].Hash(), engine.confirmedBlockHeader.Hash())
+	assert.Equal(t, 2, chain.lookups)
+}
+
+func TestFinalityMode(t *testing.T) {
+	validators := []common.Address{
+		common.StringToAddress("addr0"),
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators(validators))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+
+	var (
+		signers []common.Address
+		times   []int64
+	)
+	for i := 0; i < 12; i++ {
+		signers = append(signers, validators[i%len(validators)])
+		times = append(times, int64(i+1)*blockInterval)
+	}
+	full := newTestChain(genesis, signers, times, proto)
+
+	tests := []struct {
+		config    *params.DposConfig
+		confirmed []uint64 // confirmed block at heads 1 to 12
+	}{
+		// three distinct signers confirm a block
+		{&params.DposConfig{FinalityMode: params.Supermajority}, []uint64{0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		// blocks five deep are confirmed, no matter who minted on top
+		{&params.DposConfig{FinalityMode: params.FixedDepth, FinalityDepth: 5}, []uint64{0, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7}},
+	}
+	for _, test := range tests {
+		engine := New(test.config, db)
+		engine.confirmedBlockHeader = genesis
+		for i, expected := range test.confirmed {
+			chain := &testChainReader{config: full.config, headers: full.headers[:i+2]}
+			assert.Nil(t, engine.UpdateConfirmedBlockHeader(chain))
+			assert.Equal(t, expected, engine.confirmedBlockHeader.Number.Uint64(), "%s finality, head %d", test.config.FinalityMode, i+1)
+		}
+		confirmed, err := engine.loadConfirmedBlockHeader(full)
+		assert.Nil(t, err)
+		assert.Equal(t, full.headers[test.confirmed[len(test.confirmed)-1]].Hash(), confirmed.Hash())
+	}
+}
+
+func TestRestartAfterCrash(t *testing.T) {
+	// Finalize latches the time of the first block, don't leak it into other tests
+	defer func(first int64) { timeOfFirstBlock = first }(timeOfFirstBlock)
+
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	validator := common.StringToAddress("validator")
+	assert.Nil(t, dposContext.SetValidators([]common.Address{validator}))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+	genesis.DposContext = proto
+	parent := &types.Header{
+		ParentHash:  genesis.Hash(),
+		Number:      big.NewInt(1),
+		Time:        big.NewInt(2*epochInterval - blockInterval),
+		DposContext: proto,
+	}
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis, parent}}
+	provider := newMockProvider(maxValidatorSize)
+	// finalizing the election block again after a crash yields the same block
+	finalize := func() *types.Block {
+		engine := New(nil, db)
+		engine.SetValidatorProvider(provider)
+		dposContext, err := types.NewDposContextFromProto(trie.NewDatabase(db), proto)
+		assert.Nil(t, err)
+		stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(2),
+			Time:       big.NewInt(2 * epochInterval),
+			Validator:  validator,
+			Coinbase:   validator,
+		}
+		block, err := engine.Finalize(chain, header, stateDB, nil, nil, nil, dposContext)
+		assert.Nil(t, err)
+		return block
+	}
+	first, second := finalize(), finalize()
+	assert.Equal(t, first.Hash(), second.Hash())
+	assert.Equal(t, first.Header().DposContext, second.Header().DposContext)
+
+	// confirmation picks up where it was when the node was killed
+	validators := []common.Address{
+		common.StringToAddress("addr0"),
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	assert.Nil(t, dposContext.SetValidators(validators))
+	proto, err = dposContext.Commit()
+	assert.Nil(t, err)
+	var (
+		signers []common.Address
+		times   []int64
+	)
+	for i := 0; i < 12; i++ {
+		signers = append(signers, validators[i%len(validators)])
+		times = append(times, int64(i+1)*blockInterval)
+	}
+	full := newTestChain(genesis, signers, times, proto)
+	confirm := func(engine *Dpos, from, to int) {
+		for length := from; length <= to; length++ {
+			assert.Nil(t, engine.UpdateConfirmedBlockHeader(&testChainReader{config: full.config, headers: full.headers[:length+1]}))
+		}
+	}
+	uninterrupted := New(nil, db)
+	uninterrupted.confirmedBlockHeader = genesis
+	confirm(uninterrupted, 1, 12)
+
+	crashed := New(nil, db)
+	crashed.confirmedBlockHeader = genesis
+	confirm(crashed, 1, 7)
+	restarted := New(nil, db)
+	confirm(restarted, 8, 12)
+	assert.Equal(t, uint64(10), restarted.confirmedBlockHeader.Number.Uint64())
+	assert.Equal(t, uninterrupted.confirmedBlockHeader.Hash(), restarted.confirmedBlockHeader.Hash())
+
+	// closing flushes the confirmed block even if its last write got lost
+	assert.Nil(t, db.Delete(confirmedBlockHead))
+	assert.Nil(t, restarted.Close())
+	confirmed, err := New(nil, db).loadConfirmedBlockHeader(full)
+	assert.Nil(t, err)
+	assert.Equal(t, restarted.confirmedBlockHeader.Hash(), confirmed.Hash())
+}
+
+// staleHeadChain reports an outdated head, like a chain that moved on while
+// the head was being read.
+type staleHeadChain struct {
+	*testChainReader
+	head *types.Header
+}
+
+func (c *staleHeadChain) CurrentHeader() *types.Header { return c.head }
+
+func TestRecomputeConfirmedBlock(t *testing.T) {
+	validators := []common.Address{
+		common.StringToAddress("addr0"),
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators(validators))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+
+	var (
+		signers []common.Address
+		times   []int64
+	)
+	for i := 0; i < 12; i++ {
+		signers = append(signers, validators[i%len(validators)])
+		times = append(times, int64(i+1)*blockInterval)
+	}
+	full := newTestChain(genesis, signers, times, proto)
+
+	// confirm the blocks the way block import does, one head at a time
+	engine := New(nil, db)
+	for length := 1; length < len(full.headers); length++ {
+		chain := &testChainReader{config: full.config, headers: full.headers[:length+1]}
+		assert.Nil(t, engine.UpdateConfirmedBlockHeader(chain))
+	}
+	expected := engine.confirmedBlockHeader
+	assert.Equal(t, uint64(10), expected.Number.Uint64())
+
+	// corrupt the stored confirmed block, a restarted node can't load it
+	assert.Nil(t, db.Put(confirmedBlockHead, common.HexToHash("0xdead").Bytes()))
+	engine = New(nil, db)
+	_, err = engine.loadConfirmedBlockHeader(full)
+	assert.Equal(t, ErrNilBlockHeader, err)
+
+	admin := &AdminAPI{chain: full, dpos: engine}
+	recomputed, err := admin.RecomputeConfirmedBlock()
+	assert.Nil(t, err)
+	assert.Equal(t, expected.Hash(), recomputed.Hash())
+	loaded, err := engine.loadConfirmedBlockHeader(full)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.Hash(), loaded.Hash())
+
+	// the replay resumes from a stored confirmed block on the canonical chain
+	engine.confirmedBlockHeader = full.headers[11]
+	assert.Nil(t, engine.storeConfirmedBlockHeader(db))
+	recomputed, err = engine.RecomputeConfirmedBlock(full)
+	assert.Nil(t, err)
+	assert.Equal(t, full.headers[11].Hash(), recomputed.Hash())
+
+	// a failed replay leaves the confirmed block alone
+	broken := &testChainReader{config: full.config, headers: append(full.headers[:11:11], &types.Header{Number: big.NewInt(12)})}
+	engine.confirmedBlockHeader = expected
+	_, err = engine.RecomputeConfirmedBlock(broken)
+	assert.NotNil(t, err)
+	assert.Equal(t, expected, engine.confirmedBlockHeader)
+
+	// a newer block confirmed by block import during the replay is kept
+	assert.Nil(t, db.Put(confirmedBlockHead, common.HexToHash("0xdead").Bytes()))
+	engine.confirmedBlockHeader = full.headers[11]
+	recomputed, err = engine.RecomputeConfirmedBlock(&staleHeadChain{full, full.headers[5]})
+	assert.Nil(t, err)
+	assert.Equal(t, full.headers[11].Hash(), recomputed.Hash())
+	loaded, err = engine.loadConfirmedBlockHeader(full)
+	assert.Nil(t, err)
+	assert.Equal(t, full.headers[11].Hash(), loaded.Hash())
+
+	// a chain too short to confirm anything recomputes to genesis
+	short := &testChainReader{config: full.config, headers: full.headers[:2]}
+	recomputed, err = engine.RecomputeConfirmedBlock(short)
+	assert.Nil(t, err)
+	assert.Equal(t, genesis.Hash(), recomputed.Hash())
+}
+
+func TestAccumulateRewardsRankCurve(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	ranks := []common.Address{
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	assert.Nil(t, dposContext.SetValidatorRanks(ranks))
+
+	config := *params.DposChainConfig
+	config.Dpos = &params.DposConfig{RankRewardCurve: []uint64{120, 110}}
+	rewards := make([]*big.Int, len(ranks))
+	for i, validator := range ranks {
+		stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+		header := &types.Header{Number: big.NewInt(1), Validator: validator, Coinbase: validator}
+		AccumulateRewards(&config, stateDB, header, nil, dposContext, false)
+		rewards[i] = stateDB.GetBalance(validator)
+	}
+	// rank 1 earns more than the last rank, which is paid the last curve entry
+	assert.True(t, rewards[0].Cmp(rewards[len(ranks)-1]) > 0)
+	assert.Equal(t, new(big.Int).Div(new(big.Int).Mul(byzantiumBlockReward, big.NewInt(120)), big.NewInt(100)), rewards[0])
+	assert.Equal(t, new(big.Int).Div(new(big.Int).Mul(byzantiumBlockReward, big.NewInt(110)), big.NewInt(100)), rewards[1])
+	assert.Equal(t, rewards[1], rewards[2])
+
+	// unranked validators and chains without a curve earn the flat reward
+	unranked := common.StringToAddress("unranked")
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	AccumulateRewards(&config, stateDB, &types.Header{Number: big.NewInt(1), Validator: unranked, Coinbase: unranked}, nil, dposContext, false)
+	assert.Equal(t, byzantiumBlockReward, stateDB.GetBalance(unranked))
+
+	stateDB, _ = state.New(common.Hash{}, state.NewDatabase(db))
+	AccumulateRewards(params.DposChainConfig, stateDB, &types.Header{Number: big.NewInt(1), Validator: ranks[0], Coinbase: ranks[0]}, nil, dposContext, false)
+	assert.Equal(t, byzantiumBlockReward, stateDB.GetBalance(ranks[0]))
+}
+
+func TestAccumulateRewardsForkSwitch(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+
+	config := *params.DposChainConfig
+	config.ByzantiumBlock = big.NewInt(10)
+	config.Dpos = &params.DposConfig{}
+	reward := func(number int64) *big.Int {
+		stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+		header := &types.Header{Number: big.NewInt(number), Time: big.NewInt(0), Coinbase: common.StringToAddress("coinbase")}
+		return AccumulateRewards(&config, stateDB, header, nil, dposContext, false)
+	}
+	// by default the reward drops at the byzantium block
+	assert.Equal(t, frontierBlockReward, reward(9))
+	assert.Equal(t, byzantiumBlockReward, reward(10))
+	assert.Equal(t, byzantiumBlockReward, reward(11))
+
+	config.Dpos.DisableForkRewardSwitch = true
+	assert.Equal(t, frontierBlockReward, reward(9))
+	assert.Equal(t, frontierBlockReward, reward(10))
+	assert.Equal(t, frontierBlockReward, reward(11))
+}
+
+func TestAccumulateRewardsEpochCap(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+
+	config := *params.DposChainConfig
+	dposConfig := *config.Dpos
+	dposConfig.EpochRewardCap = new(big.Int).Div(new(big.Int).Mul(byzantiumBlockReward, big.NewInt(5)), big.NewInt(2))
+	config.Dpos = &dposConfig
+
+	coinbase := common.StringToAddress("coinbase")
+	epoch := int64(2)
+	mint := func(time int64) *big.Int {
+		header := &types.Header{Number: big.NewInt(1), Time: big.NewInt(time), Coinbase: coinbase}
+		reward := AccumulateRewards(&config, stateDB, header, nil, dposContext, false)
+		assert.Nil(t, dposContext.AddEpochReward(EpochID(nil, time), reward))
+		return reward
+	}
+	half := new(big.Int).Div(byzantiumBlockReward, big.NewInt(2))
+	expected := []*big.Int{byzantiumBlockReward, byzantiumBlockReward, half, new(big.Int), new(big.Int)}
+	for i, reward := range expected {
+		assert.Equal(t, reward, mint(epoch*epochInterval+int64(i)*blockInterval))
+	}
+	assert.Equal(t, dposConfig.EpochRewardCap, stateDB.GetBalance(coinbase))
+
+	// the next epoch starts with the full subsidy again
+	assert.Equal(t, byzantiumBlockReward, mint((epoch+1)*epochInterval))
+
+	// without a cap the subsidy is never cut
+	header := &types.Header{Number: big.NewInt(1), Time: big.NewInt(epoch * epochInterval), Coinbase: coinbase}
+	assert.Equal(t, byzantiumBlockReward, AccumulateRewards(params.DposChainConfig, stateDB, header, nil, dposContext, false))
+}
+
+func TestAccumulateRewardsPayout(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+
+	validator := common.StringToAddress("validator")
+	coinbase := common.StringToAddress("coinbase")
+	payout := common.StringToAddress("cold wallet")
+	header := &types.Header{Number: big.NewInt(1), Time: big.NewInt(0), Validator: validator, Coinbase: coinbase}
+
+	// rewards go to the coinbase unless a payout address is set
+	AccumulateRewards(params.DposChainConfig, stateDB, header, nil, dposContext, false)
+	assert.Equal(t, byzantiumBlockReward, stateDB.GetBalance(coinbase))
+
+	assert.Nil(t, dposContext.BecomeCandidate(validator))
+	assert.Nil(t, dposContext.SetPayout(validator, payout))
+	AccumulateRewards(params.DposChainConfig, stateDB, header, nil, dposContext, false)
+	assert.Equal(t, byzantiumBlockReward, stateDB.GetBalance(coinbase))
+	assert.Equal(t, byzantiumBlockReward, stateDB.GetBalance(payout))
+
+	// payout addresses of other validators don't apply
+	header.Validator = common.StringToAddress("other")
+	AccumulateRewards(params.DposChainConfig, stateDB, header, nil, dposContext, false)
+	assert.Equal(t, new(big.Int).Mul(byzantiumBlockReward, big.NewInt(2)), stateDB.GetBalance(coinbase))
+}
+
+func TestFinalizeEpochReward(t *testing.T) {
+	// Finalize latches the time of the first block, don't leak it into other tests
+	defer func(first int64) { timeOfFirstBlock = first }(timeOfFirstBlock)
+
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	validator := common.StringToAddress("validator")
+	assert.Nil(t, dposContext.SetValidators([]common.Address{validator}))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+	genesis.DposContext = proto
+	epoch := int64(2)
+	parent := &types.Header{
+		ParentHash:  genesis.Hash(),
+		Number:      big.NewInt(1),
+		Time:        big.NewInt(epoch * epochInterval),
+		DposContext: proto,
+	}
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis, parent}}
+	engine := New(&params.DposConfig{EpochHistoryBlock: big.NewInt(0)}, db)
+
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	expected := new(big.Int)
+	for i := int64(1); i <= 5; i++ {
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(parent.Number.Int64() + 1),
+			Time:       big.NewInt(parent.Time.Int64() + blockInterval),
+			Validator:  validator,
+			Coinbase:   validator,
+		}
+		var (
+			txs      []*types.Transaction
+			receipts []*types.Receipt
+		)
+		for j := int64(0); j < i; j++ {
+			txs = append(txs, types.NewTransaction(types.Binary, uint64(j), validator, new(big.Int), 21000, big.NewInt(i), nil))
+			receipts = append(receipts, &types.Receipt{GasUsed: 21000})
+			expected.Add(expected, big.NewInt(21000*i))
+		}
+		block, err := engine.Finalize(chain, header, stateDB, txs, nil, receipts, dposContext)
+		assert.Nil(t, err)
+		expected.Add(expected, byzantiumBlockReward)
+
+		parent = block.Header()
+		chain.headers = append(chain.headers, parent)
+	}
+	reward, err := dposContext.GetEpochReward(epoch)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, reward)
+
+	// other epochs are untouched
+	reward, err = dposContext.GetEpochReward(epoch + 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, reward.Sign())
+
+	// the total is exposed over the API
+	api := &API{chain: chain, dpos: engine}
+	_, err = dposContext.Commit()
+	assert.Nil(t, err)
+	reward, err = api.GetEpochReward(epoch, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, reward)
+}
+
+func TestVerifyHeaderValidatorSlot(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	validators := []common.Address{
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	assert.Nil(t, dposContext.SetValidators(validators))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+	genesis.DposContext = proto
+	parent := &types.Header{
+		ParentHash:  genesis.Hash(),
+		Number:      big.NewInt(1),
+		Time:        big.NewInt(2 * epochInterval),
+		DposContext: proto,
+	}
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis, parent}}
+	engine := New(nil, db)
+
+	newHeader := func(validator common.Address) *types.Header {
+		return &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(2),
+			Time:       big.NewInt(2*epochInterval + blockInterval),
+			Difficulty: big.NewInt(1),
+			UncleHash:  uncleHash,
+			Extra:      make([]byte, extraVanity+extraSeal),
+			Validator:  validator,
+		}
+	}
+	// the slot after the parent belongs to the second validator
+	assert.Nil(t, engine.verifyHeader(chain, newHeader(validators[1]), nil, uint64(blockInterval)))
+	assert.Equal(t, ErrInvalidBlockValidator, engine.verifyHeader(chain, newHeader(validators[2]), nil, uint64(blockInterval)))
+
+	// without the parent's dpos state the check is left to the seal verification
+	engine = New(nil, ethdb.NewMemDatabase())
+	assert.Nil(t, engine.verifyHeader(chain, newHeader(validators[2]), nil, uint64(blockInterval)))
+}
+
+func TestVerifyHeaderCoinbaseValidator(t *testing.T) {
+	genesis := newGenesisHeader(0)
+	parent := &types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), Time: big.NewInt(epochInterval)}
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis, parent}}
+
+	validator := common.StringToAddress("validator")
+	newHeader := func(coinbase common.Address) *types.Header {
+		return &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(2),
+			Time:       big.NewInt(epochInterval + blockInterval),
+			Difficulty: big.NewInt(1),
+			UncleHash:  uncleHash,
+			Extra:      make([]byte, extraVanity+extraSeal),
+			Validator:  validator,
+			Coinbase:   coinbase,
+		}
+	}
+	other := common.StringToAddress("other")
+
+	// mismatches are accepted by default
+	engine := New(nil, ethdb.NewMemDatabase())
+	assert.Nil(t, engine.verifyHeader(chain, newHeader(other), nil, uint64(blockInterval)))
+
+	engine = New(&params.DposConfig{RequireCoinbaseEqualsValidator: true}, ethdb.NewMemDatabase())
+	assert.Nil(t, engine.verifyHeader(chain, newHeader(validator), nil, uint64(blockInterval)))
+	assert.Equal(t, ErrCoinbaseValidatorMismatch, engine.verifyHeader(chain, newHeader(other), nil, uint64(blockInterval)))
+}
+
+func TestVerifyHeaderGenesisNumber(t *testing.T) {
+	genesis := newGenesisHeader(0)
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis}}
+	engine := New(nil, ethdb.NewMemDatabase())
+
+	// a header claiming to be a second genesis has no parent to underflow into
+	header := &types.Header{
+		ParentHash: genesis.Hash(),
+		Number:     big.NewInt(0),
+		Time:       big.NewInt(blockInterval),
+		Difficulty: big.NewInt(1),
+		UncleHash:  uncleHash,
+		Extra:      make([]byte, extraVanity+extraSeal),
+	}
+	assert.Equal(t, errGenesisHeader, engine.verifyHeader(chain, header, nil, uint64(blockInterval)))
+	assert.Equal(t, errGenesisHeader, engine.verifyHeader(chain, header, []*types.Header{genesis}, uint64(blockInterval)))
+}
+
+func TestEpochOffset(t *testing.T) {
+	offset := int64(3600)
+	config := &params.DposConfig{EpochOffset: uint64(offset), EpochHistoryBlock: big.NewInt(0)}
+	boundary := 10*epochInterval + offset
+
+	assert.Equal(t, int64(10), EpochID(config, boundary))
+	assert.Equal(t, int64(9), EpochID(config, boundary-1))
+	assert.Equal(t, int64(10), EpochID(nil, boundary-1))
+	assert.Equal(t, boundary, epochStart(config, 10))
+	// offsets wrap around the epoch interval
+	assert.Equal(t, int64(10), EpochID(&params.DposConfig{EpochOffset: uint64(epochInterval + offset)}, boundary))
+
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	validator := common.StringToAddress("validator")
+
+	// mint counts restart at the offset boundary, not at the unaligned one
+	updateMintCnt(EpochID(config, boundary-2*blockInterval), EpochID(config, boundary-blockInterval), validator, dposContext)
+	updateMintCnt(EpochID(config, boundary-blockInterval), EpochID(config, boundary), validator, dposContext)
+	assert.Equal(t, int64(1), getMintCnt(9, validator, dposContext.MintCntTrie()))
+	assert.Equal(t, int64(1), getMintCnt(10, validator, dposContext.MintCntTrie()))
+	updateMintCnt(EpochID(config, boundary), EpochID(config, boundary+blockInterval), validator, dposContext)
+	assert.Equal(t, int64(2), getMintCnt(10, validator, dposContext.MintCntTrie()))
+
+	// the election is held by the first block after the offset boundary
+	provider := newMockProvider(maxValidatorSize)
+	genesis := newGenesisHeader(0)
+	newEpochContext := func(now int64) *EpochContext {
+		return &EpochContext{TimeStamp: now, DposContext: dposContext, statedb: stateDB, provider: provider, config: config}
+	}
+	parent := &types.Header{Number: big.NewInt(1), Time: big.NewInt(9*epochInterval + offset)}
+	assert.Nil(t, newEpochContext(boundary-blockInterval).tryElect(genesis, parent))
+	_, err = dposContext.GetEpochValidators(10)
+	assert.NotNil(t, err)
+
+	parent.Time = big.NewInt(boundary - blockInterval)
+	assert.Nil(t, newEpochContext(boundary).tryElect(genesis, parent))
+	validators, err := dposContext.GetEpochValidators(10)
+	assert.Nil(t, err)
+	assert.Equal(t, maxValidatorSize, len(validators))
+
+	// the slots of the epoch are counted from its start
+	epochContext := newEpochContext(boundary)
+	first, err := epochContext.lookupValidator(boundary, uint64(blockInterval))
+	assert.Nil(t, err)
+	assert.Equal(t, validators[0], first)
+	second, err := epochContext.lookupValidator(boundary+blockInterval, uint64(blockInterval))
+	assert.Nil(t, err)
+	assert.Equal(t, validators[1], second)
+}
+
+// writeCountingDatabase counts the writes reaching the wrapped database.
+type writeCountingDatabase struct {
+	ethdb.Database
+	writes int
+}
+
+func (db *writeCountingDatabase) Put(key []byte, value []byte) error {
+	db.writes++
+	return db.Database.Put(key, value)
+}
+
+func (db *writeCountingDatabase) Delete(key []byte) error {
+	db.writes++
+	return db.Database.Delete(key)
+}
+
+func (db *writeCountingDatabase) NewBatch() ethdb.Batch {
+	return &writeCountingBatch{Batch: db.Database.NewBatch(), db: db}
+}
+
+type writeCountingBatch struct {
+	ethdb.Batch
+	db *writeCountingDatabase
+}
+
+func (b *writeCountingBatch) Put(key []byte, value []byte) error {
+	b.db.writes++
+	return b.Batch.Put(key, value)
+}
+
+func (b *writeCountingBatch) Delete(key []byte) error {
+	b.db.writes++
+	return b.Batch.Delete(key)
+}
+
+func TestVerifySealNoWrites(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+	db := &writeCountingDatabase{Database: ethdb.NewMemDatabase()}
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators([]common.Address{signer}))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+	genesis.DposContext = proto
+	chain := newTestChain(genesis, []common.Address{signer, signer}, []int64{blockInterval, 2 * blockInterval}, proto)
+	header := chain.CurrentHeader()
+	signTestHeader(t, header, key)
+
+	engine := New(nil, db)
+	db.writes = 0
+	assert.Nil(t, engine.VerifySeal(chain, header, genesis))
+	assert.Equal(t, 0, db.writes)
+	assert.Nil(t, engine.confirmedBlockHeader)
+
+	// confirmation is advanced explicitly once the block is the head
+	assert.Nil(t, engine.UpdateConfirmedBlockHeader(chain))
+	assert.Equal(t, header.Hash(), engine.confirmedBlockHeader.Hash())
+	assert.NotEqual(t, 0, db.writes)
+}
+
+// newSealedTestChain creates a chain of signed headers spanning the given number
+// of epochs, the validators rotating by one position every epoch.
+func newSealedTestChain(t testing.TB, db ethdb.Database, epochs, perEpoch int) *testChainReader {
+	keys := make([]*ecdsa.PrivateKey, 3)
+	validators := make([]common.Address, len(keys))
+	for i := range keys {
+		keys[i], _ = crypto.GenerateKey()
+		validators[i] = crypto.PubkeyToAddress(keys[i].PublicKey)
+	}
+	protos := make([]*types.DposContextProto, epochs)
+	for epoch := range protos {
+		dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rotated := append(append([]common.Address{}, validators[epoch%len(validators):]...), validators[:epoch%len(validators)]...)
+		if err := dposContext.SetValidators(rotated); err != nil {
+			t.Fatal(err)
+		}
+		if protos[epoch], err = dposContext.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	genesis := newGenesisHeader(0)
+	genesis.DposContext = protos[0]
+
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis}}
+	for epoch := 0; epoch < epochs; epoch++ {
+		for slot := 1; slot <= perEpoch; slot++ {
+			parent := chain.headers[len(chain.headers)-1]
+			parentEpoch := EpochID(nil, parent.Time.Int64())
+			signer := (int(parentEpoch) + slot) % len(keys)
+			header := &types.Header{
+				ParentHash:  parent.Hash(),
+				Number:      new(big.Int).Add(parent.Number, common.Big1),
+				Time:        big.NewInt(int64(epoch)*epochInterval + int64(slot)*blockInterval),
+				Validator:   validators[signer],
+				DposContext: protos[epoch],
+			}
+			signTestHeader(t, header, keys[signer])
+			chain.headers = append(chain.headers, header)
+		}
+	}
+	return chain
+}
+
+func TestExportSchedule(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	chain := newSealedTestChain(t, db, 1, 6)
+	engine := New(nil, db)
+	interval := int64(chain.headers[0].BlockInterval)
+
+	var out bytes.Buffer
+	assert.Nil(t, engine.ExportSchedule(chain, 0, &out, "json"))
+	var schedule []ScheduleSlot
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &schedule))
+	assert.Len(t, schedule, int(epochInterval/interval))
+	for i, slot := range schedule {
+		assert.Equal(t, int64(i), slot.Slot)
+		assert.Equal(t, int64(i)*interval, slot.Time)
+	}
+	// the schedule names the producers of the blocks
+	for _, header := range chain.headers[1:] {
+		slot := schedule[header.Time.Int64()/interval]
+		assert.Equal(t, header.Time.Int64(), slot.Time)
+		assert.Equal(t, header.Validator, slot.Validator)
+	}
+
+	out.Reset()
+	assert.Nil(t, engine.ExportSchedule(chain, 0, &out, "csv"))
+	rows, err := csv.NewReader(&out).ReadAll()
+	assert.Nil(t, err)
+	assert.Len(t, rows, len(schedule)+1)
+	assert.Equal(t, []string{"slot", "time", "validator"}, rows[0])
+	for i, slot := range schedule {
+		assert.Equal(t, []string{strconv.FormatInt(slot.Slot, 10), strconv.FormatInt(slot.Time, 10), slot.Validator.Hex()}, rows[i+1])
+	}
+
+	// other epochs need recorded validators
+	assert.NotNil(t, engine.ExportSchedule(chain, 5, &out, "json"))
+	assert.NotNil(t, engine.ExportSchedule(chain, 0, &out, "xml"))
+	engine = New(&params.DposConfig{EpochMode: params.BlockBased, BlocksPerEpoch: 10}, db)
+	assert.Equal(t, errNoSlotSchedule, engine.ExportSchedule(chain, 0, &out, "json"))
+}
+
+func TestVerifyCompetingHeaders(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	validator := crypto.PubkeyToAddress(key.PublicKey)
+	forger, _ := crypto.GenerateKey()
+
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators([]common.Address{validator}))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+	genesis := newGenesisHeader(0)
+	genesis.DposContext = proto
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis}}
+
+	// two blocks proposed for the same slot, and a third one sealed by a forger
+	proposal := func(coinbase string, signer *ecdsa.PrivateKey) *types.Header {
+		header := &types.Header{
+			ParentHash:  genesis.Hash(),
+			UncleHash:   uncleHash,
+			Coinbase:    common.StringToAddress(coinbase),
+			Number:      big.NewInt(1),
+			Time:        big.NewInt(blockInterval),
+			Difficulty:  big.NewInt(1),
+			Validator:   validator,
+			DposContext: proto,
+		}
+		signTestHeader(t, header, signer)
+		return header
+	}
+	competing := []*types.Header{proposal("first", key), proposal("second", key)}
+	forged := proposal("forged", forger)
+	assert.NotEqual(t, competing[0].Hash(), competing[1].Hash())
+
+	engine := New(nil, db)
+	var wg sync.WaitGroup
+	errs := make(chan error, 300)
+	for i := 0; i < 50; i++ {
+		for _, header := range append(competing, forged) {
+			wg.Add(1)
+			go func(header *types.Header) {
+				defer wg.Done()
+				if err := engine.VerifyHeader(chain, header, true, genesis.BlockInterval); err != nil {
+					errs <- err
+					return
+				}
+				err := engine.VerifySeal(chain, header, genesis)
+				if header == forged {
+					if err != ErrInvalidBlockValidator {
+						errs <- fmt.Errorf("forged header: have %v, want %v", err, ErrInvalidBlockValidator)
+					}
+					return
+				}
+				if err != nil {
+					errs <- err
+				}
+			}(header)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	// each proposal keeps its own signer cached, none touches finality
+	for _, header := range competing {
+		signer, err := ecrecover(header, engine.signatures)
+		assert.Nil(t, err)
+		assert.Equal(t, validator, signer)
+	}
+	signer, err := ecrecover(forged, engine.signatures)
+	assert.Nil(t, err)
+	assert.Equal(t, crypto.PubkeyToAddress(forger.PublicKey), signer)
+	assert.Nil(t, engine.confirmedBlockHeader)
+}
+
+func TestVerifySeals(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	chain := newSealedTestChain(t, db, 3, 8)
+	genesis, headers := chain.headers[0], chain.headers[1:]
+
+	engine := New(nil, db)
+	errs := engine.VerifySeals(chain, headers, genesis)
+	assert.Equal(t, len(headers), len(errs))
+	for i, header := range headers {
+		assert.Nil(t, errs[i])
+		assert.Nil(t, engine.VerifySeal(chain, header, genesis))
+	}
+
+	// a header sealed by someone else than the validator of its slot is rejected
+	key, _ := crypto.GenerateKey()
+	last := headers[len(headers)-1]
+	signTestHeader(t, last, key)
+	errs = New(nil, db).VerifySeals(chain, headers, genesis)
+	for i := range headers[:len(headers)-1] {
+		assert.Nil(t, errs[i])
+	}
+	assert.Equal(t, ErrInvalidBlockValidator, errs[len(errs)-1])
+}
+
+func TestVerifySealValidatorSetSize(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	chain := newSealedTestChain(t, db, 1, 2)
+	genesis, header := chain.headers[0], chain.headers[1]
+	assert.Nil(t, New(nil, db).VerifySeal(chain, header, genesis))
+
+	// the three validators of the chain exceed a smaller maximum
+	small := types.CopyHeader(genesis)
+	small.MaxValidatorSize = 2
+	assert.Equal(t, ErrInvalidValidatorSetSize, New(nil, db).VerifySeal(chain, header, small))
+
+	// a parent without validators can't have a valid successor
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators([]common.Address{}))
+	empty, err := dposContext.Commit()
+	assert.Nil(t, err)
+	parent := types.CopyHeader(chain.headers[0])
+	parent.DposContext = empty
+	assert.Equal(t, ErrInvalidValidatorSetSize, New(nil, db).NewSealVerifier(genesis).Verify(chain, header, []*types.Header{parent}))
+
+	assert.Nil(t, checkValidatorSetSize(make([]common.Address, 2), 2))
+	assert.Equal(t, ErrInvalidValidatorSetSize, checkValidatorSetSize(make([]common.Address, 3), 2))
+	assert.Equal(t, ErrInvalidValidatorSetSize, checkValidatorSetSize(nil, 2))
+}
+
+func BenchmarkVerifySeals(b *testing.B) {
+	db := ethdb.NewMemDatabase()
+	chain := newSealedTestChain(b, db, 4, 64)
+	genesis, headers := chain.headers[0], chain.headers[1:]
+	engine := New(nil, db)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, err := range engine.VerifySeals(chain, headers, genesis) {
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkVerifySealPerHeader(b *testing.B) {
+	db := ethdb.NewMemDatabase()
+	chain := newSealedTestChain(b, db, 4, 64)
+	genesis, headers := chain.headers[0], chain.headers[1:]
+	engine := New(nil, db)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, header := range headers {
+			if err := engine.VerifySeal(chain, header, genesis); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestVerifyDposRoots(t *testing.T) {
+	dposContext, err := types.NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.BecomeCandidate(common.StringToAddress("addr0")))
+	header := &types.Header{Number: big.NewInt(1), DposContext: dposContext.ToProto()}
+	assert.Nil(t, VerifyDposRoots(header, dposContext))
+
+	// every root has to match the recomputed state
+	for _, tamper := range []func(*types.DposContextProto){
+		func(proto *types.DposContextProto) { proto.EpochHash = common.HexToHash("0x01") },
+		func(proto *types.DposContextProto) { proto.DelegateHash = common.HexToHash("0x01") },
+		func(proto *types.DposContextProto) { proto.CandidateHash = common.HexToHash("0x01") },
+		func(proto *types.DposContextProto) { proto.VoteHash = common.HexToHash("0x01") },
+		func(proto *types.DposContextProto) { proto.MintCntHash = common.HexToHash("0x01") },
+	} {
+		tampered := &types.Header{Number: big.NewInt(1), DposContext: dposContext.ToProto()}
+		tamper(tampered.DposContext)
+		assert.Equal(t, ErrDposRootMismatch, VerifyDposRoots(tampered, dposContext))
+	}
+	assert.Equal(t, ErrDposRootMismatch, VerifyDposRoots(&types.Header{Number: big.NewInt(1)}, dposContext))
+
+	// roots of a state that diverged later on don't match either
+	assert.Nil(t, dposContext.BecomeCandidate(common.StringToAddress("addr1")))
+	assert.Equal(t, ErrDposRootMismatch, VerifyDposRoots(header, dposContext))
+}
+
+func TestEpochMode(t *testing.T) {
+	blockBased := &params.DposConfig{EpochMode: params.BlockBased, BlocksPerEpoch: 100, EpochHistoryBlock: big.NewInt(0)}
+	timeBased := &params.DposConfig{EpochMode: params.TimeBased, BlocksPerEpoch: 100, EpochHistoryBlock: big.NewInt(0)}
+	header := &types.Header{Number: big.NewInt(250), Time: big.NewInt(3*epochInterval + blockInterval)}
+	assert.Equal(t, int64(2), HeaderEpochID(blockBased, header))
+	assert.Equal(t, int64(3), HeaderEpochID(timeBased, header))
+	assert.Equal(t, int64(3), HeaderEpochID(nil, header))
+	// block based epochs need their length
+	assert.Equal(t, int64(3), HeaderEpochID(&params.DposConfig{EpochMode: params.BlockBased}, header))
+
+	provider := newMockProvider(maxValidatorSize)
+	genesis := newGenesisHeader(0)
+
+	// the election is held by the first block of the epoch, by number or by time
+	for _, test := range []struct {
+		config          *params.DposConfig
+		electedAtNumber bool
+	}{
+		{blockBased, true},
+		{timeBased, false},
+	} {
+		db := ethdb.NewMemDatabase()
+		dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+		assert.Nil(t, err)
+		stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+		validator := common.StringToAddress("validator")
+
+		parent := &types.Header{Number: big.NewInt(99), Time: big.NewInt(epochInterval / 2)}
+		current := &types.Header{Number: big.NewInt(100), Time: big.NewInt(epochInterval/2 + blockInterval)}
+		epochContext := &EpochContext{TimeStamp: current.Time.Int64(), number: current.Number.Int64(), DposContext: dposContext, statedb: stateDB, provider: provider, config: test.config}
+		assert.Nil(t, epochContext.tryElect(genesis, parent))
+		_, err = dposContext.GetEpochValidators(1)
+		assert.Equal(t, test.electedAtNumber, err == nil)
+
+		updateMintCnt(HeaderEpochID(test.config, parent), HeaderEpochID(test.config, current), validator, dposContext)
+		if test.electedAtNumber {
+			assert.Equal(t, int64(1), getMintCnt(1, validator, dposContext.MintCntTrie()))
+			continue
+		}
+		assert.Equal(t, int64(1), getMintCnt(0, validator, dposContext.MintCntTrie()))
+
+		// time based epochs change with the time, whatever the number
+		parent, current = current, &types.Header{Number: big.NewInt(101), Time: big.NewInt(epochInterval)}
+		epochContext = &EpochContext{TimeStamp: current.Time.Int64(), number: current.Number.Int64(), DposContext: dposContext, statedb: stateDB, provider: provider, config: test.config}
+		assert.Nil(t, epochContext.tryElect(genesis, parent))
+		_, err = dposContext.GetEpochValidators(1)
+		assert.Nil(t, err)
+	}
+}
+
+func TestCurrentSlot(t *testing.T) {
+	validators := []common.Address{
+		common.StringToAddress("addr0"),
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+	}
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators(validators))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+	start := 5 * epochInterval
+	chain := newTestChain(genesis, validators[:1], []int64{start - blockInterval}, proto)
+	engine := New(nil, db)
+
+	tests := []struct {
+		now   int64
+		index int64
+	}{
+		{start, 0},                         // epoch start
+		{start + 37*blockInterval + 4, 37}, // middle, within the slot
+		{start + epochInterval - 1, 8639},  // epoch end
+		{start + epochInterval, 0},         // next epoch
+	}
+	for _, test := range tests {
+		index, slots, validator, err := engine.CurrentSlot(chain, test.now)
+		assert.Nil(t, err)
+		assert.Equal(t, test.index, index, "now %d", test.now)
+		assert.Equal(t, epochInterval/blockInterval, slots)
+		assert.Equal(t, validators[test.index%3], validator, "now %d", test.now)
+	}
+
+	// block based epochs count the blocks instead
+	engine = New(&params.DposConfig{EpochMode: params.BlockBased, BlocksPerEpoch: 120}, db)
+	index, slots, _, err := engine.CurrentSlot(chain, start)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), index)
+	assert.Equal(t, int64(120), slots)
+}
+
+func TestBlocksUntilElection(t *testing.T) {
+	genesis := newGenesisHeader(0)
+	start := 5 * epochInterval
+	chain := newTestChain(genesis, []common.Address{common.StringToAddress("addr0")}, []int64{start - blockInterval}, &types.DposContextProto{})
+	engine := New(nil, ethdb.NewMemDatabase())
+
+	tests := []struct {
+		now     int64
+		seconds int64
+		blocks  int64
+	}{
+		{start, epochInterval, epochInterval / blockInterval},                           // epoch start
+		{start + 1, epochInterval - 1, epochInterval/blockInterval - 1},                 // within the first slot
+		{start + epochInterval/2, epochInterval / 2, epochInterval / blockInterval / 2}, // middle
+		{start + epochInterval - blockInterval, blockInterval, 1},                       // last slot
+		{start + epochInterval - 1, 1, 0},                                               // epoch end, no slot left
+	}
+	for _, test := range tests {
+		seconds, blocks, err := engine.BlocksUntilElection(chain, test.now)
+		assert.Nil(t, err)
+		assert.Equal(t, test.seconds, seconds, "now %d", test.now)
+		assert.Equal(t, test.blocks, blocks, "now %d", test.now)
+	}
+
+	// the epochs are shifted by the offset
+	engine = New(&params.DposConfig{EpochOffset: 3600}, ethdb.NewMemDatabase())
+	seconds, blocks, err := engine.BlocksUntilElection(chain, start)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3600), seconds)
+	assert.Equal(t, 3600/blockInterval, blocks)
+
+	// block based epochs count the blocks, the head is block 1 of 120
+	engine = New(&params.DposConfig{EpochMode: params.BlockBased, BlocksPerEpoch: 120}, ethdb.NewMemDatabase())
+	seconds, blocks, err = engine.BlocksUntilElection(chain, start)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(118), blocks)
+	assert.Equal(t, 118*blockInterval, seconds)
+
+	_, _, err = engine.BlocksUntilElection(&testChainReader{config: params.DposChainConfig}, start)
+	assert.Equal(t, ErrNilBlockHeader, err)
+}
+
+func TestSealHardwareAccount(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	account := accounts.Account{
+		Address: crypto.PubkeyToAddress(key.PublicKey),
+		URL:     accounts.URL{Scheme: "ledger", Path: "m/44'/60'/0'/0/0"},
+	}
+	// the hardware wallet locates the key by the path of the account
+	var signed []accounts.Account
+	signFn := func(account accounts.Account, hash []byte) ([]byte, error) {
+		signed = append(signed, account)
+		return crypto.Sign(hash, key)
+	}
+	genesis := newGenesisHeader(0)
+	genesis.BlockInterval = 1
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis}}
+
+	engine := New(nil, ethdb.NewMemDatabase())
+	engine.AuthorizeAccount(account, signFn)
+	header := &types.Header{
+		ParentHash:  genesis.Hash(),
+		Number:      big.NewInt(1),
+		Time:        big.NewInt(time.Now().Unix()),
+		Validator:   account.Address,
+		Extra:       make([]byte, extraVanity+extraSeal),
+		DposContext: &types.DposContextProto{},
+	}
+	block, err := engine.Seal(chain, types.NewBlockWithHeader(header), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []accounts.Account{account}, signed)
+	signer, err := ecrecover(block.Header(), engine.signatures)
+	assert.Nil(t, err)
+	assert.Equal(t, account.Address, signer)
+
+	// plain keystore signers still only get the address
+	signed = nil
+	engine.Authorize(account.Address, signFn)
+	_, err = engine.Seal(chain, types.NewBlockWithHeader(header), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []accounts.Account{{Address: account.Address}}, signed)
+}
+
+func TestFinalizeElectionBonus(t *testing.T) {
+	// Finalize latches the time of the first block, don't leak it into other tests
+	defer func(first int64) { timeOfFirstBlock = first }(timeOfFirstBlock)
+
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	validator := common.StringToAddress("validator")
+	assert.Nil(t, dposContext.SetValidators([]common.Address{validator}))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	config := *params.DposChainConfig
+	dposConfig := *config.Dpos
+	dposConfig.ElectionBlockBonus = big.NewInt(1000)
+	dposConfig.EpochHistoryBlock = big.NewInt(0)
+	config.Dpos = &dposConfig
+
+	genesis := newGenesisHeader(0)
+	genesis.DposContext = proto
+	epoch := int64(2)
+	parent := &types.Header{
+		ParentHash:  genesis.Hash(),
+		Number:      big.NewInt(1),
+		Time:        big.NewInt(epoch*epochInterval - 2*blockInterval),
+		DposContext: proto,
+	}
+	chain := &testChainReader{config: &config, headers: []*types.Header{genesis, parent}}
+	engine := New(&dposConfig, db)
+	provider := newMockProvider(maxValidatorSize)
+	engine.SetValidatorProvider(provider)
+
+	// only the first block of the epoch holds the election and earns the bonus
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	bonus := new(big.Int).Add(byzantiumBlockReward, dposConfig.ElectionBlockBonus)
+	for _, expected := range []*big.Int{byzantiumBlockReward, bonus, byzantiumBlockReward} {
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(parent.Number.Int64() + 1),
+			Time:       big.NewInt(parent.Time.Int64() + blockInterval),
+			Validator:  validator,
+			Coinbase:   validator,
+		}
+		before := stateDB.GetBalance(validator)
+		block, err := engine.Finalize(chain, header, stateDB, nil, nil, nil, dposContext)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, new(big.Int).Sub(stateDB.GetBalance(validator), before), "block %d", header.Number)
+
+		parent = block.Header()
+		chain.headers = append(chain.headers, parent)
+	}
+	reward, err := dposContext.GetEpochReward(epoch)
+	assert.Nil(t, err)
+	assert.Equal(t, new(big.Int).Add(bonus, byzantiumBlockReward), reward)
+}
+
+func TestFinalizeBurnFees(t *testing.T) {
+	// Finalize latches the time of the first block, don't leak it into other tests
+	defer func(first int64) { timeOfFirstBlock = first }(timeOfFirstBlock)
+
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	validator := common.StringToAddress("validator")
+	assert.Nil(t, dposContext.SetValidators([]common.Address{validator}))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	config := *params.DposChainConfig
+	dposConfig := *config.Dpos
+	dposConfig.BaseFeeBurnRatio = 40
+	dposConfig.EpochHistoryBlock = big.NewInt(0)
+	config.Dpos = &dposConfig
+
+	genesis := newGenesisHeader(0)
+	genesis.DposContext = proto
+	epoch := int64(2)
+	parent := &types.Header{
+		ParentHash:  genesis.Hash(),
+		Number:      big.NewInt(1),
+		Time:        big.NewInt(epoch*epochInterval + blockInterval),
+		DposContext: proto,
+	}
+	chain := &testChainReader{config: &config, headers: []*types.Header{genesis, parent}}
+	engine := New(&dposConfig, db)
+	provider := newMockProvider(maxValidatorSize)
+	engine.SetValidatorProvider(provider)
+
+	// the transactions credited their fees to the validator
+	txs := []*types.Transaction{types.NewTransaction(types.Binary, 0, common.Address{}, new(big.Int), 21000, big.NewInt(10), nil)}
+	receipts := []*types.Receipt{{GasUsed: 21000}}
+	fees := big.NewInt(210000)
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	stateDB.AddBalance(validator, fees)
+
+	header := &types.Header{
+		ParentHash: parent.Hash(),
+		Number:     big.NewInt(2),
+		Time:       big.NewInt(parent.Time.Int64() + blockInterval),
+		Validator:  validator,
+		Coinbase:   validator,
+	}
+	_, err = engine.Finalize(chain, header, stateDB, txs, nil, receipts, dposContext)
+	assert.Nil(t, err)
+
+	// 40% of the fees left circulation, the validator keeps the rest
+	kept := big.NewInt(126000)
+	assert.Equal(t, new(big.Int).Add(byzantiumBlockReward, kept), stateDB.GetBalance(validator))
+	assert.Equal(t, new(big.Int), stateDB.GetBalance(common.Address{}))
+	reward, err := dposContext.GetEpochReward(epoch)
+	assert.Nil(t, err)
+	assert.Equal(t, new(big.Int).Add(byzantiumBlockReward, kept), reward)
+
+	// with a separate coinbase the fees are still burnt from the validator,
+	// which block processing credits them to as the author of the block
+	coinbase := common.StringToAddress("coinbase")
+	stateDB, _ = state.New(common.Hash{}, state.NewDatabase(db))
+	stateDB.AddBalance(validator, fees)
+	header = &types.Header{
+		ParentHash: parent.Hash(),
+		Number:     big.NewInt(2),
+		Time:       big.NewInt(parent.Time.Int64() + blockInterval),
+		Validator:  validator,
+		Coinbase:   coinbase,
+	}
+	_, err = engine.Finalize(chain, header, stateDB, txs, nil, receipts, dposContext)
+	assert.Nil(t, err)
+	assert.Equal(t, kept, stateDB.GetBalance(validator))
+	assert.Equal(t, byzantiumBlockReward, stateDB.GetBalance(coinbase))
+}
+
+func TestSealUnauthorized(t *testing.T) {
+	genesis := newGenesisHeader(0)
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis}}
+	header := &types.Header{
+		ParentHash:  genesis.Hash(),
+		Number:      big.NewInt(1),
+		Time:        big.NewInt(time.Now().Unix()),
+		Extra:       make([]byte, extraVanity+extraSeal),
+		DposContext: &types.DposContextProto{},
+	}
+	engine := New(nil, ethdb.NewMemDatabase())
+	_, err := engine.Seal(chain, types.NewBlockWithHeader(header), nil)
+	assert.Equal(t, ErrSignerNotAuthorized, err)
+
+	// a signer without an address is no signer either
+	engine.Authorize(common.Address{}, func(accounts.Account, []byte) ([]byte, error) { return nil, nil })
+	_, err = engine.Seal(chain, types.NewBlockWithHeader(header), nil)
+	assert.Equal(t, ErrSignerNotAuthorized, err)
+}
+
+func TestVerifyHeaderStaleTime(t *testing.T) {
+	genesis := newGenesisHeader(0)
+	parent := &types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), Time: big.NewInt(epochInterval)}
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis, parent}}
+	engine := New(nil, ethdb.NewMemDatabase())
+
+	// headers have to be at least a slot after their parent, never behind it
+	for _, test := range []struct {
+		time int64
+		err  error
+	}{
+		{epochInterval + blockInterval, nil},
+		{epochInterval + 100*blockInterval, nil},
+		{epochInterval + blockInterval - 1, ErrInvalidTimestamp},
+		{epochInterval, ErrInvalidTimestamp},
+		{epochInterval - 100*blockInterval, ErrInvalidTimestamp},
+	} {
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(2),
+			Time:       big.NewInt(test.time),
+			Difficulty: big.NewInt(1),
+			UncleHash:  uncleHash,
+			Extra:      make([]byte, extraVanity+extraSeal),
+		}
+		assert.Equal(t, test.err, engine.verifyHeader(chain, header, nil, uint64(blockInterval)), "time %d", test.time)
+	}
+}
+
+func TestVerifyHeaderSlotTime(t *testing.T) {
+	genesis := newGenesisHeader(0)
+	for _, test := range []struct {
+		interval, offset, parent, time int64
+		err                            error
+	}{
+		// one second slots: any later second is a later slot
+		{1, 0, 1000, 1001, nil},
+		{1, 0, 1000, 1000, ErrInvalidTimestamp},
+		{1, 0, 1000, 999, ErrInvalidTimestamp},
+		// a parent late in its slot doesn't push back the next slot
+		{10, 0, 1003, 1010, nil},
+		{10, 0, 1003, 1009, ErrInvalidTimestamp},
+		{10, 0, 1009, 1010, nil},
+		// valid epoch offsets are multiples of the interval and keep the slots
+		{10, 20, 1005, 1010, nil},
+		{10, 20, 1005, 1009, ErrInvalidTimestamp},
+		{10, 20, 1009, 1010, nil},
+		{3, 6, 1001, 1002, nil},
+		{3, 6, 1002, 1004, ErrInvalidTimestamp},
+	} {
+		parent := &types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), Time: big.NewInt(test.parent)}
+		chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis, parent}}
+		engine := New(&params.DposConfig{EpochOffset: uint64(test.offset)}, ethdb.NewMemDatabase())
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(2),
+			Time:       big.NewInt(test.time),
+			Difficulty: big.NewInt(1),
+			UncleHash:  uncleHash,
+			Extra:      make([]byte, extraVanity+extraSeal),
+		}
+		err := engine.verifyHeader(chain, header, nil, uint64(test.interval))
+		assert.Equal(t, test.err, err, "interval %d, offset %d, parent %d, time %d", test.interval, test.offset, test.parent, test.time)
+	}
+}
+
+func TestVerifyHeaderGasLimit(t *testing.T) {
+	genesis := newGenesisHeader(0)
+	parent := &types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), Time: big.NewInt(epochInterval), GasLimit: 1024000}
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis, parent}}
+	newHeader := func(gasLimit uint64) *types.Header {
+		return &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(2),
+			Time:       big.NewInt(epochInterval + blockInterval),
+			Difficulty: big.NewInt(1),
+			UncleHash:  uncleHash,
+			Extra:      make([]byte, extraVanity+extraSeal),
+			GasLimit:   gasLimit,
+		}
+	}
+
+	// any change is accepted by default
+	engine := New(nil, ethdb.NewMemDatabase())
+	assert.Nil(t, engine.verifyHeader(chain, newHeader(2*parent.GasLimit), nil, uint64(blockInterval)))
+
+	engine = New(&params.DposConfig{GasLimitBoundDivisor: 1024}, ethdb.NewMemDatabase())
+	for _, test := range []struct {
+		gasLimit uint64
+		err      error
+	}{
+		{parent.GasLimit, nil},
+		{parent.GasLimit + 999, nil},
+		{parent.GasLimit - 999, nil},
+		{parent.GasLimit + 1000, ErrInvalidGasLimit},
+		{parent.GasLimit - 1000, ErrInvalidGasLimit},
+		{2 * parent.GasLimit, ErrInvalidGasLimit},
+	} {
+		assert.Equal(t, test.err, engine.verifyHeader(chain, newHeader(test.gasLimit), nil, uint64(blockInterval)), "gas limit %d", test.gasLimit)
+	}
+
+	// limits may not drop below the minimum even within the bound
+	parent.GasLimit = params.MinGasLimit
+	chain.headers[1] = parent
+	engine = New(&params.DposConfig{GasLimitBoundDivisor: 1}, ethdb.NewMemDatabase())
+	assert.Nil(t, engine.verifyHeader(chain, newHeader(params.MinGasLimit+1), nil, uint64(blockInterval)))
+	assert.Equal(t, ErrInvalidGasLimit, engine.verifyHeader(chain, newHeader(params.MinGasLimit-1), nil, uint64(blockInterval)))
+}
+
+func TestCheckValidatorPastGenesis(t *testing.T) {
+	validators := []common.Address{
+		common.StringToAddress("addr0"),
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+	}
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators(validators))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	// the chain has been idle for days since genesis
+	genesis := newGenesisHeader(0)
+	genesis.DposContext = proto
+	start := 5*epochInterval + 7*blockInterval
+
+	mint := func(config *params.DposConfig, from, to int64) map[int64][]common.Address {
+		minted := make(map[int64][]common.Address)
+		for _, validator := range validators {
+			engine := New(config, db)
+			engine.Authorize(validator, nil)
+			for now := from; now < to; now++ {
+				if engine.CheckValidator(types.NewBlockWithHeader(genesis), now, uint64(blockInterval)) == nil {
+					minted[now] = append(minted[now], validator)
+				}
+			}
+		}
+		return minted
+	}
+	// only the validator of each slot mints, once and at its start
+	minted := mint(nil, start, start+3*blockInterval)
+	assert.Len(t, minted, 3)
+	for slot := start; slot < start+3*blockInterval; slot += blockInterval {
+		expected, err := slotValidator(nil, validators, slot, uint64(blockInterval))
+		assert.Nil(t, err)
+		assert.Equal(t, []common.Address{expected}, minted[slot])
+	}
+
+	// nothing is minted before the activation time
+	config := &params.DposConfig{ActivationTime: uint64(start + blockInterval)}
+	minted = mint(config, start, start+3*blockInterval)
+	assert.Len(t, minted, 2)
+	assert.Empty(t, minted[start])
+	engine := New(config, db)
+	engine.Authorize(validators[0], nil)
+	assert.Equal(t, ErrNotActivated, engine.CheckValidator(types.NewBlockWithHeader(genesis), start, uint64(blockInterval)))
+}
+
+func TestPauseProduction(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators([]common.Address{signer}))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	genesis := newGenesisHeader(0)
+	genesis.BlockInterval = 1
+	genesis.DposContext = proto
+	chain := &testChainReader{config: params.DposChainConfig, headers: []*types.Header{genesis}}
+	header := &types.Header{
+		ParentHash:  genesis.Hash(),
+		Number:      big.NewInt(1),
+		Time:        big.NewInt(time.Now().Unix()),
+		Validator:   signer,
+		Extra:       make([]byte, extraVanity+extraSeal),
+		DposContext: proto,
+	}
+	engine := New(nil, db)
+	engine.Authorize(signer, func(account accounts.Account, hash []byte) ([]byte, error) {
+		return crypto.Sign(hash, key)
+	})
+	admin := &AdminAPI{dpos: engine}
+
+	// nothing is minted while paused
+	assert.True(t, admin.PauseProduction())
+	assert.True(t, admin.ProductionPaused())
+	_, err = engine.Seal(chain, types.NewBlockWithHeader(header), nil)
+	assert.Equal(t, ErrProductionPaused, err)
+	now := time.Now().Unix()
+	assert.Equal(t, ErrProductionPaused, engine.CheckValidator(types.NewBlockWithHeader(genesis), now, 1))
+
+	// production resumes with the signer authorized before
+	assert.True(t, admin.ResumeProduction())
+	assert.False(t, admin.ProductionPaused())
+	assert.Nil(t, engine.CheckValidator(types.NewBlockWithHeader(genesis), now, 1))
+	block, err := engine.Seal(chain, types.NewBlockWithHeader(header), nil)
+	assert.Nil(t, err)
+	sealer, err := ecrecover(block.Header(), engine.signatures)
+	assert.Nil(t, err)
+	assert.Equal(t, signer, sealer)
+}
@@ -1,6 +1,7 @@
 package dpos
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -11,13 +12,20 @@ import (
 	"github.com/happytoken/go-ethereum/core/state"
 	"github.com/happytoken/go-ethereum/core/types"
 	"github.com/happytoken/go-ethereum/log"
+	"github.com/happytoken/go-ethereum/params"
 	"github.com/happytoken/go-ethereum/trie"
 )
 
+// errNoCandidates is returned when votes are counted without any candidate.
+var errNoCandidates = errors.New("no candidates")
+
 type EpochContext struct {
 	TimeStamp   int64
+	number      int64 // Number of the block, counts the epochs if they're block based
 	DposContext *types.DposContext
 	statedb     *state.StateDB
+	provider    ValidatorProvider
+	config      *params.DposConfig
 }
 
 /*投票算法
@@ -36,12 +44,14 @@ func (ec *EpochContext) countVotes() (votes map[common.Address]*big.Int, err err
 	iterCandidate := trie.NewIterator(candidateTrie.NodeIterator(nil))
 	existCandidate := iterCandidate.Next()
 	if !existCandidate {
-		return votes, errors.New("no candidates")
+		return votes, errNoCandidates
 	}
 	// 遍历候选人列表
 	for existCandidate {
-		candidate := iterCandidate.Value   //获取每个候选人--bytes
-		candidateAddr := common.BytesToAddress(candidate) // 将bytes转化为地址
+		candidateAddr := common.BytesToAddress(iterCandidate.Value) // 将bytes转化为地址
+		candidate := candidateAddr.Bytes()   //获取每个候选人--bytes
+		// Delegators come in ascending address order. The weights are only
+		// summed, so the tally wouldn't depend on the order regardless.
 		delegateIterator := trie.NewIterator(delegateTrie.PrefixIterator(candidate))   //通过候选人找到每一个候选人对应投票信息列表
 		existDelegator := delegateIterator.Next()                                     //调用迭代器Next()判断迭代器
 		if !existDelegator {                                                          //如果在候选人列表中为空
@@ -58,6 +68,13 @@ func (ec *EpochContext) countVotes() (votes map[common.Address]*big.Int, err err
 			delegatorAddr := common.BytesToAddress(delegator)                        //将投票人bytes类型转换为address
 			// 获取投票人的余额作为票数累积到候选人的票数中
 			weight := statedb.GetBalance(delegatorAddr)
+			if ec.config != nil && ec.config.VoteDecayHalfLife > 0 {
+				voted, err := ec.DposContext.GetVoteTime(delegatorAddr)
+				if err != nil {
+					return nil, err
+				}
+				weight = decayedWeight(weight, voted, ec.TimeStamp, int64(ec.config.VoteDecayHalfLife))
+			}
 			score.Add(score, weight)
 			votes[candidateAddr] = score
 			existDelegator = delegateIterator.Next()
@@ -67,6 +84,92 @@ func (ec *EpochContext) countVotes() (votes map[common.Address]*big.Int, err err
 	return votes, nil
 }
 
+// decayedWeight returns the weight at now of a vote cast at voted, halved for
+// every halfLife that went by and interpolated linearly in between. Votes
+// recorded without a time keep their full weight.
+func decayedWeight(weight *big.Int, voted, now, halfLife int64) *big.Int {
+	age := now - voted
+	if voted == 0 || age <= 0 {
+		return weight
+	}
+	halvings := age / halfLife
+	if halvings >= int64(weight.BitLen()) {
+		return new(big.Int)
+	}
+	decayed := new(big.Int).Rsh(weight, uint(halvings))
+	rest := new(big.Int).Mul(decayed, big.NewInt(age%halfLife))
+	return decayed.Sub(decayed, rest.Div(rest, big.NewInt(2*halfLife)))
+}
+
+// votedCandidates tallies the votes of all candidates eligible for the election
+// of the given epoch and returns them ordered by vote weight, highest first.
+func (ec *EpochContext) votedCandidates(epoch int64) (sortableAddresses, error) {
+	// 对候选人进行计票后按照票数由高到低来排序, 选出前 N 个
+	// 这里需要注意的是当前对于成为候选人没有门槛限制很容易被恶意攻击
+	votes, err := ec.countVotes()
+	if err == errNoCandidates {
+		return sortableAddresses{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	candidates := sortableAddresses{}
+	for candidate, cnt := range votes {
+		registered, err := ec.DposContext.CandidateEpoch(candidate)
+		if err != nil {
+			return nil, err
+		}
+		if !ec.isWarmedUp(registered, epoch) {
+			log.Debug("Skip candidate in warmup", "candidate", candidate, "epoch", epoch)
+			continue
+		}
+		if !ec.hasElectableWeight(cnt) {
+			log.Debug("Skip candidate below the minimum weight", "candidate", candidate, "epoch", epoch, "weight", cnt)
+			continue
+		}
+		candidates = append(candidates, &sortableAddress{address: candidate, weight: cnt, registered: registered})
+	}
+	sort.Sort(candidates)
+	return candidates, nil
+}
+
+// isWarmedUp reports whether a candidate registered in the given epoch has sat
+// out enough elections to be eligible for the election of epoch.
+func (ec *EpochContext) isWarmedUp(registered, epoch int64) bool {
+	if ec.config == nil || ec.config.CandidateWarmupEpochs == 0 {
+		return true
+	}
+	return epoch-registered > int64(ec.config.CandidateWarmupEpochs)
+}
+
+// hasElectableWeight reports whether a candidate with the given vote weight
+// reaches the minimum weight to be eligible for election.
+func (ec *EpochContext) hasElectableWeight(weight *big.Int) bool {
+	if ec.config == nil || ec.config.MinElectableWeight == nil {
+		return true
+	}
+	return weight.Cmp(ec.config.MinElectableWeight) >= 0
+}
+
+// providedCandidates returns the validator set of the given epoch as reported by
+// the configured validator provider, keeping the provider's order.
+func (ec *EpochContext) providedCandidates(epoch int64) (sortableAddresses, error) {
+	validators, err := ec.provider.Validators(ec.statedb, epoch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get validators from provider: %s", err)
+	}
+	candidates := sortableAddresses{}
+	for _, validator := range validators {
+		candidates = append(candidates, &sortableAddress{address: validator, weight: new(big.Int)})
+	}
+	return candidates, nil
+}
+
+// epoch returns the number of the epoch of the block the context belongs to.
+func (ec *EpochContext) epoch() int64 {
+	return blockEpochID(ec.config, ec.number, ec.TimeStamp)
+}
+
 //剔除验证人算法
 func (ec *EpochContext) kickoutValidator(epoch int64,genesis *types.Header) error {
 	validators, err := ec.DposContext.GetValidators()
@@ -97,6 +200,17 @@ func (ec *EpochContext) kickoutValidator(epoch int64,genesis *types.Header) erro
 		epochDuration = ec.TimeStamp - timeOfFirstBlock
 	}
 
+	// Each validator is expected to mint once per round of slots, missed slots
+	// within the downtime allowance don't count against it.
+	expected := epochDuration/int64(blockInterval)/ int64(maxValidatorSize)
+	if blocksPerEpoch := epochBlocks(ec.config); blocksPerEpoch > 0 {
+		// block based epochs hold the same number of blocks no matter how long they take
+		expected = blocksPerEpoch / int64(maxValidatorSize)
+	}
+	allowance := int64(0)
+	if ec.config != nil {
+		allowance = int64(ec.config.DowntimeAllowance)
+	}
 	needKickoutValidators := sortableAddresses{}
 	for _, validator := range validators {
 		key := make([]byte, 8)
@@ -106,10 +220,16 @@ func (ec *EpochContext) kickoutValidator(epoch int64,genesis *types.Header) erro
 		if cntBytes := ec.DposContext.MintCntTrie().Get(key); cntBytes != nil {
 			cnt = int64(binary.BigEndian.Uint64(cntBytes))
 		}
-
-		if cnt < epochDuration/int64(blockInterval)/ int64(maxValidatorSize) /2 {
+		missed := expected - cnt
+		if missed < 0 {
+			missed = 0
+		}
+		if missed -= allowance; missed < 0 {
+			missed = 0
+		}
+		if expected-missed < expected/2 {
 			// not active validators need kickout
-			needKickoutValidators = append(needKickoutValidators, &sortableAddress{validator, big.NewInt(cnt)})
+			needKickoutValidators = append(needKickoutValidators, &sortableAddress{address: validator, weight: big.NewInt(cnt)})
 		}
 	}
 	// no validators need kickout
@@ -119,13 +239,13 @@ func (ec *EpochContext) kickoutValidator(epoch int64,genesis *types.Header) erro
 	}
 	sort.Sort(sort.Reverse(needKickoutValidators))
 
-	candidateCount := 0
-	iter := trie.NewIterator(ec.DposContext.CandidateTrie().NodeIterator(nil))
-	for iter.Next() {
-		candidateCount++
-		if candidateCount >= needKickoutValidatorCnt+int(safeSize) {
-			break
-		}
+	candidateCount, err := ec.DposContext.CountCandidates()
+	if err != nil {
+		return err
+	}
+	var cooldown int64
+	if ec.config != nil {
+		cooldown = int64(ec.config.ReRegisterCooldown)
 	}
 
 	for i, validator := range needKickoutValidators {
@@ -135,7 +255,7 @@ func (ec *EpochContext) kickoutValidator(epoch int64,genesis *types.Header) erro
 			return nil
 		}
 
-		if err := ec.DposContext.KickoutCandidate(validator.address); err != nil {
+		if err := ec.DposContext.KickoutCandidateAt(validator.address, ec.epoch(), cooldown); err != nil {
 			return err
 		}
 		// if kickout success, candidateCount minus 1
@@ -147,17 +267,25 @@ func (ec *EpochContext) kickoutValidator(epoch int64,genesis *types.Header) erro
 
 //实时检查出块者是否是本节点
 func (ec *EpochContext) lookupValidator(now int64, blockInterval uint64) (validator common.Address, err error) {
-	validator = common.Address{}
-	offset := now % epochInterval
+	validators, err := ec.DposContext.GetValidators()
+	if err != nil {
+		return common.Address{}, err
+	}
+	return slotValidator(ec.config, validators, now, blockInterval)
+}
+
+// slotValidator returns the validator of the slot starting at now, validators
+// take turns in the order they were elected in.
+func slotValidator(config *params.DposConfig, validators []common.Address, now int64, blockInterval uint64) (common.Address, error) {
+	offset := (now - epochOffset(config)) % epochInterval
+	if offset < 0 {
+		offset += epochInterval
+	}
 	if offset%int64(blockInterval) != 0 {    //判断当前时间是否在出块周期内
 		return common.Address{}, ErrInvalidMintBlockTime
 	}
 	offset /= int64(blockInterval)
 
-	validators, err := ec.DposContext.GetValidators()
-	if err != nil {
-		return common.Address{}, err
-	}
 	validatorSize := len(validators)
 	if validatorSize == 0 {
 		return common.Address{}, errors.New("failed to lookup validator")
@@ -167,19 +295,93 @@ func (ec *EpochContext) lookupValidator(now int64, blockInterval uint64) (valida
 }
 
 type sortableAddress struct {
-	address common.Address
-	weight  *big.Int
+	address    common.Address
+	weight     *big.Int
+	registered int64 // Epoch the candidate registered in
 }
+
+// sortableAddresses orders candidates by weight, highest first. Ties are broken
+// by seniority, earlier registered candidates first, and then by the byte order
+// of the addresses, so every node agrees on who makes the cut.
 type sortableAddresses []*sortableAddress
 
 func (p sortableAddresses) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 func (p sortableAddresses) Len() int      { return len(p) }
 func (p sortableAddresses) Less(i, j int) bool {
-	if p[i].weight.Cmp(p[j].weight) < 0 {
-		return false
-	} else if p[i].weight.Cmp(p[j].weight) > 0 {
-		return true
+	if cmp := p[i].weight.Cmp(p[j].weight); cmp != 0 {
+		return cmp > 0
+	}
+	if p[i].registered != p[j].registered {
+		return p[i].registered < p[j].registered
+	}
+	return bytes.Compare(p[i].address[:], p[j].address[:]) < 0
+}
+
+// weights returns the candidates along with their standing in the election.
+func (p sortableAddresses) weights() []types.CandidateWeight {
+	weights := make([]types.CandidateWeight, 0, len(p))
+	for _, candidate := range p {
+		weights = append(weights, types.CandidateWeight{Address: candidate.address, Weight: candidate.weight, Registered: uint64(candidate.registered)})
+	}
+	return weights
+}
+
+// fallbackValidators returns the validator set to retain when an election has
+// no candidates at all: the current validators, or the genesis ones if there
+// are none.
+func (ec *EpochContext) fallbackValidators() ([]common.Address, error) {
+	if validators, err := ec.DposContext.GetValidators(); err == nil && len(validators) > 0 {
+		return validators, nil
+	}
+	if ec.config != nil && len(ec.config.Validators) > 0 {
+		return ec.config.Validators, nil
+	}
+	return nil, errors.New("no validators to fall back to")
+}
+
+// keepsHistory reports whether the block the context belongs to keeps the epoch
+// trie across elections.
+func (ec *EpochContext) keepsHistory() bool {
+	return ec.config.IsEpochHistory(big.NewInt(ec.number))
+}
+
+// recordElection stores the outcome of the election of the given epoch. Before
+// the epoch history block the epoch trie starts afresh, keeping only the per
+// account settings. From then on it is kept, recording the validators and the
+// input of the election, and dropping the records of the epoch that fell out of
+// the history window.
+func (ec *EpochContext) recordElection(epoch int64, input []types.CandidateWeight, validators, ranks []common.Address) error {
+	var cooldown int64
+	if ec.config != nil {
+		cooldown = int64(ec.config.ReRegisterCooldown)
+	}
+	dc := ec.DposContext
+	if !ec.keepsHistory() {
+		if err := dc.RenewEpochTrie(); err != nil {
+			return err
+		}
 	} else {
-		return p[i].address.String() < p[j].address.String()
+		if err := dc.KeepCounts(); err != nil {
+			return err
+		}
+		if err := dc.SetElectionInput(epoch, input); err != nil {
+			return err
+		}
+		if err := dc.SetEpochValidators(epoch, validators); err != nil {
+			return err
+		}
+		if epoch >= epochHistoryWindow {
+			if err := dc.PruneEpochHistory(epoch - epochHistoryWindow); err != nil {
+				return err
+			}
+		}
+	}
+	if err := dc.ExpireDepartures(epoch, cooldown); err != nil {
+		return err
+	}
+	if err := dc.SetValidators(validators); err != nil {
+		return err
 	}
+	// kept epoch tries may still hold the ranks of the previous election
+	return dc.SetValidatorRanks(ranks)
 }
@@ -2,6 +2,7 @@ package dpos
 
 import (
 	"math/big"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -10,6 +11,7 @@ import (
 	"github.com/happytoken/go-ethereum/core/state"
 	"github.com/happytoken/go-ethereum/core/types"
 	"github.com/happytoken/go-ethereum/ethdb"
+	"github.com/happytoken/go-ethereum/params"
 	"github.com/happytoken/go-ethereum/trie"
 
 	"github.com/stretchr/testify/assert"
@@ -76,13 +78,12 @@ func TestLookupValidator(t *testing.T) {
 	}
 	mockEpochContext.DposContext.SetValidators(validators)
 	for i, expected := range validators {
-		got, _ := mockEpochContext.lookupValidator(int64(i) * blockInterval)
+		got, _ := mockEpochContext.lookupValidator(int64(i)*blockInterval, uint64(blockInterval))
 		if got != expected {
 			t.Errorf("Failed to test lookup validator, %s was expected but got %s", expected.Str(), got.Str())
 		}
 	}
-	blockInterval := 10
-	_, err := mockEpochContext.lookupValidator(blockInterval - 1)
+	_, err := mockEpochContext.lookupValidator(blockInterval-1, uint64(blockInterval))
 	if err != ErrInvalidMintBlockTime {
 		t.Errorf("Failed to test lookup validator. err '%v' was expected but got '%v'", ErrInvalidMintBlockTime, err)
 	}
@@ -101,6 +102,7 @@ func TestEpochContextKickoutValidator(t *testing.T) {
 	}
 	atLeastMintCnt := epochInterval / blockInterval / maxValidatorSize / 2
 	testEpoch := int64(1)
+	genesis := mockGenesisHeader(0)
 
 	// no validator can be kickout, because all validators mint enough block at least
 	validators := []common.Address{}
@@ -112,7 +114,7 @@ func TestEpochContextKickoutValidator(t *testing.T) {
 	}
 	assert.Nil(t, dposContext.SetValidators(validators))
 	assert.Nil(t, dposContext.BecomeCandidate(common.StringToAddress("addr")))
-	assert.Nil(t, epochContext.kickoutValidator(testEpoch))
+	assert.Nil(t, epochContext.kickoutValidator(testEpoch, genesis))
 	candidateMap := getCandidates(dposContext.CandidateTrie())
 	assert.Equal(t, maxValidatorSize +1, len(candidateMap))
 
@@ -133,7 +135,7 @@ func TestEpochContextKickoutValidator(t *testing.T) {
 		setTestMintCnt(dposContext, testEpoch, validator, atLeastMintCnt-int64(i)-1)
 	}
 	assert.Nil(t, dposContext.SetValidators(validators))
-	assert.Nil(t, epochContext.kickoutValidator(testEpoch))
+	assert.Nil(t, epochContext.kickoutValidator(testEpoch, genesis))
 	candidateMap = getCandidates(dposContext.CandidateTrie())
 	assert.Equal(t, safeSize, len(candidateMap))
 	for i := maxValidatorSize - 1; i >= safeSize; i-- {
@@ -161,7 +163,7 @@ func TestEpochContextKickoutValidator(t *testing.T) {
 		assert.Nil(t, dposContext.BecomeCandidate(candidate))
 	}
 	assert.Nil(t, dposContext.SetValidators(validators))
-	assert.Nil(t, epochContext.kickoutValidator(testEpoch))
+	assert.Nil(t, epochContext.kickoutValidator(testEpoch, genesis))
 	candidateMap = getCandidates(dposContext.CandidateTrie())
 	assert.Equal(t, maxValidatorSize, len(candidateMap))
 
@@ -187,7 +189,7 @@ func TestEpochContextKickoutValidator(t *testing.T) {
 	}
 	assert.Nil(t, dposContext.BecomeCandidate(common.StringToAddress("addr")))
 	assert.Nil(t, dposContext.SetValidators(validators))
-	assert.Nil(t, epochContext.kickoutValidator(testEpoch))
+	assert.Nil(t, epochContext.kickoutValidator(testEpoch, genesis))
 	candidateMap = getCandidates(dposContext.CandidateTrie())
 	assert.Equal(t, maxValidatorSize, len(candidateMap))
 	assert.False(t, candidateMap[common.StringToAddress("addr"+strconv.Itoa(0))])
@@ -213,7 +215,7 @@ func TestEpochContextKickoutValidator(t *testing.T) {
 		assert.Nil(t, dposContext.BecomeCandidate(candidate))
 	}
 	assert.Nil(t, dposContext.SetValidators(validators))
-	assert.Nil(t, epochContext.kickoutValidator(testEpoch))
+	assert.Nil(t, epochContext.kickoutValidator(testEpoch, genesis))
 	candidateMap = getCandidates(dposContext.CandidateTrie())
 	assert.Equal(t, maxValidatorSize *2, len(candidateMap))
 
@@ -238,7 +240,7 @@ func TestEpochContextKickoutValidator(t *testing.T) {
 		assert.Nil(t, dposContext.BecomeCandidate(candidate))
 	}
 	assert.Nil(t, dposContext.SetValidators(validators))
-	assert.Nil(t, epochContext.kickoutValidator(testEpoch))
+	assert.Nil(t, epochContext.kickoutValidator(testEpoch, genesis))
 	candidateMap = getCandidates(dposContext.CandidateTrie())
 	assert.Equal(t, maxValidatorSize, len(candidateMap))
 
@@ -250,14 +252,14 @@ func TestEpochContextKickoutValidator(t *testing.T) {
 		DposContext: dposContext,
 		statedb:     stateDB,
 	}
-	assert.NotNil(t, epochContext.kickoutValidator(testEpoch))
+	assert.NotNil(t, epochContext.kickoutValidator(testEpoch, genesis))
 	dposContext.SetValidators([]common.Address{})
-	assert.NotNil(t, epochContext.kickoutValidator(testEpoch))
+	assert.NotNil(t, epochContext.kickoutValidator(testEpoch, genesis))
 }
 
 func setTestMintCnt(dposContext *types.DposContext, epoch int64, validator common.Address, count int64) {
 	for i := int64(0); i < count; i++ {
-		updateMintCnt(epoch*epochInterval, epoch*epochInterval+blockInterval, validator, dposContext)
+		updateMintCnt(EpochID(nil, epoch*epochInterval), EpochID(nil, epoch*epochInterval+blockInterval), validator, dposContext)
 	}
 }
 
@@ -280,6 +282,7 @@ func TestEpochContextTryElect(t *testing.T) {
 		TimeStamp:   epochInterval,
 		DposContext: dposContext,
 		statedb:     stateDB,
+		config:      &params.DposConfig{EpochHistoryBlock: big.NewInt(0)},
 	}
 	atLeastMintCnt := epochInterval / blockInterval / maxValidatorSize / 2
 	testEpoch := int64(1)
@@ -296,9 +299,7 @@ func TestEpochContextTryElect(t *testing.T) {
 	assert.Nil(t, dposContext.SetValidators(validators))
 
 	// genesisEpoch == parentEpoch do not kickout
-	genesis := &types.Header{
-		Time: big.NewInt(0),
-	}
+	genesis := mockGenesisHeader(0)
 	parent := &types.Header{
 		Time: big.NewInt(epochInterval - blockInterval),
 	}
@@ -312,10 +313,13 @@ func TestEpochContextTryElect(t *testing.T) {
 	}
 	assert.NotEqual(t, oldHash, dposContext.EpochTrie().Hash())
 
+	// the elected set is recorded for its epoch
+	epochValidators, err := dposContext.GetEpochValidators(1)
+	assert.Nil(t, err)
+	assert.Equal(t, result, epochValidators)
+
 	// genesisEpoch != parentEpoch and have none mintCnt do not kickout
-	genesis = &types.Header{
-		Time: big.NewInt(-epochInterval),
-	}
+	genesis = mockGenesisHeader(-epochInterval)
 	parent = &types.Header{
 		Difficulty: big.NewInt(1),
 		Time:       big.NewInt(epochInterval - blockInterval),
@@ -332,9 +336,7 @@ func TestEpochContextTryElect(t *testing.T) {
 	assert.NotEqual(t, oldHash, dposContext.EpochTrie().Hash())
 
 	// genesisEpoch != parentEpoch kickout
-	genesis = &types.Header{
-		Time: big.NewInt(0),
-	}
+	genesis = mockGenesisHeader(0)
 	parent = &types.Header{
 		Time: big.NewInt(epochInterval*2 - blockInterval),
 	}
@@ -354,9 +356,7 @@ func TestEpochContextTryElect(t *testing.T) {
 	assert.NotEqual(t, oldHash, dposContext.EpochTrie().Hash())
 
 	// parentEpoch == currentEpoch do not elect
-	genesis = &types.Header{
-		Time: big.NewInt(0),
-	}
+	genesis = mockGenesisHeader(0)
 	parent = &types.Header{
 		Time: big.NewInt(epochInterval),
 	}
@@ -368,3 +368,495 @@ func TestEpochContextTryElect(t *testing.T) {
 	assert.Equal(t, safeSize, len(result))
 	assert.Equal(t, oldHash, dposContext.EpochTrie().Hash())
 }
+
+func TestEpochContextEpochs(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	validators := []common.Address{}
+	for i := 0; i < maxValidatorSize; i++ {
+		validator := common.StringToAddress("addr" + strconv.Itoa(i))
+		validators = append(validators, validator)
+		assert.Nil(t, dposContext.BecomeCandidate(validator))
+		assert.Nil(t, dposContext.Delegate(validator, validator))
+		stateDB.SetBalance(validator, big.NewInt(1))
+	}
+	// a state predating the per epoch records only holds the current set
+	assert.Nil(t, dposContext.SetValidators(validators))
+	epochs, err := dposContext.Epochs()
+	assert.Nil(t, err)
+	assert.Empty(t, epochs)
+
+	epochContext := &EpochContext{DposContext: dposContext, statedb: stateDB, config: &params.DposConfig{EpochHistoryBlock: big.NewInt(0)}}
+	genesis := mockGenesisHeader(0)
+	for _, epoch := range []int64{1, 2, 4} {
+		epochContext.TimeStamp = epoch * epochInterval
+		parent := &types.Header{Time: big.NewInt(epoch*epochInterval - blockInterval)}
+		if epoch == 4 {
+			// a chain stalled over an epoch elects the skipped one too
+			parent.Time = big.NewInt(2*epochInterval + blockInterval)
+		}
+		assert.Nil(t, epochContext.tryElect(genesis, parent))
+	}
+	epochs, err = dposContext.Epochs()
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 2, 3, 4}, epochs)
+	for _, epoch := range epochs {
+		_, err := dposContext.GetEpochValidators(epoch)
+		assert.Nil(t, err)
+	}
+}
+
+func TestEpochContextEpochHistoryFork(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	for i := 0; i < maxValidatorSize; i++ {
+		validator := common.StringToAddress("addr" + strconv.Itoa(i))
+		assert.Nil(t, dposContext.BecomeCandidate(validator))
+		assert.Nil(t, dposContext.Delegate(validator, validator))
+		stateDB.SetBalance(validator, big.NewInt(1))
+	}
+	config := &params.DposConfig{EpochHistoryBlock: big.NewInt(10)}
+	genesis := mockGenesisHeader(0)
+	// elect holds the elections from the parent's epoch up to the given one
+	elect := func(number, parentEpoch, epoch int64) {
+		epochContext := &EpochContext{TimeStamp: epoch * epochInterval, number: number, DposContext: dposContext, statedb: stateDB, config: config}
+		parent := &types.Header{Time: big.NewInt(parentEpoch*epochInterval + blockInterval)}
+		assert.Nil(t, epochContext.tryElect(genesis, parent))
+	}
+	// before the fork every election starts a fresh epoch trie
+	elect(1, 0, 2)
+	epochs, err := dposContext.Epochs()
+	assert.Nil(t, err)
+	assert.Empty(t, epochs)
+	count, err := dposContext.EpochTrie().TryGet([]byte("candidate-count"))
+	assert.Nil(t, err)
+	assert.Nil(t, count)
+
+	// from then on the history is kept, within the window
+	elect(10, 2, 3)
+	_, err = dposContext.GetEpochValidators(3)
+	assert.Nil(t, err)
+	count, err = dposContext.EpochTrie().TryGet([]byte("candidate-count"))
+	assert.Nil(t, err)
+	assert.NotNil(t, count)
+
+	elect(11, 3, epochHistoryWindow+3)
+	_, err = dposContext.GetEpochValidators(3)
+	assert.NotNil(t, err)
+	_, err = dposContext.GetEpochValidators(4)
+	assert.Nil(t, err)
+	epochs, err = dposContext.Epochs()
+	assert.Nil(t, err)
+	assert.Equal(t, epochHistoryWindow, len(epochs))
+}
+
+func TestEpochContextCandidateWarmup(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+
+	testEpoch := int64(10)
+	for i := 0; i < maxValidatorSize; i++ {
+		validator := common.StringToAddress("addr" + strconv.Itoa(i))
+		assert.Nil(t, dposContext.RegisterCandidate(validator, 0))
+		assert.Nil(t, dposContext.Delegate(validator, validator))
+		stateDB.SetBalance(validator, big.NewInt(1))
+	}
+	// the fresh candidate has the most votes but just registered
+	fresh := common.StringToAddress("fresh")
+	assert.Nil(t, dposContext.RegisterCandidate(fresh, testEpoch))
+	assert.Nil(t, dposContext.Delegate(fresh, fresh))
+	stateDB.SetBalance(fresh, big.NewInt(100))
+
+	epochContext := &EpochContext{
+		DposContext: dposContext,
+		statedb:     stateDB,
+		config:      &params.DposConfig{CandidateWarmupEpochs: 2},
+	}
+	genesis := mockGenesisHeader(0)
+	elected := func(epoch int64) bool {
+		epochContext.TimeStamp = epoch * epochInterval
+		parent := &types.Header{Time: big.NewInt(epoch*epochInterval - blockInterval)}
+		assert.Nil(t, epochContext.tryElect(genesis, parent))
+		validators, err := dposContext.GetValidators()
+		assert.Nil(t, err)
+		for _, validator := range validators {
+			if validator == fresh {
+				return true
+			}
+		}
+		return false
+	}
+	// the candidate sits out the elections of the two epochs following its registration
+	assert.False(t, elected(testEpoch+1))
+	assert.False(t, elected(testEpoch+2))
+	assert.True(t, elected(testEpoch+3))
+
+	// without a warmup the candidate is eligible right away
+	epochContext.config = &params.DposConfig{}
+	assert.True(t, elected(testEpoch+1))
+}
+
+func TestEpochContextMinElectableWeight(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+
+	for i := 0; i < maxValidatorSize-1; i++ {
+		validator := common.StringToAddress("addr" + strconv.Itoa(i))
+		assert.Nil(t, dposContext.BecomeCandidate(validator))
+		assert.Nil(t, dposContext.Delegate(validator, validator))
+		stateDB.SetBalance(validator, big.NewInt(10))
+	}
+	// the weak candidate ranks within the validator size, but has little support
+	weak := common.StringToAddress("weak")
+	assert.Nil(t, dposContext.BecomeCandidate(weak))
+	assert.Nil(t, dposContext.Delegate(weak, weak))
+	stateDB.SetBalance(weak, big.NewInt(1))
+
+	epochContext := &EpochContext{
+		TimeStamp:   epochInterval,
+		DposContext: dposContext,
+		statedb:     stateDB,
+		config:      &params.DposConfig{MinElectableWeight: big.NewInt(5)},
+	}
+	genesis := mockGenesisHeader(0)
+	parent := &types.Header{Time: big.NewInt(epochInterval - blockInterval)}
+	assert.Nil(t, epochContext.tryElect(genesis, parent))
+	validators, err := dposContext.GetValidators()
+	assert.Nil(t, err)
+	assert.Equal(t, maxValidatorSize-1, len(validators))
+	assert.NotContains(t, validators, weak)
+
+	// without a minimum it's elected
+	epochContext.config = &params.DposConfig{}
+	assert.Nil(t, epochContext.tryElect(genesis, parent))
+	validators, err = dposContext.GetValidators()
+	assert.Nil(t, err)
+	assert.Equal(t, maxValidatorSize, len(validators))
+	assert.Contains(t, validators, weak)
+}
+
+func TestEpochContextKickoutDowntimeAllowance(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	atLeastMintCnt := epochInterval / blockInterval / maxValidatorSize / 2
+	allowance := int64(10)
+	testEpoch := int64(1)
+	genesis := mockGenesisHeader(0)
+
+	within := common.StringToAddress("addr0")
+	beyond := common.StringToAddress("addr1")
+	kickout := func(config *params.DposConfig) map[common.Address]bool {
+		dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+		assert.Nil(t, err)
+		validators := []common.Address{}
+		for i := 0; i < maxValidatorSize; i++ {
+			validator := common.StringToAddress("addr" + strconv.Itoa(i))
+			validators = append(validators, validator)
+			assert.Nil(t, dposContext.BecomeCandidate(validator))
+			switch validator {
+			case within:
+				setTestMintCnt(dposContext, testEpoch, validator, atLeastMintCnt-allowance/2)
+			case beyond:
+				setTestMintCnt(dposContext, testEpoch, validator, atLeastMintCnt-allowance-1)
+			default:
+				setTestMintCnt(dposContext, testEpoch, validator, atLeastMintCnt)
+			}
+		}
+		assert.Nil(t, dposContext.SetValidators(validators))
+		assert.Nil(t, dposContext.BecomeCandidate(common.StringToAddress("more0")))
+		assert.Nil(t, dposContext.BecomeCandidate(common.StringToAddress("more1")))
+
+		epochContext := &EpochContext{
+			TimeStamp:   epochInterval,
+			DposContext: dposContext,
+			statedb:     stateDB,
+			config:      config,
+		}
+		assert.Nil(t, epochContext.kickoutValidator(testEpoch, genesis))
+		return getCandidates(dposContext.CandidateTrie())
+	}
+
+	// only the validator missing more slots than allowed is kicked out
+	candidateMap := kickout(&params.DposConfig{DowntimeAllowance: uint64(allowance)})
+	assert.Equal(t, maxValidatorSize+1, len(candidateMap))
+	assert.True(t, candidateMap[within])
+	assert.False(t, candidateMap[beyond])
+
+	// without an allowance both validators are kicked out
+	candidateMap = kickout(nil)
+	assert.Equal(t, maxValidatorSize, len(candidateMap))
+	assert.False(t, candidateMap[within])
+	assert.False(t, candidateMap[beyond])
+}
+
+func TestEpochContextTryElectRecordsRanks(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	for i := 0; i < maxValidatorSize; i++ {
+		validator := common.StringToAddress("addr" + strconv.Itoa(i))
+		assert.Nil(t, dposContext.BecomeCandidate(validator))
+		assert.Nil(t, dposContext.Delegate(validator, validator))
+		stateDB.SetBalance(validator, big.NewInt(int64(i+1)))
+	}
+	epochContext := &EpochContext{
+		TimeStamp:   epochInterval,
+		DposContext: dposContext,
+		statedb:     stateDB,
+		config:      &params.DposConfig{RankRewardCurve: []uint64{110, 100}},
+	}
+	parent := &types.Header{Time: big.NewInt(epochInterval - blockInterval)}
+	assert.Nil(t, epochContext.tryElect(mockGenesisHeader(0), parent))
+
+	ranks, err := dposContext.GetValidatorRanks()
+	assert.Nil(t, err)
+	assert.Equal(t, maxValidatorSize, len(ranks))
+	for i, validator := range ranks {
+		assert.Equal(t, common.StringToAddress("addr"+strconv.Itoa(maxValidatorSize-1-i)), validator)
+	}
+}
+
+func TestEpochContextTryElectEmptyCandidates(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	validators := []common.Address{
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	assert.Nil(t, dposContext.SetValidators(validators))
+
+	epochContext := &EpochContext{
+		TimeStamp:   epochInterval,
+		DposContext: dposContext,
+		statedb:     stateDB,
+		config:      &params.DposConfig{EpochHistoryBlock: big.NewInt(0)},
+	}
+	genesis := mockGenesisHeader(0)
+	parent := &types.Header{Time: big.NewInt(epochInterval - blockInterval)}
+
+	// without any candidate the previous validators keep minting
+	assert.Nil(t, epochContext.tryElect(genesis, parent))
+	result, err := dposContext.GetValidators()
+	assert.Nil(t, err)
+	assert.Equal(t, validators, result)
+	epochValidators, err := dposContext.GetEpochValidators(1)
+	assert.Nil(t, err)
+	assert.Equal(t, validators, epochValidators)
+	for i := int64(0); i < 3; i++ {
+		validator, err := epochContext.lookupValidator(epochInterval+i*blockInterval, uint64(blockInterval))
+		assert.Nil(t, err)
+		assert.Equal(t, validators[i], validator)
+	}
+
+	// the genesis validators are used once nothing else is left
+	assert.Nil(t, dposContext.SetValidators([]common.Address{}))
+	epochContext.config = &params.DposConfig{Validators: validators[:1]}
+	assert.Nil(t, epochContext.tryElect(genesis, parent))
+	result, err = dposContext.GetValidators()
+	assert.Nil(t, err)
+	assert.Equal(t, validators[:1], result)
+
+	// without any fallback the election fails
+	assert.Nil(t, dposContext.SetValidators([]common.Address{}))
+	epochContext.config = nil
+	assert.NotNil(t, epochContext.tryElect(genesis, parent))
+}
+
+func TestEpochContextTryElectTieBreak(t *testing.T) {
+	// maxValidatorSize-2 leaders plus four candidates tying for the last two seats,
+	// two of them registered an epoch earlier than the others
+	type testCandidate struct {
+		address    common.Address
+		weight     int64
+		registered int64
+	}
+	var candidates []testCandidate
+	for i := 0; i < maxValidatorSize-2; i++ {
+		candidates = append(candidates, testCandidate{common.StringToAddress("leader" + strconv.Itoa(i)), 100, 0})
+	}
+	tied := []testCandidate{
+		{common.HexToAddress("0x0000000000000000000000000000000000000004"), 10, 1},
+		{common.HexToAddress("0x0000000000000000000000000000000000000003"), 10, 0},
+		{common.HexToAddress("0x0000000000000000000000000000000000000002"), 10, 1},
+		{common.HexToAddress("0x0000000000000000000000000000000000000001"), 10, 1},
+	}
+	candidates = append(candidates, tied...)
+
+	elect := func(order []int) []common.Address {
+		db := ethdb.NewMemDatabase()
+		stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+		dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+		assert.Nil(t, err)
+		for _, i := range order {
+			candidate := candidates[i]
+			assert.Nil(t, dposContext.RegisterCandidate(candidate.address, candidate.registered))
+			assert.Nil(t, dposContext.Delegate(candidate.address, candidate.address))
+			stateDB.SetBalance(candidate.address, big.NewInt(candidate.weight))
+		}
+		epochContext := &EpochContext{TimeStamp: epochInterval, DposContext: dposContext, statedb: stateDB}
+		parent := &types.Header{Time: big.NewInt(epochInterval - blockInterval)}
+		assert.Nil(t, epochContext.tryElect(mockGenesisHeader(0), parent))
+		validators, err := dposContext.GetValidators()
+		assert.Nil(t, err)
+		return validators
+	}
+	order := make([]int, len(candidates))
+	reversed := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+		reversed[len(candidates)-1-i] = i
+	}
+	validators := elect(order)
+	assert.Equal(t, validators, elect(reversed))
+
+	// the senior candidate takes the first tied seat, the lowest address the second
+	elected := map[common.Address]bool{}
+	for _, validator := range validators {
+		elected[validator] = true
+	}
+	assert.Equal(t, maxValidatorSize, len(validators))
+	assert.True(t, elected[tied[1].address])
+	assert.True(t, elected[tied[3].address])
+	assert.False(t, elected[tied[0].address])
+	assert.False(t, elected[tied[2].address])
+}
+
+func TestSortableAddressesTieBreak(t *testing.T) {
+	addr1 := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	addr2 := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	candidates := sortableAddresses{
+		{address: addr2, weight: big.NewInt(1), registered: 1},
+		{address: addr1, weight: big.NewInt(1), registered: 1},
+		{address: addr2, weight: big.NewInt(1), registered: 0},
+		{address: addr1, weight: big.NewInt(2), registered: 5},
+	}
+	sort.Sort(candidates)
+	assert.Equal(t, big.NewInt(2), candidates[0].weight)
+	assert.Equal(t, int64(0), candidates[1].registered)
+	assert.Equal(t, addr1, candidates[2].address)
+	assert.Equal(t, addr2, candidates[3].address)
+}
+
+func benchmarkLookupValidator(b *testing.B, open func(*trie.Database, *types.DposContextProto) (*types.DposContext, error)) {
+	db := ethdb.NewMemDatabase()
+	dposContext, _ := types.NewDposContext(trie.NewDatabase(db))
+	validators := []common.Address{}
+	for i := 0; i < maxValidatorSize; i++ {
+		validator := common.StringToAddress("addr" + strconv.Itoa(i))
+		validators = append(validators, validator)
+		dposContext.BecomeCandidate(validator)
+		dposContext.Delegate(validator, validator)
+	}
+	dposContext.SetValidators(validators)
+	proto, _ := dposContext.Commit()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dposContext, err := open(trie.NewDatabase(db), proto)
+		if err != nil {
+			b.Fatal(err)
+		}
+		epochContext := &EpochContext{DposContext: dposContext}
+		if _, err := epochContext.lookupValidator(int64(i)*blockInterval, uint64(blockInterval)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLookupValidatorAllTries(b *testing.B) {
+	benchmarkLookupValidator(b, types.NewDposContextFromProto)
+}
+
+func BenchmarkLookupValidatorEpochTrieOnly(b *testing.B) {
+	benchmarkLookupValidator(b, func(db *trie.Database, proto *types.DposContextProto) (*types.DposContext, error) {
+		return types.OpenEpochTrieOnly(proto.EpochHash, db)
+	})
+}
+
+func TestEpochContextElectionInput(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+
+	// more candidates than seats, some of them tied
+	for i := 0; i < maxValidatorSize+5; i++ {
+		candidate := common.StringToAddress("addr" + strconv.Itoa(i))
+		assert.Nil(t, dposContext.BecomeCandidate(candidate))
+		assert.Nil(t, dposContext.Delegate(candidate, candidate))
+		stateDB.SetBalance(candidate, big.NewInt(int64(i%7)))
+	}
+	genesis := mockGenesisHeader(0)
+	parent := &types.Header{Number: big.NewInt(1), Time: big.NewInt(epochInterval - blockInterval)}
+	config := &params.DposConfig{EpochHistoryBlock: big.NewInt(0)}
+	epochContext := &EpochContext{TimeStamp: epochInterval, DposContext: dposContext, statedb: stateDB, config: config}
+	assert.Nil(t, epochContext.tryElect(genesis, parent))
+
+	input, err := dposContext.GetElectionInput(1)
+	assert.Nil(t, err)
+	assert.Equal(t, maxValidatorSize+5, len(input))
+
+	// re-running the election on the recorded input yields the elected set
+	candidates := sortableAddresses{}
+	for _, candidate := range input {
+		candidates = append(candidates, &sortableAddress{address: candidate.Address, weight: candidate.Weight, registered: int64(candidate.Registered)})
+	}
+	assert.True(t, sort.IsSorted(candidates))
+	elected, err := dposContext.GetEpochValidators(1)
+	assert.Nil(t, err)
+	assert.Equal(t, elected, shuffleValidators(candidates[:maxValidatorSize], parent.Hash(), 0))
+
+	// epochs without an election have no input
+	_, err = dposContext.GetElectionInput(2)
+	assert.NotNil(t, err)
+}
+
+func TestEpochContextVoteDecay(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	config := &params.DposConfig{VoteDecayHalfLife: uint64(epochInterval)}
+
+	// equal stakes, one cast at genesis and one an epoch later
+	candidate := common.StringToAddress("candidate")
+	old, recent := common.StringToAddress("old"), common.StringToAddress("recent")
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	stateDB.SetBalance(old, big.NewInt(1000))
+	stateDB.SetBalance(recent, big.NewInt(1000))
+	assert.Nil(t, dposContext.DelegateAt(old, candidate, 1, 0))
+	assert.Nil(t, dposContext.DelegateAt(recent, candidate, epochInterval+1, 0))
+
+	tally := func(now int64, config *params.DposConfig) int64 {
+		epochContext := &EpochContext{TimeStamp: now, DposContext: dposContext, statedb: stateDB, config: config}
+		votes, err := epochContext.countVotes()
+		assert.Nil(t, err)
+		return votes[candidate].Int64()
+	}
+	assert.Equal(t, int64(2000), tally(3*epochInterval+1, nil))
+	assert.Equal(t, int64(1000+500), tally(epochInterval+1, config))
+	assert.Equal(t, int64(500+250), tally(2*epochInterval+1, config))
+	assert.Equal(t, int64(250+125), tally(3*epochInterval+1, config))
+	// in between half-lives the weight decays gradually
+	assert.Equal(t, int64(375+750), tally(3*epochInterval/2+1, config))
+
+	// voting again for the same candidate keeps the time of the vote
+	assert.Nil(t, dposContext.DelegateAt(old, candidate, 3*epochInterval+1, 0))
+	assert.Equal(t, int64(250+125), tally(3*epochInterval+1, config))
+	// only a fresh vote restores the full weight
+	assert.Nil(t, dposContext.UnDelegateAt(old, candidate, 3*epochInterval+1, 0))
+	assert.Nil(t, dposContext.DelegateAt(old, candidate, 3*epochInterval+1, 0))
+	assert.Equal(t, int64(1000+250), tally(3*epochInterval+1, config))
+}
@@ -0,0 +1,41 @@
+package dpos
+
+import (
+	"math/big"
+
+	"github.com/happytoken/go-ethereum/core/types"
+	"github.com/happytoken/go-ethereum/params"
+)
+
+// systemTrieWrites is the number of dpos trie entries each system transaction
+// writes or deletes. Unregistering only pays for the candidate entry, the votes
+// it drops are freed storage.
+var systemTrieWrites = map[types.TxType]uint64{
+	types.RegCandidate:      1, // candidate entry
+	types.UnregCandidate:    1, // candidate entry
+	types.Delegate:          3, // previous delegate entry, new delegate entry, vote
+	types.UnDelegate:        2, // delegate entry, vote
+	types.ValidatorOverride: 2, // current and per epoch validator lists
+	types.SetPayout:         1, // payout entry
+}
+
+// SystemGas returns the gas a dpos system transaction of the given type pays on
+// top of its intrinsic gas in the block with the given number, proportional to
+// the trie writes it performs. It is zero before the SystemGasBlock.
+func SystemGas(config *params.DposConfig, num *big.Int, txType types.TxType) uint64 {
+	if !config.IsSystemGas(num) {
+		return 0
+	}
+	writeGas := params.DposTrieWriteGas
+	if config != nil && config.TrieWriteGas != 0 {
+		writeGas = config.TrieWriteGas
+	}
+	writes := systemTrieWrites[txType]
+	if txType == types.UnregCandidate && config != nil && config.ReRegisterCooldown > 0 {
+		writes++ // epoch the candidate left in
+	}
+	if (txType == types.Delegate || txType == types.UnDelegate) && config != nil && config.VoteHistoryLength > 0 {
+		writes++ // vote history
+	}
+	return writes * writeGas
+}
@@ -0,0 +1,133 @@
+package dpos_test
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/consensus/dpos"
+	"github.com/happytoken/go-ethereum/core"
+	"github.com/happytoken/go-ethereum/core/state"
+	"github.com/happytoken/go-ethereum/core/types"
+	"github.com/happytoken/go-ethereum/core/vm"
+	"github.com/happytoken/go-ethereum/crypto"
+	"github.com/happytoken/go-ethereum/ethdb"
+	"github.com/happytoken/go-ethereum/params"
+	"github.com/happytoken/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemGas(t *testing.T) {
+	forked := &params.DposConfig{SystemGasBlock: big.NewInt(10)}
+	num := big.NewInt(10)
+	assert.Equal(t, uint64(0), dpos.SystemGas(forked, num, types.Binary))
+	assert.Equal(t, params.DposTrieWriteGas, dpos.SystemGas(forked, num, types.RegCandidate))
+	assert.Equal(t, params.DposTrieWriteGas, dpos.SystemGas(forked, num, types.UnregCandidate))
+	assert.Equal(t, 3*params.DposTrieWriteGas, dpos.SystemGas(forked, num, types.Delegate))
+	assert.Equal(t, 2*params.DposTrieWriteGas, dpos.SystemGas(forked, num, types.UnDelegate))
+	assert.Equal(t, params.DposTrieWriteGas, dpos.SystemGas(forked, num, types.SetPayout))
+	// unregistering records the epoch the candidate left in with a re-registration cooldown
+	config := &params.DposConfig{SystemGasBlock: big.NewInt(0), ReRegisterCooldown: 1}
+	assert.Equal(t, 2*params.DposTrieWriteGas, dpos.SystemGas(config, num, types.UnregCandidate))
+	// voting appends to the vote history if one is kept
+	config = &params.DposConfig{SystemGasBlock: big.NewInt(0), VoteHistoryLength: 1}
+	assert.Equal(t, 4*params.DposTrieWriteGas, dpos.SystemGas(config, num, types.Delegate))
+	assert.Equal(t, 3*params.DposTrieWriteGas, dpos.SystemGas(config, num, types.UnDelegate))
+
+	config = &params.DposConfig{SystemGasBlock: big.NewInt(0), TrieWriteGas: 100}
+	assert.Equal(t, uint64(300), dpos.SystemGas(config, num, types.Delegate))
+
+	// nothing is charged before the fork, or without one
+	assert.Equal(t, uint64(0), dpos.SystemGas(forked, big.NewInt(9), types.Delegate))
+	assert.Equal(t, uint64(0), dpos.SystemGas(&params.DposConfig{TrieWriteGas: 100}, num, types.Delegate))
+	assert.Equal(t, uint64(0), dpos.SystemGas(nil, num, types.Delegate))
+}
+
+func TestSystemGasCharged(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	candidate := common.StringToAddress("candidate")
+	config := &params.ChainConfig{ChainID: big.NewInt(1), Dpos: &params.DposConfig{TrieWriteGas: 1000, SystemGasBlock: big.NewInt(0)}}
+	signer := types.NewEIP155Signer(config.ChainID)
+	header := &types.Header{Number: big.NewInt(1), Time: big.NewInt(0), Difficulty: big.NewInt(1), GasLimit: 10000000}
+
+	for nonce, txType := range []types.TxType{types.RegCandidate, types.Delegate, types.UnDelegate, types.UnregCandidate} {
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+		statedb.SetBalance(sender, big.NewInt(1e18))
+		statedb.SetNonce(sender, uint64(nonce))
+
+		tx, err := types.SignTx(types.NewTransaction(txType, uint64(nonce), candidate, new(big.Int), 100000, big.NewInt(1), nil), signer, key)
+		assert.Nil(t, err)
+		msg, err := tx.AsMessage(signer)
+		assert.Nil(t, err)
+
+		context := core.NewEVMContext(msg, header, nil, &common.Address{})
+		evm := vm.NewEVM(context, statedb, config, vm.Config{})
+		_, gas, failed, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(header.GasLimit))
+		assert.Nil(t, err)
+		assert.False(t, failed)
+		assert.Equal(t, params.TxGas+dpos.SystemGas(config.Dpos, header.Number, txType), gas)
+	}
+
+	// too little gas for the trie writes fails the transaction
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+	statedb.SetBalance(sender, big.NewInt(1e18))
+	tx, _ := types.SignTx(types.NewTransaction(types.Delegate, 0, candidate, new(big.Int), params.TxGas+1000, big.NewInt(1), nil), signer, key)
+	msg, _ := tx.AsMessage(signer)
+	evm := vm.NewEVM(core.NewEVMContext(msg, header, nil, &common.Address{}), statedb, config, vm.Config{})
+	_, _, _, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(header.GasLimit))
+	assert.Equal(t, vm.ErrOutOfGas, err)
+
+	// before the fork the intrinsic gas suffices
+	config.Dpos.SystemGasBlock = big.NewInt(2)
+	statedb, _ = state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+	statedb.SetBalance(sender, big.NewInt(1e18))
+	tx, _ = types.SignTx(types.NewTransaction(types.Delegate, 0, candidate, new(big.Int), params.TxGas, big.NewInt(1), nil), signer, key)
+	msg, _ = tx.AsMessage(signer)
+	evm = vm.NewEVM(core.NewEVMContext(msg, header, nil, &common.Address{}), statedb, config, vm.Config{})
+	_, gas, failed, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(header.GasLimit))
+	assert.Nil(t, err)
+	assert.False(t, failed)
+	assert.Equal(t, params.TxGas, gas)
+}
+
+func TestVoteHistoryRecorded(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	first, second := common.StringToAddress("first"), common.StringToAddress("second")
+	config := &params.ChainConfig{ChainID: big.NewInt(1), EIP155Block: big.NewInt(0), Dpos: &params.DposConfig{VoteHistoryLength: 2}}
+	signer := types.NewEIP155Signer(config.ChainID)
+
+	db := ethdb.NewMemDatabase()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.BecomeCandidate(first))
+	assert.Nil(t, dposContext.BecomeCandidate(second))
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	statedb.SetBalance(sender, big.NewInt(1e18))
+
+	votes := []struct {
+		txType    types.TxType
+		candidate common.Address
+	}{
+		{types.Delegate, first},
+		{types.Delegate, second},
+		{types.UnDelegate, first}, // not the current vote, rejected and not recorded
+		{types.UnDelegate, second},
+	}
+	for nonce, vote := range votes {
+		header := &types.Header{Number: big.NewInt(1), Time: big.NewInt(int64(nonce + 1)), Difficulty: big.NewInt(1), GasLimit: 10000000}
+		tx, err := types.SignTx(types.NewTransaction(vote.txType, uint64(nonce), vote.candidate, new(big.Int), 1000000, big.NewInt(1), nil), signer, key)
+		assert.Nil(t, err)
+		gasUsed := uint64(0)
+		_, _, err = core.ApplyTransaction(config, dposContext, nil, &common.Address{}, new(core.GasPool).AddGas(header.GasLimit), statedb, header, tx, &gasUsed, vm.Config{})
+		assert.Nil(t, err)
+	}
+	// only the two most recent changes are kept
+	history, err := dposContext.GetVoteHistory(sender)
+	assert.Nil(t, err)
+	assert.Equal(t, []types.VoteChange{
+		{Time: 2, From: first, To: second},
+		{Time: 4, From: second},
+	}, history)
+}
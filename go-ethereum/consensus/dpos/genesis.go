@@ -0,0 +1,30 @@
+package dpos
+
+import (
+	"errors"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/core/types"
+)
+
+// SeedGenesisDpos seeds the dpos context of a genesis block with the given
+// validators: each one is registered as a candidate delegating to itself, the
+// list is set as the validators of the first epoch and the context committed.
+func SeedGenesisDpos(dc *types.DposContext, validators []common.Address) error {
+	if len(validators) == 0 {
+		return errors.New("no genesis validators")
+	}
+	if err := dc.BatchBecomeCandidate(validators); err != nil {
+		return err
+	}
+	for _, validator := range validators {
+		if err := dc.Delegate(validator, validator); err != nil {
+			return err
+		}
+	}
+	if err := dc.SetValidators(validators); err != nil {
+		return err
+	}
+	_, err := dc.Commit()
+	return err
+}
@@ -0,0 +1,52 @@
+package dpos
+
+import (
+	"testing"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/core/types"
+	"github.com/happytoken/go-ethereum/ethdb"
+	"github.com/happytoken/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeedGenesisDpos(t *testing.T) {
+	validators := []common.Address{
+		common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e"),
+		common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2"),
+		common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670"),
+	}
+	db := ethdb.NewMemDatabase()
+	trieDB := trie.NewDatabase(db)
+	dposContext, err := types.NewDposContext(trieDB)
+	assert.Nil(t, err)
+	assert.Nil(t, SeedGenesisDpos(dposContext, validators))
+
+	result, err := dposContext.GetValidators()
+	assert.Nil(t, err)
+	assert.Equal(t, validators, result)
+
+	// the seeded context is committed and can be reloaded from its roots
+	reloaded, err := types.NewDposContextFromProto(trie.NewDatabase(db), dposContext.ToProto())
+	assert.Nil(t, err)
+	result, err = reloaded.GetValidators()
+	assert.Nil(t, err)
+	assert.Equal(t, validators, result)
+
+	candidates := getCandidates(reloaded.CandidateTrie())
+	assert.Equal(t, len(validators), len(candidates))
+	for _, validator := range validators {
+		assert.True(t, candidates[validator])
+		vote, err := reloaded.VoteTrie().TryGet(validator.Bytes())
+		assert.Nil(t, err)
+		assert.Equal(t, validator.Bytes(), vote)
+		delegate, err := reloaded.DelegateTrie().TryGet(append(validator.Bytes(), validator.Bytes()...))
+		assert.Nil(t, err)
+		assert.Equal(t, validator.Bytes(), delegate)
+	}
+
+	// seeding without validators is rejected
+	dposContext, err = types.NewDposContext(trieDB)
+	assert.Nil(t, err)
+	assert.NotNil(t, SeedGenesisDpos(dposContext, nil))
+}
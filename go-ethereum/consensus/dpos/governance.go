@@ -0,0 +1,113 @@
+package dpos
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/core/types"
+	"github.com/happytoken/go-ethereum/crypto"
+	"github.com/happytoken/go-ethereum/crypto/sha3"
+	"github.com/happytoken/go-ethereum/log"
+	"github.com/happytoken/go-ethereum/params"
+	"github.com/happytoken/go-ethereum/rlp"
+)
+
+var (
+	// errOverrideDisabled is returned if an override is checked on a chain
+	// without admins.
+	errOverrideDisabled = errors.New("validator override not enabled")
+	// errOverrideEpoch is returned if an override is for another epoch than the
+	// one of the block it is included in.
+	errOverrideEpoch = errors.New("validator override for another epoch")
+	// errOverrideValidators is returned if an override has no validators or
+	// more than a block may have.
+	errOverrideValidators = errors.New("invalid validator override set")
+	// errOverrideQuorum is returned if too few admins signed an override.
+	errOverrideQuorum = errors.New("validator override lacks admin quorum")
+)
+
+// ValidatorOverride is the payload of a ValidatorOverride transaction, forcing
+// the validator set of an epoch in place of the election result.
+type ValidatorOverride struct {
+	Epoch      uint64
+	Validators []common.Address
+	Signatures [][]byte // Admin signatures of SigHash
+}
+
+// SigHash returns the hash the admins have to sign to approve the override.
+func (o *ValidatorOverride) SigHash() (hash common.Hash) {
+	hasher := sha3.NewKeccak256()
+	rlp.Encode(hasher, []interface{}{o.Epoch, o.Validators})
+	hasher.Sum(hash[:0])
+	return hash
+}
+
+// Sign adds the signature of an admin to the override.
+func (o *ValidatorOverride) Sign(sign func(hash []byte) ([]byte, error)) error {
+	sig, err := sign(o.SigHash().Bytes())
+	if err != nil {
+		return err
+	}
+	o.Signatures = append(o.Signatures, sig)
+	return nil
+}
+
+// verify checks the override is for the given epoch, holds a sane validator set
+// and is signed by enough distinct admins.
+func (o *ValidatorOverride) verify(config *params.DposConfig, epoch int64, maxValidatorSize uint64) error {
+	if config == nil || config.AdminThreshold == 0 || len(config.Admins) == 0 {
+		return errOverrideDisabled
+	}
+	if o.Epoch != uint64(epoch) {
+		return errOverrideEpoch
+	}
+	if len(o.Validators) == 0 || (maxValidatorSize > 0 && uint64(len(o.Validators)) > maxValidatorSize) {
+		return errOverrideValidators
+	}
+	admins := make(map[common.Address]bool, len(config.Admins))
+	for _, admin := range config.Admins {
+		admins[admin] = true
+	}
+	hash := o.SigHash().Bytes()
+	signers := make(map[common.Address]bool)
+	for _, sig := range o.Signatures {
+		pubkey, err := crypto.SigToPub(hash, sig)
+		if err != nil {
+			continue
+		}
+		if signer := crypto.PubkeyToAddress(*pubkey); admins[signer] {
+			signers[signer] = true
+		}
+	}
+	if uint64(len(signers)) < config.AdminThreshold {
+		return errOverrideQuorum
+	}
+	return nil
+}
+
+// recordValidatorOverrides records the last valid override among the
+// transactions, which replaces the election result of the epoch following the
+// block's. Invalid overrides are skipped, they don't invalidate the block.
+func recordValidatorOverrides(config *params.DposConfig, genesis, header *types.Header, txs []*types.Transaction, dposContext *types.DposContext) error {
+	epoch := HeaderEpochID(config, header) + 1
+	for _, tx := range txs {
+		if tx.Type() != types.ValidatorOverride {
+			continue
+		}
+		override := new(ValidatorOverride)
+		if err := rlp.DecodeBytes(tx.Data(), override); err != nil {
+			log.Warn("Skip undecodable validator override", "tx", tx.Hash(), "err", err)
+			continue
+		}
+		if err := override.verify(config, epoch, genesis.MaxValidatorSize); err != nil {
+			log.Warn("Skip invalid validator override", "tx", tx.Hash(), "err", err)
+			continue
+		}
+		if err := dposContext.SetValidatorOverride(epoch, override.Validators); err != nil {
+			return fmt.Errorf("failed to override validators: %s", err)
+		}
+		log.Warn("Validator set override accepted", "epoch", epoch, "validators", len(override.Validators), "tx", tx.Hash())
+	}
+	return nil
+}
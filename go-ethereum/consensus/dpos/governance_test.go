@@ -0,0 +1,139 @@
+package dpos
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"strconv"
+	"testing"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/core/state"
+	"github.com/happytoken/go-ethereum/core/types"
+	"github.com/happytoken/go-ethereum/crypto"
+	"github.com/happytoken/go-ethereum/ethdb"
+	"github.com/happytoken/go-ethereum/params"
+	"github.com/happytoken/go-ethereum/rlp"
+	"github.com/happytoken/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+func newOverrideTx(t *testing.T, override *ValidatorOverride, signers ...*ecdsa.PrivateKey) *types.Transaction {
+	for _, key := range signers {
+		assert.Nil(t, override.Sign(func(hash []byte) ([]byte, error) { return crypto.Sign(hash, key) }))
+	}
+	data, err := rlp.EncodeToBytes(override)
+	assert.Nil(t, err)
+	return types.NewTransaction(types.ValidatorOverride, 0, common.StringToAddress("override"), new(big.Int), 0, new(big.Int), data)
+}
+
+func TestRecordValidatorOverrides(t *testing.T) {
+	var (
+		keys   []*ecdsa.PrivateKey
+		admins []common.Address
+	)
+	for i := 0; i < 3; i++ {
+		key, _ := crypto.GenerateKey()
+		keys = append(keys, key)
+		admins = append(admins, crypto.PubkeyToAddress(key.PublicKey))
+	}
+	outsider, _ := crypto.GenerateKey()
+	config := &params.DposConfig{Admins: admins, AdminThreshold: 2}
+
+	elected := []common.Address{common.StringToAddress("elected")}
+	forced := []common.Address{common.StringToAddress("forced1"), common.StringToAddress("forced2")}
+	epoch := int64(3)
+	genesis := mockGenesisHeader(0)
+	header := &types.Header{Time: big.NewInt((epoch-1)*epochInterval + blockInterval)}
+
+	apply := func(config *params.DposConfig, txs ...*types.Transaction) []common.Address {
+		dposContext, err := types.NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+		assert.Nil(t, err)
+		assert.Nil(t, dposContext.SetValidators(elected))
+		assert.Nil(t, recordValidatorOverrides(config, genesis, header, txs, dposContext))
+		// the validators of the running epoch stay in place
+		validators, err := dposContext.GetValidators()
+		assert.Nil(t, err)
+		assert.Equal(t, elected, validators)
+		override, err := dposContext.GetValidatorOverride(epoch)
+		assert.Nil(t, err)
+		return override
+	}
+
+	// a quorum of admins forces the set
+	tx := newOverrideTx(t, &ValidatorOverride{Epoch: uint64(epoch), Validators: forced}, keys[0], keys[2])
+	assert.Equal(t, forced, apply(config, tx))
+
+	// too few signatures leave the election result in place
+	tx = newOverrideTx(t, &ValidatorOverride{Epoch: uint64(epoch), Validators: forced}, keys[0])
+	assert.Nil(t, apply(config, tx))
+
+	// repeated and non admin signatures don't count
+	tx = newOverrideTx(t, &ValidatorOverride{Epoch: uint64(epoch), Validators: forced}, keys[0], keys[0], outsider)
+	assert.Nil(t, apply(config, tx))
+
+	// overrides are bound to the next epoch, the running one is too late
+	tx = newOverrideTx(t, &ValidatorOverride{Epoch: uint64(epoch - 1), Validators: forced}, keys[0], keys[1])
+	assert.Nil(t, apply(config, tx))
+
+	// signatures over another set don't carry over
+	override := &ValidatorOverride{Epoch: uint64(epoch), Validators: elected}
+	newOverrideTx(t, override, keys[0], keys[1])
+	override.Validators = forced
+	data, _ := rlp.EncodeToBytes(override)
+	tx = types.NewTransaction(types.ValidatorOverride, 0, common.StringToAddress("override"), new(big.Int), 0, new(big.Int), data)
+	assert.Nil(t, apply(config, tx))
+
+	// disabled without admins
+	tx = newOverrideTx(t, &ValidatorOverride{Epoch: uint64(epoch), Validators: forced}, keys[0], keys[1])
+	assert.Nil(t, apply(&params.DposConfig{}, tx))
+
+	// empty sets are rejected
+	tx = newOverrideTx(t, &ValidatorOverride{Epoch: uint64(epoch)}, keys[0], keys[1])
+	assert.Nil(t, apply(config, tx))
+}
+
+func TestEpochContextTryElectOverride(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	for i := 0; i < maxValidatorSize; i++ {
+		validator := common.StringToAddress("addr" + strconv.Itoa(i))
+		assert.Nil(t, dposContext.BecomeCandidate(validator))
+		assert.Nil(t, dposContext.Delegate(validator, validator))
+		stateDB.SetBalance(validator, big.NewInt(int64(i+1)))
+	}
+	forced := []common.Address{common.StringToAddress("forced1"), common.StringToAddress("forced2")}
+	assert.Nil(t, dposContext.SetValidatorOverride(1, forced))
+
+	epochContext := &EpochContext{
+		TimeStamp:   epochInterval,
+		DposContext: dposContext,
+		statedb:     stateDB,
+		config:      &params.DposConfig{RankRewardCurve: []uint64{110, 100}, EpochHistoryBlock: big.NewInt(0)},
+	}
+	parent := &types.Header{Time: big.NewInt(epochInterval - blockInterval)}
+	assert.Nil(t, epochContext.tryElect(mockGenesisHeader(0), parent))
+
+	// the override replaces the election result and is used up by it
+	validators, err := dposContext.GetValidators()
+	assert.Nil(t, err)
+	assert.Equal(t, forced, validators)
+	validators, err = dposContext.GetEpochValidators(1)
+	assert.Nil(t, err)
+	assert.Equal(t, forced, validators)
+	ranks, err := dposContext.GetValidatorRanks()
+	assert.Nil(t, err)
+	assert.Empty(t, ranks)
+	override, err := dposContext.GetValidatorOverride(1)
+	assert.Nil(t, err)
+	assert.Nil(t, override)
+
+	// the next election is a regular one again
+	epochContext.TimeStamp = 2 * epochInterval
+	parent = &types.Header{Time: big.NewInt(2*epochInterval - blockInterval)}
+	assert.Nil(t, epochContext.tryElect(mockGenesisHeader(0), parent))
+	validators, err = dposContext.GetValidators()
+	assert.Nil(t, err)
+	assert.Equal(t, maxValidatorSize, len(validators))
+}
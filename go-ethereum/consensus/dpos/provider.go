@@ -0,0 +1,48 @@
+package dpos
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/core/state"
+	"github.com/happytoken/go-ethereum/crypto"
+	"github.com/happytoken/go-ethereum/params"
+)
+
+// ValidatorProvider supplies the validator set of an epoch from a source other
+// than the vote tries, e.g. a governance contract. The returned order is kept
+// as the election order before shuffling, so it must be deterministic.
+type ValidatorProvider interface {
+	Validators(statedb *state.StateDB, epoch int64) ([]common.Address, error)
+}
+
+// contractValidatorProvider reads the validator set from the storage of a
+// system contract which keeps it as an `address[]` in its first storage slot.
+type contractValidatorProvider struct {
+	contract common.Address
+}
+
+// NewContractValidatorProvider creates a provider reading the validator list
+// from the `address[]` stored at slot 0 of the given contract.
+func NewContractValidatorProvider(contract common.Address) ValidatorProvider {
+	return &contractValidatorProvider{contract: contract}
+}
+
+func (p *contractValidatorProvider) Validators(statedb *state.StateDB, epoch int64) ([]common.Address, error) {
+	// Dynamic arrays store their length at the slot itself and the elements
+	// consecutively from keccak256(slot) onwards.
+	slot := common.Hash{}
+	length := statedb.GetState(p.contract, slot).Big()
+	// the length is contract controlled, don't let it size the allocation
+	if length.Cmp(new(big.Int).SetUint64(params.MaxValidatorSizeLimit)) > 0 {
+		return nil, fmt.Errorf("validator list of %x too long: %v > %d", p.contract, length, params.MaxValidatorSizeLimit)
+	}
+	base := new(big.Int).SetBytes(crypto.Keccak256(slot.Bytes()))
+	validators := make([]common.Address, 0, length.Uint64())
+	for i := uint64(0); i < length.Uint64(); i++ {
+		key := common.BigToHash(new(big.Int).Add(base, new(big.Int).SetUint64(i)))
+		validators = append(validators, common.BytesToAddress(statedb.GetState(p.contract, key).Bytes()))
+	}
+	return validators, nil
+}
@@ -0,0 +1,117 @@
+package dpos
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+	"testing"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/core/state"
+	"github.com/happytoken/go-ethereum/core/types"
+	"github.com/happytoken/go-ethereum/crypto"
+	"github.com/happytoken/go-ethereum/ethdb"
+	"github.com/happytoken/go-ethereum/params"
+	"github.com/happytoken/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockValidatorProvider struct {
+	validators []common.Address
+	err        error
+}
+
+func (p *mockValidatorProvider) Validators(statedb *state.StateDB, epoch int64) ([]common.Address, error) {
+	return p.validators, p.err
+}
+
+// newMockProvider returns a provider of n validators named provided0, provided1 and so on.
+func newMockProvider(n int) *mockValidatorProvider {
+	provider := &mockValidatorProvider{}
+	for i := 0; i < n; i++ {
+		provider.validators = append(provider.validators, common.StringToAddress("provided"+strconv.Itoa(i)))
+	}
+	return provider
+}
+
+func TestEpochContextTryElectWithProvider(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+
+	// the provided set wins over a candidate with votes
+	voted := common.StringToAddress("voted")
+	assert.Nil(t, dposContext.BecomeCandidate(voted))
+	assert.Nil(t, dposContext.Delegate(voted, voted))
+	stateDB.SetBalance(voted, big.NewInt(100))
+
+	provided := map[common.Address]bool{}
+	provider := &mockValidatorProvider{}
+	for i := 0; i < maxValidatorSize; i++ {
+		validator := common.StringToAddress("provided" + strconv.Itoa(i))
+		provider.validators = append(provider.validators, validator)
+		provided[validator] = true
+	}
+	epochContext := &EpochContext{
+		TimeStamp:   epochInterval,
+		DposContext: dposContext,
+		statedb:     stateDB,
+		provider:    provider,
+	}
+	genesis := mockGenesisHeader(0)
+	parent := &types.Header{Time: big.NewInt(epochInterval - blockInterval)}
+	assert.Nil(t, epochContext.tryElect(genesis, parent))
+
+	result, err := dposContext.GetValidators()
+	assert.Nil(t, err)
+	assert.Equal(t, maxValidatorSize, len(result))
+	for _, validator := range result {
+		assert.True(t, provided[validator])
+	}
+
+	// too few provided validators must fail the election
+	provider.validators = provider.validators[:safeSize-1]
+	assert.NotNil(t, epochContext.tryElect(genesis, parent))
+
+	// provider errors are propagated
+	provider.err = errors.New("provider failure")
+	assert.NotNil(t, epochContext.tryElect(genesis, parent))
+}
+
+func TestContractValidatorProvider(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	contract := common.StringToAddress("validatorContract")
+	validators := []common.Address{
+		common.StringToAddress("addr1"),
+		common.StringToAddress("addr2"),
+		common.StringToAddress("addr3"),
+	}
+	// lay out the validators as a solidity address[] at slot 0
+	stateDB.SetState(contract, common.Hash{}, common.BigToHash(big.NewInt(int64(len(validators)))))
+	base := new(big.Int).SetBytes(crypto.Keccak256(common.Hash{}.Bytes()))
+	for i, validator := range validators {
+		key := common.BigToHash(new(big.Int).Add(base, big.NewInt(int64(i))))
+		stateDB.SetState(contract, key, common.BytesToHash(validator.Bytes()))
+	}
+
+	result, err := NewContractValidatorProvider(contract).Validators(stateDB, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, validators, result)
+
+	// an unknown contract yields an empty set
+	result, err = NewContractValidatorProvider(common.StringToAddress("unknown")).Validators(stateDB, 1)
+	assert.Nil(t, err)
+	assert.Empty(t, result)
+
+	// lengths beyond the validator size limit are rejected before reading
+	for _, length := range []*big.Int{
+		new(big.Int).SetUint64(params.MaxValidatorSizeLimit + 1),
+		new(big.Int).Lsh(common.Big1, 255),
+	} {
+		stateDB.SetState(contract, common.Hash{}, common.BigToHash(length))
+		_, err = NewContractValidatorProvider(contract).Validators(stateDB, 1)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,93 @@
+package dpos
+
+import (
+	"errors"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/core/state"
+	"github.com/happytoken/go-ethereum/core/types"
+	"github.com/happytoken/go-ethereum/rlp"
+)
+
+var (
+	// ErrAlreadyCandidate is returned if an address registers as candidate
+	// while being one.
+	ErrAlreadyCandidate = errors.New("already a candidate")
+	// ErrNotCandidate is returned if a transaction requires its sender or
+	// recipient to be a candidate and it isn't.
+	ErrNotCandidate = errors.New("not a candidate")
+	// ErrNotDelegated is returned if a delegator withdraws a vote it didn't
+	// cast for the candidate.
+	ErrNotDelegated = errors.New("not delegated to the candidate")
+	// ErrNoRecipient is returned if a transaction naming a candidate or payout
+	// address has no recipient.
+	ErrNoRecipient = errors.New("recipient required")
+)
+
+// ValidateDposTx checks the dpos system transaction against the dpos state it
+// is applied on: the candidates it names have to be registered, or not yet for
+// a registration, and votes have to exist to be withdrawn. The tx pool turns
+// failing transactions away, block processing includes them without effect.
+//
+// The vote and registration cooldowns depend on the time of the including
+// block, so they are enforced when the transaction is applied. The protocol
+// asks no stake of candidates or delegators, so state is not consulted yet.
+func ValidateDposTx(tx *types.Transaction, ctx *types.DposContext, state *state.StateDB) error {
+	if tx.Type() == types.Binary {
+		return nil
+	}
+	from, err := types.Sender(types.NewEIP155Signer(tx.ChainId()), tx)
+	if err != nil {
+		return err
+	}
+	// block processing doesn't run tx.Validate, so check before dereferencing
+	switch tx.Type() {
+	case types.Delegate, types.UnDelegate, types.SetPayout:
+		if tx.To() == nil {
+			return ErrNoRecipient
+		}
+	}
+	switch tx.Type() {
+	case types.RegCandidate:
+		return requireCandidate(ctx, from, false)
+	case types.UnregCandidate:
+		return requireCandidate(ctx, from, true)
+	case types.Delegate:
+		return requireCandidate(ctx, *tx.To(), true)
+	case types.UnDelegate:
+		if err := requireCandidate(ctx, *tx.To(), true); err != nil {
+			return err
+		}
+		vote, err := ctx.GetVote(from)
+		if err != nil {
+			return err
+		}
+		if vote != *tx.To() {
+			return ErrNotDelegated
+		}
+		return nil
+	case types.SetPayout:
+		return requireCandidate(ctx, from, true)
+	case types.ValidatorOverride:
+		// the admin signatures are verified by the engine when finalizing
+		return rlp.DecodeBytes(tx.Data(), new(ValidatorOverride))
+	default:
+		return types.ErrInvalidType
+	}
+}
+
+// requireCandidate returns an error unless the address being a candidate
+// matches want.
+func requireCandidate(dposContext *types.DposContext, addr common.Address, want bool) error {
+	registered, err := dposContext.CandidateTrie().TryGet(addr.Bytes())
+	if err != nil {
+		return err
+	}
+	switch {
+	case want && registered == nil:
+		return ErrNotCandidate
+	case !want && registered != nil:
+		return ErrAlreadyCandidate
+	}
+	return nil
+}
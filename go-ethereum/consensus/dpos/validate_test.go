@@ -0,0 +1,96 @@
+package dpos
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/core/state"
+	"github.com/happytoken/go-ethereum/core/types"
+	"github.com/happytoken/go-ethereum/crypto"
+	"github.com/happytoken/go-ethereum/ethdb"
+	"github.com/happytoken/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateDposTx(t *testing.T) {
+	var (
+		keys  = make(map[string]*ecdsa.PrivateKey)
+		addrs = make(map[string]common.Address)
+	)
+	for _, name := range []string{"candidate", "delegator", "outsider"} {
+		keys[name], _ = crypto.GenerateKey()
+		addrs[name] = crypto.PubkeyToAddress(keys[name].PublicKey)
+	}
+	candidate, delegator, outsider := addrs["candidate"], addrs["delegator"], addrs["outsider"]
+
+	db := ethdb.NewMemDatabase()
+	stateDB, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	dposContext, err := types.NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	assert.Nil(t, dposContext.Delegate(delegator, candidate))
+	root := dposContext.Root()
+
+	signer := types.NewEIP155Signer(big.NewInt(1))
+	newTx := func(txType types.TxType, from string, to common.Address) *types.Transaction {
+		tx, err := types.SignTx(types.NewTransaction(txType, 0, to, new(big.Int), 0, new(big.Int), nil), signer, keys[from])
+		assert.Nil(t, err)
+		return tx
+	}
+	for i, test := range []struct {
+		tx  *types.Transaction
+		err error
+	}{
+		{newTx(types.Binary, "outsider", candidate), nil},
+
+		{newTx(types.RegCandidate, "outsider", common.Address{}), nil},
+		{newTx(types.RegCandidate, "candidate", common.Address{}), ErrAlreadyCandidate},
+
+		{newTx(types.UnregCandidate, "candidate", common.Address{}), nil},
+		{newTx(types.UnregCandidate, "outsider", common.Address{}), ErrNotCandidate},
+
+		{newTx(types.Delegate, "outsider", candidate), nil},
+		{newTx(types.Delegate, "delegator", candidate), nil},
+		{newTx(types.Delegate, "outsider", outsider), ErrNotCandidate},
+
+		{newTx(types.UnDelegate, "delegator", candidate), nil},
+		{newTx(types.UnDelegate, "outsider", candidate), ErrNotDelegated},
+		{newTx(types.UnDelegate, "delegator", outsider), ErrNotCandidate},
+
+		{newTx(types.SetPayout, "candidate", outsider), nil},
+		{newTx(types.SetPayout, "outsider", outsider), ErrNotCandidate},
+
+		// a zero recipient leaves the transaction without one
+		{newTx(types.Delegate, "delegator", common.Address{}), ErrNoRecipient},
+		{newTx(types.UnDelegate, "delegator", common.Address{}), ErrNoRecipient},
+		{newTx(types.SetPayout, "candidate", common.Address{}), ErrNoRecipient},
+
+		{newTx(types.TxType(0xff), "outsider", candidate), types.ErrInvalidType},
+	} {
+		assert.Equal(t, test.err, ValidateDposTx(test.tx, dposContext, stateDB), "test %d", i)
+	}
+	// unsigned transactions have no sender to check
+	unsigned := types.NewTransaction(types.SetPayout, 0, outsider, new(big.Int), 0, new(big.Int), nil)
+	assert.NotNil(t, ValidateDposTx(unsigned, dposContext, stateDB))
+
+	// validation leaves the state untouched
+	assert.Equal(t, root, dposContext.Root())
+}
+
+func TestValidateDposTxOverride(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	dposContext, err := types.NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	signer := types.NewEIP155Signer(big.NewInt(1))
+
+	// overrides only have to decode, the engine verifies the admin signatures
+	tx, err := types.SignTx(newOverrideTx(t, &ValidatorOverride{Epoch: 3, Validators: []common.Address{common.StringToAddress("forced")}}, key), signer, key)
+	assert.Nil(t, err)
+	assert.Nil(t, ValidateDposTx(tx, dposContext, nil))
+
+	tx, err = types.SignTx(types.NewTransaction(types.ValidatorOverride, 0, common.StringToAddress("override"), new(big.Int), 0, new(big.Int), []byte{0x01}), signer, key)
+	assert.Nil(t, err)
+	assert.NotNil(t, ValidateDposTx(tx, dposContext, nil))
+}
@@ -0,0 +1,80 @@
+package dpos
+
+import (
+	"time"
+
+	"github.com/happytoken/go-ethereum/consensus"
+	"github.com/happytoken/go-ethereum/core/types"
+	"github.com/happytoken/go-ethereum/log"
+	"github.com/happytoken/go-ethereum/metrics"
+)
+
+var (
+	missedSlotsGauge      = metrics.NewRegisteredGauge("dpos/missedslots", nil)
+	integrityFailureMeter = metrics.NewRegisteredMeter("dpos/integrity/failures", nil)
+)
+
+// MissedSlots returns the number of consecutive slots that went by without a
+// block since the head of the chain. The slot in progress at now doesn't count.
+func (d *Dpos) MissedSlots(chain consensus.ChainReader, now int64) int {
+	head := chain.CurrentHeader()
+	genesis := chain.GetHeaderByNumber(0)
+	if head == nil || genesis == nil || genesis.BlockInterval == 0 {
+		return 0
+	}
+	interval := int64(genesis.BlockInterval)
+	headSlot := head.Time.Int64() - head.Time.Int64()%interval
+	missed := (now-now%interval-headSlot)/interval - 1
+	if missed < 0 {
+		return 0
+	}
+	return int(missed)
+}
+
+// StartWatchdog checks the chain for missed slots once per block interval until
+// the engine is closed.
+func (d *Dpos) StartWatchdog(chain consensus.ChainReader) {
+	genesis := chain.GetHeaderByNumber(0)
+	if genesis == nil || genesis.BlockInterval == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(genesis.BlockInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case now := <-ticker.C:
+				d.checkStall(chain, now.Unix())
+			}
+		}
+	}()
+}
+
+// checkStall publishes the missed slots and reports the chain as stalled once
+// more than StallSlots of them went by in a row.
+func (d *Dpos) checkStall(chain consensus.ChainReader, now int64) bool {
+	missed := d.MissedSlots(chain, now)
+	missedSlotsGauge.Update(int64(missed))
+	if missed <= int(d.config.StallSlots) {
+		return false
+	}
+	log.Warn("Chain stalled, no blocks minted", "missedSlots", missed, "head", chain.CurrentHeader().Number)
+	return true
+}
+
+// checkIntegrity validates the vote and delegate tries once a block applied its
+// dpos changes, if CheckTrieIntegrity is set. Inconsistencies are logged and
+// metered but don't fail the block, they have to be investigated by hand.
+func (d *Dpos) checkIntegrity(header *types.Header, dposContext *types.DposContext) error {
+	if !d.config.CheckTrieIntegrity {
+		return nil
+	}
+	err := dposContext.Validate()
+	if err != nil {
+		integrityFailureMeter.Mark(1)
+		log.Error("Dpos tries out of sync", "number", header.Number, "hash", header.Hash(), "err", err)
+	}
+	return err
+}
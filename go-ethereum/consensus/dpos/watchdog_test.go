@@ -0,0 +1,70 @@
+package dpos
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/core/types"
+	"github.com/happytoken/go-ethereum/ethdb"
+	"github.com/happytoken/go-ethereum/params"
+	"github.com/happytoken/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissedSlots(t *testing.T) {
+	genesis := newGenesisHeader(0)
+	validators := []common.Address{common.StringToAddress("addr0"), common.StringToAddress("addr1")}
+	// the last block was sealed a little after its slot
+	head := 100 * blockInterval
+	chain := newTestChain(genesis, validators, []int64{head - blockInterval, head + 3}, &types.DposContextProto{})
+	engine := New(&params.DposConfig{StallSlots: 3}, ethdb.NewMemDatabase())
+
+	tests := []struct {
+		now     int64
+		missed  int
+		stalled bool
+	}{
+		{head + 3, 0, false},
+		{head + blockInterval + 5, 0, false},   // the next slot is still in progress
+		{head + 2*blockInterval, 1, false},     // the next slot went by
+		{head + 4*blockInterval + 9, 3, false}, // as many missed as allowed
+		{head + 5*blockInterval, 4, true},      // the chain stalled
+		{head + 100*blockInterval + 1, 99, true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.missed, engine.MissedSlots(chain, test.now), "now %d", test.now)
+		assert.Equal(t, test.stalled, engine.checkStall(chain, test.now), "now %d", test.now)
+	}
+
+	// a new block ends the stall
+	chain = newTestChain(genesis, append(validators, validators[0]), []int64{head - blockInterval, head + 3, head + 100*blockInterval}, &types.DposContextProto{})
+	assert.Equal(t, 0, engine.MissedSlots(chain, head+100*blockInterval+1))
+
+	// the default threshold applies if unset
+	engine = New(nil, ethdb.NewMemDatabase())
+	assert.Equal(t, defaultStallSlots, engine.config.StallSlots)
+	engine.StartWatchdog(chain)
+	assert.Nil(t, engine.Close())
+	assert.Nil(t, engine.Close())
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	candidate := common.StringToAddress("candidate")
+	delegator := common.StringToAddress("delegator")
+	dposContext, err := types.NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	assert.Nil(t, dposContext.Delegate(delegator, candidate))
+	header := &types.Header{Number: big.NewInt(1)}
+
+	engine := New(&params.DposConfig{CheckTrieIntegrity: true}, ethdb.NewMemDatabase())
+	assert.Nil(t, engine.checkIntegrity(header, dposContext))
+
+	// a vote left behind without its delegate entry is caught
+	assert.Nil(t, dposContext.DelegateTrie().TryDelete(append(candidate.Bytes(), delegator.Bytes()...)))
+	assert.NotNil(t, engine.checkIntegrity(header, dposContext))
+
+	// unless the check is off
+	assert.Nil(t, New(nil, ethdb.NewMemDatabase()).checkIntegrity(header, dposContext))
+}
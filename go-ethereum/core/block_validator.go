@@ -20,6 +20,7 @@ import (
 	"fmt"
 
 	"github.com/happytoken/go-ethereum/consensus"
+	"github.com/happytoken/go-ethereum/consensus/dpos"
 	"github.com/happytoken/go-ethereum/core/state"
 	"github.com/happytoken/go-ethereum/core/types"
 	"github.com/happytoken/go-ethereum/params"
@@ -102,13 +103,7 @@ func (v *BlockValidator) ValidateState(block, parent *types.Block, statedb *stat
 }
 
 func (v *BlockValidator) ValidateDposState(block *types.Block) error {
-	header := block.Header()
-	localRoot := block.DposCtx().Root()
-	remoteRoot := header.DposContext.Root()
-	if remoteRoot != localRoot {
-		return fmt.Errorf("invalid dpos root (remote: %x local: %x)", remoteRoot, localRoot)
-	}
-	return nil
+	return dpos.VerifyDposRoots(block.Header(), block.DposCtx())
 }
 
 // CalcGasLimit computes the gas limit of the next block after parent.
@@ -1005,6 +1005,16 @@ func (bc *BlockChain) WriteBlockWithState(block *types.Block, receipts []*types.
 	// Set new head.
 	if status == CanonStatTy {
 		bc.insert(block)
+
+		// advance the dpos irreversible block over the new head
+		if dposEngine, isDpos := bc.engine.(*dpos.Dpos); isDpos {
+			if err := dposEngine.UpdateConfirmedBlockHeader(bc); err != nil {
+				log.Warn("Failed to update dpos confirmed block", "number", block.Number(), "err", err)
+			}
+			if err := dposEngine.NewHead(bc, block.Header()); err != nil {
+				log.Warn("Failed to post dpos election", "number", block.Number(), "err", err)
+			}
+		}
 	}
 	bc.futureBlocks.Remove(block.Hash())
 	return status, nil
@@ -1073,6 +1083,12 @@ func (bc *BlockChain) insertChain(chain types.Blocks) (int, []interface{}, []*ty
 	// Start a parallel signature recovery (signer will fluke on fork transition, minimal perf loss)
 	senderCacher.recoverFromBlocks(types.MakeSigner(bc.chainConfig, chain[0].Number()), chain)
 
+	// Check the seals of the segment against validator sets read once per epoch trie
+	var sealVerifier *dpos.SealVerifier
+	if dposEngine, isDpos := bc.engine.(*dpos.Dpos); isDpos {
+		sealVerifier = dposEngine.NewSealVerifier(genesisblock.Header())
+	}
+
 	// Iterate over the blocks and insert when the verifier permits
 	for i, block := range chain {
 		// If the chain is terminating, stop processing blocks
@@ -1192,9 +1208,8 @@ func (bc *BlockChain) insertChain(chain types.Blocks) (int, []interface{}, []*ty
 			return i, events, coalescedLogs, err
 		}
 		// Validate validator
-		dposEngine, isDpos := bc.engine.(*dpos.Dpos)
-		if isDpos {
-			err = dposEngine.VerifySeal(bc, block.Header(),genesisblock.Header())
+		if sealVerifier != nil {
+			err = sealVerifier.Verify(bc, block.Header(), nil)
 			if err != nil {
 				bc.reportBlock(block, receipts, err)
 				return i, events, coalescedLogs, err
@@ -1361,6 +1376,12 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 			return fmt.Errorf("Invalid new chain")
 		}
 	}
+	// Refuse reorgs reaching too far below the irreversible block
+	if dposEngine, isDpos := bc.engine.(*dpos.Dpos); isDpos {
+		if err := dposEngine.VerifyReorg(bc, uint64(len(oldChain))); err != nil {
+			return err
+		}
+	}
 	// Ensure the user sees large reorgs
 	if len(oldChain) > 0 && len(newChain) > 0 {
 		logFn := log.Debug
@@ -1394,6 +1415,16 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 	if len(deletedLogs) > 0 {
 		go bc.rmLogsFeed.Send(RemovedLogsEvent{deletedLogs})
 	}
+	// Drop the dpos caches of the orphaned blocks and recompute finality
+	if dposEngine, isDpos := bc.engine.(*dpos.Dpos); isDpos && len(newChain) > 0 {
+		orphans := make([]*types.Header, len(oldChain))
+		for i, block := range oldChain {
+			orphans[i] = block.Header()
+		}
+		if err := dposEngine.Reorg(bc, newChain[0].Header(), orphans); err != nil {
+			log.Error("Failed to update dpos confirmation after reorg", "err", err)
+		}
+	}
 
 	return nil
 }
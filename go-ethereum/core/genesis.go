@@ -155,6 +155,11 @@ func SetupGenesisBlock(db ethdb.Database, genesis *Genesis) (*params.ChainConfig
 	if genesis != nil && genesis.Config == nil {
 		return params.DposChainConfig, common.Hash{}, errGenesisNoConfig
 	}
+	if genesis != nil {
+		if err := validateDposConfig(genesis.Config); err != nil {
+			return genesis.Config, common.Hash{}, err
+		}
+	}
 
 	// Just commit the new block if there is no stored genesis block.
 	stored := rawdb.ReadCanonicalHash(db, 0)
@@ -162,6 +167,9 @@ func SetupGenesisBlock(db ethdb.Database, genesis *Genesis) (*params.ChainConfig
 		if genesis == nil {
 			log.Info("Writing default main-net genesis block")
 			genesis = DefaultGenesisBlock()
+			if err := validateDposConfig(genesis.Config); err != nil {
+				return genesis.Config, common.Hash{}, err
+			}
 		} else {
 			log.Info("Writing custom genesis block")
 		}
@@ -182,6 +190,9 @@ func SetupGenesisBlock(db ethdb.Database, genesis *Genesis) (*params.ChainConfig
 	storedcfg := rawdb.ReadChainConfig(db, stored)
 	if storedcfg == nil {
 		log.Warn("Found genesis block without chain config")
+		if err := validateDposConfig(newcfg); err != nil {
+			return newcfg, stored, err
+		}
 		rawdb.WriteChainConfig(db, stored, newcfg)
 		return newcfg, stored, nil
 	}
@@ -189,6 +200,10 @@ func SetupGenesisBlock(db ethdb.Database, genesis *Genesis) (*params.ChainConfig
 	// config is supplied. These chains would get AllProtocolChanges (and a compat error)
 	// if we just continued here.
 	if genesis == nil && stored != params.MainnetGenesisHash {
+		// nodes restarting without a genesis still check the stored parameters
+		if err := validateDposConfig(storedcfg); err != nil {
+			return storedcfg, stored, err
+		}
 		return storedcfg, stored, nil
 	}
 
@@ -206,6 +221,15 @@ func SetupGenesisBlock(db ethdb.Database, genesis *Genesis) (*params.ChainConfig
 	return newcfg, stored, nil
 }
 
+// validateDposConfig checks the dpos parameters of the chain configuration, if
+// it runs dpos.
+func validateDposConfig(config *params.ChainConfig) error {
+	if config == nil || config.Dpos == nil {
+		return nil
+	}
+	return config.Dpos.Validate()
+}
+
 func (g *Genesis) configOrDefault(ghash common.Hash) *params.ChainConfig {
 	switch {
 	case g != nil:
@@ -397,9 +421,13 @@ func initGenesisDposContext(g *Genesis, db *trie.Database) *types.DposContext {
 	}
 	if g.Config != nil && g.Config.Dpos != nil && g.Config.Dpos.Validators != nil {
 		dc.SetValidators(g.Config.Dpos.Validators)
+		if err := dc.BatchBecomeCandidate(g.Config.Dpos.Validators); err != nil {
+			log.Error("initGenesisDposContext-BatchBecomeCandidate", "error", err)
+			return nil
+		}
+		// the genesis validators back themselves, without a vote of their own
 		for _, validator := range g.Config.Dpos.Validators {
 			dc.DelegateTrie().TryUpdate(append(validator.Bytes(), validator.Bytes()...), validator.Bytes())
-			dc.CandidateTrie().TryUpdate(validator.Bytes(), validator.Bytes())
 		}
 	}
 	return dc
@@ -19,6 +19,7 @@ package core
 import (
 	"github.com/happytoken/go-ethereum/common"
 	"github.com/happytoken/go-ethereum/consensus"
+	"github.com/happytoken/go-ethereum/consensus/dpos"
 	"github.com/happytoken/go-ethereum/consensus/misc"
 	"github.com/happytoken/go-ethereum/core/state"
 	"github.com/happytoken/go-ethereum/core/types"
@@ -107,7 +108,7 @@ func ApplyTransaction(config *params.ChainConfig, dposContext *types.DposContext
 		return nil, 0, err
 	}
 	if msg.Type() != types.Binary {
-		if err = applyDposMessage(dposContext, msg); err != nil {
+		if err = applyDposMessage(config.Dpos, dposContext, statedb, tx, msg, header); err != nil {
 			return nil, 0, err
 		}
 	}
@@ -138,18 +139,58 @@ func ApplyTransaction(config *params.ChainConfig, dposContext *types.DposContext
 }
 
 // 更新打包時会執行所有的块内交易，如果发现交易类型不是转账或者合约调用类型，将会将新的用户信息写入到候选人数据库中（候选人树）
-func applyDposMessage(dposContext *types.DposContext, msg types.Message) error {
+func applyDposMessage(config *params.DposConfig, dposContext *types.DposContext, statedb *state.StateDB, tx *types.Transaction, msg types.Message, header *types.Header) error {
+	if err := dpos.ValidateDposTx(tx, dposContext, statedb); err != nil {
+		if err == types.ErrInvalidType {
+			return err
+		}
+		// transactions breaking the dpos rules are included without effect
+		return nil
+	}
+	var cooldown, reRegisterCooldown int64
+	var historyLength int
+	if config != nil {
+		cooldown = int64(config.VoteChangeCooldown)
+		reRegisterCooldown = int64(config.ReRegisterCooldown)
+		historyLength = int(config.VoteHistoryLength)
+	}
 	switch msg.Type() {
 	case types.RegCandidate:
-		dposContext.BecomeCandidate(msg.From())
+		epoch := dpos.HeaderEpochID(config, header)
+		if config.IsCandidateEpoch(header.Number) {
+			dposContext.RegisterCandidateAt(msg.From(), epoch, reRegisterCooldown)
+		} else if dposContext.CheckReRegisterCooldown(msg.From(), epoch, reRegisterCooldown) == nil {
+			// candidates hold the bare address until the candidate epoch fork
+			dposContext.BecomeCandidate(msg.From())
+		}
 	case types.UnregCandidate:
-		dposContext.KickoutCandidate(msg.From())
+		dposContext.KickoutCandidateAt(msg.From(), dpos.HeaderEpochID(config, header), reRegisterCooldown)
 	case types.Delegate:
-		dposContext.Delegate(msg.From(), *(msg.To()))
+		previous, _ := dposContext.GetVote(msg.From())
+		if previous == *(msg.To()) {
+			// voting again for the current candidate changes nothing
+			break
+		}
+		var err error
+		if config.IsVoteTime(header.Number) {
+			err = dposContext.DelegateAt(msg.From(), *(msg.To()), header.Time.Int64(), cooldown)
+		} else {
+			// votes hold the bare candidate until the vote time fork
+			err = dposContext.Delegate(msg.From(), *(msg.To()))
+		}
+		if err == nil {
+			change := types.VoteChange{Time: header.Time.Uint64(), From: previous, To: *(msg.To())}
+			dposContext.RecordVoteChange(msg.From(), change, historyLength)
+		}
 	case types.UnDelegate:
-		dposContext.UnDelegate(msg.From(), *(msg.To()))
-	default:
-		return types.ErrInvalidType
+		if dposContext.UnDelegateAt(msg.From(), *(msg.To()), header.Time.Int64(), cooldown) == nil {
+			change := types.VoteChange{Time: header.Time.Uint64(), From: *(msg.To())}
+			dposContext.RecordVoteChange(msg.From(), change, historyLength)
+		}
+	case types.SetPayout:
+		dposContext.SetPayout(msg.From(), *(msg.To()))
+	case types.ValidatorOverride:
+		// applied by the consensus engine when finalizing the block
 	}
 	return nil
 }
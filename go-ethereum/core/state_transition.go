@@ -22,6 +22,8 @@ import (
 	"math/big"
 
 	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/consensus/dpos"
+	"github.com/happytoken/go-ethereum/core/types"
 	"github.com/happytoken/go-ethereum/core/vm"
 	"github.com/happytoken/go-ethereum/log"
 	"github.com/happytoken/go-ethereum/params"
@@ -73,6 +75,7 @@ type Message interface {
 	Nonce() uint64
 	CheckNonce() bool
 	Data() []byte
+	Type() types.TxType
 }
 
 // IntrinsicGas computes the 'intrinsic gas' for a message with the given data.
@@ -197,6 +200,12 @@ func (st *StateTransition) TransitionDb() (ret []byte, usedGas uint64, failed bo
 	if err = st.useGas(gas); err != nil {
 		return nil, 0, false, err
 	}
+	// Pay for the dpos trie writes of system transactions
+	if msg.Type() != types.Binary {
+		if err = st.useGas(dpos.SystemGas(st.evm.ChainConfig().Dpos, st.evm.BlockNumber, msg.Type())); err != nil {
+			return nil, 0, false, err
+		}
+	}
 
 	var (
 		evm = st.evm
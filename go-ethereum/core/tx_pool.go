@@ -26,6 +26,7 @@ import (
 	"time"
 
 	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/consensus/dpos"
 	"github.com/happytoken/go-ethereum/core/state"
 	"github.com/happytoken/go-ethereum/core/types"
 	"github.com/happytoken/go-ethereum/event"
@@ -197,6 +198,8 @@ type TxPool struct {
 	currentState  *state.StateDB      // Current state in the blockchain head
 	pendingState  *state.ManagedState // Pending state tracking virtual nonces
 	currentMaxGas uint64              // Current gas limit for transaction caps
+	currentDpos   *types.DposContext  // Current dpos state in the blockchain head, nil without dpos
+	pendingNumber *big.Int            // Number of the block pending transactions go into
 
 	locals  *accountSet // Set of local transaction to exempt from eviction rules
 	journal *txJournal  // Journal of local transaction to back up to disk
@@ -413,6 +416,13 @@ func (pool *TxPool) reset(oldHead, newHead *types.Header) {
 	pool.currentState = statedb
 	pool.pendingState = state.ManageState(statedb)
 	pool.currentMaxGas = newHead.GasLimit
+	pool.pendingNumber = new(big.Int).Add(newHead.Number, big.NewInt(1))
+	pool.currentDpos = nil
+	if newHead.DposContext != nil {
+		if pool.currentDpos, err = types.NewDposContextFromProto(statedb.Database().TrieDB(), newHead.DposContext); err != nil {
+			log.Error("Failed to reset txpool dpos state", "err", err)
+		}
+	}
 
 	// Inject any transactions discarded due to reorgs
 	log.Debug("Reinjecting stale transactions", "count", len(reinject))
@@ -602,9 +612,24 @@ func (pool *TxPool) validateTx(tx *types.Transaction, local bool) error {
 	if err != nil {
 		return err
 	}
+	if tx.Type() != types.Binary {
+		intrGas += dpos.SystemGas(pool.chainconfig.Dpos, pool.pendingNumber, tx.Type())
+	}
 	if tx.Gas() < intrGas {
 		return ErrIntrinsicGas
 	}
+	// Dpos transactions are checked against the head, only the cooldowns are
+	// left to the block they end up in
+	if tx.Type() != types.Binary {
+		if err := tx.Validate(); err != nil {
+			return err
+		}
+		if pool.currentDpos != nil {
+			if err := dpos.ValidateDposTx(tx, pool.currentDpos, pool.currentState); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
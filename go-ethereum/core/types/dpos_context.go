@@ -2,15 +2,27 @@ package types
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/big"
+	"sort"
+	"time"
 
 	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/crypto"
 	"github.com/happytoken/go-ethereum/crypto/sha3"
+	"github.com/happytoken/go-ethereum/log"
+	"github.com/happytoken/go-ethereum/metrics"
 	"github.com/happytoken/go-ethereum/rlp"
 	"github.com/happytoken/go-ethereum/trie"
 )
 
+// DposContext holds the dpos tries of a block. It is not safe for concurrent
+// use, not even by readers only, as lookups cache the trie nodes they resolve.
+// Goroutines sharing a context, like RPC handlers reading the state of the
+// block being mined, each have to work on their own Copy, taken while no one
+// modifies the original.
 type DposContext struct {
 	epochTrie     *trie.Trie   //记录每个周期的验证人列表
 	delegateTrie  *trie.Trie   //记录验证人以及对应投票人的列表
@@ -21,6 +33,26 @@ type DposContext struct {
 	db *trie.Database
 }
 
+var (
+	dposCommitTimer = metrics.NewRegisteredTimer("dpos/commit/time", nil)
+)
+
+var (
+	// ErrVoteChangeTooSoon is returned if a delegator changes its vote again
+	// before the vote change cooldown has passed.
+	ErrVoteChangeTooSoon = errors.New("vote change too soon")
+	// ErrReRegisterTooSoon is returned if a candidate that left registers again
+	// before the re-registration cooldown has passed.
+	ErrReRegisterTooSoon = errors.New("candidate re-registration too soon")
+	// ErrInvalidDelegateKey is returned if a delegate trie key would be formed
+	// from a candidate or delegator that isn't an address, e.g. read from a
+	// corrupted trie entry.
+	ErrInvalidDelegateKey = errors.New("invalid delegate trie key")
+	// ErrInvalidCandidateExport is returned if imported candidates hold an
+	// entry that isn't a candidate trie entry.
+	ErrInvalidCandidateExport = errors.New("invalid candidate export")
+)
+
 var (
 	epochPrefix     = []byte("epoch-")
 	delegatePrefix  = []byte("delegate-")
@@ -41,6 +73,11 @@ func NewVoteTrie(root common.Hash, db *trie.Database) (*trie.Trie, error) {
 	return trie.NewTrieWithPrefix(root, votePrefix, db)
 }
 
+// VotePrefix returns the prefix the keys of vote trie iterators carry.
+func VotePrefix() []byte {
+	return common.CopyBytes(votePrefix)
+}
+
 func NewCandidateTrie(root common.Hash, db *trie.Database) (*trie.Trie, error) {
 	return trie.NewTrieWithPrefix(root, candidatePrefix, db)
 }
@@ -80,6 +117,22 @@ func NewDposContext(db *trie.Database) (*DposContext, error) {
 	}, nil
 }
 
+// Clear wipes the dpos state, replacing all tries with empty ones backed by the
+// same database, and commits the empty state.
+func (d *DposContext) Clear() error {
+	empty, err := NewDposContext(d.db)
+	if err != nil {
+		return err
+	}
+	d.epochTrie = empty.epochTrie
+	d.delegateTrie = empty.delegateTrie
+	d.voteTrie = empty.voteTrie
+	d.candidateTrie = empty.candidateTrie
+	d.mintCntTrie = empty.mintCntTrie
+	_, err = d.Commit()
+	return err
+}
+
 func NewDposContextFromProto(db *trie.Database, ctxProto *DposContextProto) (*DposContext, error) {
 	epochTrie, err := NewEpochTrie(ctxProto.EpochHash, db)
 	if err != nil {
@@ -111,21 +164,45 @@ func NewDposContextFromProto(db *trie.Database, ctxProto *DposContextProto) (*Dp
 	}, nil
 }
 
+// OpenEpochTrieOnly opens a dpos context backed by the epoch trie alone, for
+// reading the validators without the cost of opening the other four tries.
+// Only the epoch trie accessors may be used on the returned context.
+func OpenEpochTrieOnly(root common.Hash, db *trie.Database) (*DposContext, error) {
+	epochTrie, err := NewEpochTrie(root, db)
+	if err != nil {
+		return nil, err
+	}
+	return &DposContext{epochTrie: epochTrie, db: db}, nil
+}
+
+// Copy returns an independent copy of the context. The copy shares the
+// immutable trie nodes with the original, so copying is cheap.
 func (d *DposContext) Copy() *DposContext {
-	epochTrie := *d.epochTrie
-	delegateTrie := *d.delegateTrie
-	voteTrie := *d.voteTrie
-	candidateTrie := *d.candidateTrie
-	mintCntTrie := *d.mintCntTrie
 	return &DposContext{
-		epochTrie:     &epochTrie,
-		delegateTrie:  &delegateTrie,
-		voteTrie:      &voteTrie,
-		candidateTrie: &candidateTrie,
-		mintCntTrie:   &mintCntTrie,
+		epochTrie:     copyTrie(d.epochTrie),
+		delegateTrie:  copyTrie(d.delegateTrie),
+		voteTrie:      copyTrie(d.voteTrie),
+		candidateTrie: copyTrie(d.candidateTrie),
+		mintCntTrie:   copyTrie(d.mintCntTrie),
+		db:            d.db,
 	}
 }
 
+// copyTrie copies a trie, keeping the tries left out of epoch trie only
+// contexts absent.
+func copyTrie(t *trie.Trie) *trie.Trie {
+	if t == nil {
+		return nil
+	}
+	cpy := *t
+	return &cpy
+}
+
+// Root hashes the roots of the five dpos tries. Per-epoch data, like the
+// validators, rewards and election inputs of past epochs, is kept in the epoch
+// trie, so the root covers it without further tries. Elections before the
+// EpochHistoryBlock renew the epoch trie, and with it drop that data from the
+// root again.
 func (d *DposContext) Root() (h common.Hash) {
 	hw := sha3.NewKeccak256()
 	rlp.Encode(hw, d.epochTrie.Hash())
@@ -147,6 +224,18 @@ func (d *DposContext) RevertToSnapShot(snapshot *DposContext) {
 	d.candidateTrie = snapshot.candidateTrie
 	d.voteTrie = snapshot.voteTrie
 	d.mintCntTrie = snapshot.mintCntTrie
+	d.db = snapshot.db
+}
+
+// WithSnapshot runs fn as a single atomic unit: if fn returns an error, every
+// change it made to the tries is reverted and the error is returned.
+func (d *DposContext) WithSnapshot(fn func() error) error {
+	snapshot := d.Snapshot()
+	if err := fn(); err != nil {
+		d.RevertToSnapShot(snapshot)
+		return err
+	}
+	return nil
 }
 
 func (d *DposContext) FromProto(dcp *DposContextProto) error {
@@ -203,16 +292,36 @@ func (p *DposContextProto) Root() (h common.Hash) {
 
 func (d *DposContext) KickoutCandidate(candidateAddr common.Address) error {
 	candidate := candidateAddr.Bytes()
-	err := d.candidateTrie.TryDelete(candidate)
+	count, err := d.CountCandidates()
+	if err != nil {
+		return err
+	}
+	if existing, err := d.candidateTrie.TryGet(candidate); err == nil && existing != nil {
+		if err := d.setCandidateCount(count - 1); err != nil {
+			return err
+		}
+	}
+	err = d.candidateTrie.TryDelete(candidate)
 	if err != nil {
 		if _, ok := err.(*trie.MissingNodeError); !ok {
 			return err
 		}
 	}
+	if err := d.epochTrie.TryDelete(payoutKey(candidateAddr)); err != nil {
+		return err
+	}
+	if err := d.epochTrie.TryDelete(delegatorCountKey(candidateAddr)); err != nil {
+		return err
+	}
+	// delegators are visited in ascending address order, though removing
+	// them doesn't depend on the order anyway
 	iter := trie.NewIterator(d.delegateTrie.PrefixIterator(candidate))
 	for iter.Next() {
 		delegator := iter.Value
-		key := append(candidate, delegator...)
+		key, err := delegateKey(candidate, delegator)
+		if err != nil {
+			return err
+		}
 		err = d.delegateTrie.TryDelete(key)
 		if err != nil {
 			if _, ok := err.(*trie.MissingNodeError); !ok {
@@ -225,7 +334,7 @@ func (d *DposContext) KickoutCandidate(candidateAddr common.Address) error {
 				return err
 			}
 		}
-		if err == nil && bytes.Equal(v, candidate) {
+		if votedCandidate, _ := splitVote(v); err == nil && bytes.Equal(votedCandidate, candidate) {
 			err = d.voteTrie.TryDelete(delegator)
 			if err != nil {
 				if _, ok := err.(*trie.MissingNodeError); !ok {
@@ -240,9 +349,274 @@ func (d *DposContext) KickoutCandidate(candidateAddr common.Address) error {
 func (d *DposContext) BecomeCandidate(candidateAddr common.Address) error {
 	// 当出块前检查内部交易类型，如果类型为1（RegCandidate）更新候选人树(数据库)
 	candidate := candidateAddr.Bytes()
+	existing, err := d.candidateTrie.TryGet(candidate)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		count, err := d.CountCandidates()
+		if err != nil {
+			return err
+		}
+		if err := d.setCandidateCount(count + 1); err != nil {
+			return err
+		}
+	}
 	return d.candidateTrie.TryUpdate(candidate, candidate)
 }
 
+// BatchBecomeCandidate is like calling BecomeCandidate for every address, but
+// reads and writes the candidate count once and commits the context once, which
+// makes seeding many candidates, as in genesis, much cheaper.
+func (d *DposContext) BatchBecomeCandidate(candidateAddrs []common.Address) error {
+	count, err := d.CountCandidates()
+	if err != nil {
+		return err
+	}
+	added := 0
+	for _, candidateAddr := range candidateAddrs {
+		candidate := candidateAddr.Bytes()
+		existing, err := d.candidateTrie.TryGet(candidate)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			added++
+		}
+		if err := d.candidateTrie.TryUpdate(candidate, candidate); err != nil {
+			return err
+		}
+	}
+	if added > 0 {
+		if err := d.setCandidateCount(count + added); err != nil {
+			return err
+		}
+	}
+	_, err = d.Commit()
+	return err
+}
+
+// candidateEntry is a candidate trie entry in an export of the candidates.
+type candidateEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// ExportCandidates serializes the contents of the candidate trie, in trie
+// order, for ImportCandidates.
+func (d *DposContext) ExportCandidates() ([]byte, error) {
+	entries := make([]candidateEntry, 0)
+	iter := trie.NewIterator(d.candidateTrie.NodeIterator(nil))
+	for iter.Next() {
+		entries = append(entries, candidateEntry{Key: iter.Key[len(candidatePrefix):], Value: iter.Value})
+	}
+	if iter.Err != nil {
+		return nil, iter.Err
+	}
+	return rlp.EncodeToBytes(entries)
+}
+
+// ImportCandidates replaces the candidate trie with the candidates exported by
+// ExportCandidates, and updates the candidate count, if kept, to match. The delegate,
+// vote and mint count tries are left untouched, so votes for candidates that
+// aren't imported stay in place but aren't counted in elections. Nothing is
+// changed if the export is invalid.
+func (d *DposContext) ImportCandidates(data []byte) error {
+	var entries []candidateEntry
+	if err := rlp.DecodeBytes(data, &entries); err != nil {
+		return err
+	}
+	candidateTrie, err := NewCandidateTrie(common.Hash{}, d.db)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if len(entry.Key) != common.AddressLength || !bytes.HasSuffix(entry.Value, entry.Key) ||
+			(len(entry.Value) != common.AddressLength && len(entry.Value) != 8+common.AddressLength) {
+			return ErrInvalidCandidateExport
+		}
+		if err := candidateTrie.TryUpdate(entry.Key, entry.Value); err != nil {
+			return err
+		}
+	}
+	d.candidateTrie = candidateTrie
+	return d.setCandidateCount(len(entries))
+}
+
+// RegisterCandidateAt is like RegisterCandidate, but rejects addresses that left
+// the candidates less than cooldown epochs before epoch.
+func (d *DposContext) RegisterCandidateAt(candidateAddr common.Address, epoch, cooldown int64) error {
+	if err := d.CheckReRegisterCooldown(candidateAddr, epoch, cooldown); err != nil {
+		return err
+	}
+	return d.RegisterCandidate(candidateAddr, epoch)
+}
+
+// CheckReRegisterCooldown returns ErrReRegisterTooSoon if the address left the
+// candidates less than cooldown epochs before epoch.
+func (d *DposContext) CheckReRegisterCooldown(candidateAddr common.Address, epoch, cooldown int64) error {
+	if cooldown <= 0 {
+		return nil
+	}
+	left, err := d.epochTrie.TryGet(candidateLeftKey(candidateAddr))
+	if err != nil {
+		return err
+	}
+	if len(left) == 8 && epoch-int64(binary.BigEndian.Uint64(left)) < cooldown {
+		return ErrReRegisterTooSoon
+	}
+	return nil
+}
+
+// KickoutCandidateAt is like KickoutCandidate, but records the epoch the
+// candidate left in for RegisterCandidateAt to enforce the cooldown. Nothing is
+// recorded without a cooldown or if the address wasn't a candidate.
+func (d *DposContext) KickoutCandidateAt(candidateAddr common.Address, epoch, cooldown int64) error {
+	if cooldown > 0 {
+		registered, err := d.candidateTrie.TryGet(candidateAddr.Bytes())
+		if err != nil {
+			return err
+		}
+		if registered != nil {
+			left := make([]byte, 8)
+			binary.BigEndian.PutUint64(left, uint64(epoch))
+			if err := d.epochTrie.TryUpdate(candidateLeftKey(candidateAddr), left); err != nil {
+				return err
+			}
+		}
+	}
+	return d.KickoutCandidate(candidateAddr)
+}
+
+func candidateLeftKey(candidate common.Address) []byte {
+	return append([]byte("left-"), candidate.Bytes()...)
+}
+
+// RegisterCandidate registers the candidate and records the epoch it registered
+// in, which is kept as an 8 byte big endian prefix of the candidate trie value.
+// Re-registering an existing candidate doesn't reset its registration epoch.
+func (d *DposContext) RegisterCandidate(candidateAddr common.Address, epoch int64) error {
+	candidate := candidateAddr.Bytes()
+	candidateInTrie, err := d.candidateTrie.TryGet(candidate)
+	if err != nil {
+		return err
+	}
+	if candidateInTrie != nil {
+		return nil
+	}
+	count, err := d.CountCandidates()
+	if err != nil {
+		return err
+	}
+	if err := d.setCandidateCount(count + 1); err != nil {
+		return err
+	}
+	value := make([]byte, 8, 8+common.AddressLength)
+	binary.BigEndian.PutUint64(value, uint64(epoch))
+	return d.candidateTrie.TryUpdate(candidate, append(value, candidate...))
+}
+
+// CountCandidates returns the number of registered candidates. The count is
+// kept in the epoch trie once KeepCounts was called, before the candidates are
+// counted by iterating the candidate trie.
+func (d *DposContext) CountCandidates() (int, error) {
+	value, err := d.epochTrie.TryGet([]byte("candidate-count"))
+	if err != nil {
+		return 0, err
+	}
+	if len(value) == 8 {
+		return int(binary.BigEndian.Uint64(value)), nil
+	}
+	if d.candidateTrie == nil {
+		return 0, errors.New("candidates not counted and candidate trie not loaded")
+	}
+	count := 0
+	iter := trie.NewIterator(d.candidateTrie.NodeIterator(nil))
+	for iter.Next() {
+		count++
+	}
+	return count, iter.Err
+}
+
+// KeepCounts starts keeping running candidate and delegator counts in the
+// epoch trie. The delegator counts are filled in lazily as votes change.
+func (d *DposContext) KeepCounts() error {
+	if d.countsKept() {
+		return nil
+	}
+	count, err := d.CountCandidates()
+	if err != nil {
+		return err
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(count))
+	return d.epochTrie.TryUpdate([]byte("candidate-count"), value)
+}
+
+// countsKept reports whether KeepCounts was called on the epoch trie.
+func (d *DposContext) countsKept() bool {
+	value, err := d.epochTrie.TryGet([]byte("candidate-count"))
+	return err == nil && len(value) == 8
+}
+
+func (d *DposContext) setCandidateCount(count int) error {
+	if !d.countsKept() {
+		return nil
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(count))
+	return d.epochTrie.TryUpdate([]byte("candidate-count"), value)
+}
+
+// DelegatorCount returns the number of delegators voting for the candidate.
+// The count is kept in the epoch trie once KeepCounts was called, before, or if
+// the candidate's votes didn't change since, the delegators are counted by
+// iterating the delegate trie.
+func (d *DposContext) DelegatorCount(candidateAddr common.Address) (int, error) {
+	value, err := d.epochTrie.TryGet(delegatorCountKey(candidateAddr))
+	if err != nil {
+		return 0, err
+	}
+	if len(value) == 8 {
+		return int(binary.BigEndian.Uint64(value)), nil
+	}
+	count := 0
+	iter := trie.NewIterator(d.delegateTrie.PrefixIterator(candidateAddr.Bytes()))
+	for iter.Next() {
+		count++
+	}
+	return count, iter.Err
+}
+
+func (d *DposContext) setDelegatorCount(candidateAddr common.Address, count int) error {
+	if !d.countsKept() {
+		return nil
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(count))
+	return d.epochTrie.TryUpdate(delegatorCountKey(candidateAddr), value)
+}
+
+func delegatorCountKey(candidate common.Address) []byte {
+	return append([]byte("delegators-"), candidate.Bytes()...)
+}
+
+// CandidateEpoch returns the epoch the candidate registered in. Candidates
+// registered without an epoch are reported as registered in epoch 0.
+func (d *DposContext) CandidateEpoch(candidateAddr common.Address) (int64, error) {
+	value, err := d.candidateTrie.TryGet(candidateAddr.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		return 0, errors.New("invalid candidate")
+	}
+	if len(value) == 8+common.AddressLength {
+		return int64(binary.BigEndian.Uint64(value[:8])), nil
+	}
+	return 0, nil
+}
+
 //用户投票
 func (d *DposContext) Delegate(delegatorAddr, candidateAddr common.Address) error {
 	delegator, candidate := delegatorAddr.Bytes(), candidateAddr.Bytes()
@@ -266,12 +640,38 @@ func (d *DposContext) Delegate(delegatorAddr, candidateAddr common.Address) erro
 		}
 	}
 	if oldCandidate != nil {
-		d.delegateTrie.Delete(append(oldCandidate, delegator...))
+		oldCandidate, _ = splitVote(oldCandidate)
+		// voting again for the same candidate leaves the vote, and the time
+		// it was cast at, as is
+		if bytes.Equal(oldCandidate, candidate) {
+			return nil
+		}
+		oldKey, err := delegateKey(oldCandidate, delegator)
+		if err != nil {
+			return err
+		}
+		oldCount, err := d.DelegatorCount(common.BytesToAddress(oldCandidate))
+		if err != nil {
+			return err
+		}
+		d.delegateTrie.Delete(oldKey)
+		if oldCount > 0 {
+			if err := d.setDelegatorCount(common.BytesToAddress(oldCandidate), oldCount-1); err != nil {
+				return err
+			}
+		}
+	}
+	count, err := d.DelegatorCount(candidateAddr)
+	if err != nil {
+		return err
 	}
 	// 更新候选人对应的授权列表
 	if err = d.delegateTrie.TryUpdate(append(candidate, delegator...), delegator); err != nil {
 		return err
 	}
+	if err := d.setDelegatorCount(candidateAddr, count+1); err != nil {
+		return err
+	}
 	//更新投票人对应的候选人列表
 	return d.voteTrie.TryUpdate(delegator, candidate)
 }
@@ -296,11 +696,21 @@ func (d *DposContext) UnDelegate(delegatorAddr, candidateAddr common.Address) er
 	if err != nil {
 		return err
 	}
+	oldCandidate, _ = splitVote(oldCandidate)
 
 	//检查所取消投票的候选人是否在VoteTrie（投票人对应投票候选人列表中）
 	if !bytes.Equal(candidate, oldCandidate) {
 		return errors.New("mismatch candidate to undelegate")
 	}
+	count, err := d.DelegatorCount(candidateAddr)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		if err := d.setDelegatorCount(candidateAddr, count-1); err != nil {
+			return err
+		}
+	}
 
 	// 删除候选人对应投票人的列表中
 	if err = d.delegateTrie.TryDelete(append(candidate, delegator...)); err != nil {
@@ -311,38 +721,166 @@ func (d *DposContext) UnDelegate(delegatorAddr, candidateAddr common.Address) er
 }
 
 
+// DelegateAt is like Delegate, but records the time of the vote and rejects
+// changing an existing vote within cooldown seconds of its last change. Voting
+// again for the current candidate is a no-op that keeps the time of the vote.
+func (d *DposContext) DelegateAt(delegatorAddr, candidateAddr common.Address, timestamp, cooldown int64) error {
+	if current, err := d.GetVote(delegatorAddr); err == nil && current == candidateAddr {
+		return nil
+	}
+	if err := d.checkVoteCooldown(delegatorAddr, timestamp, cooldown); err != nil {
+		return err
+	}
+	if err := d.Delegate(delegatorAddr, candidateAddr); err != nil {
+		return err
+	}
+	vote := make([]byte, 8, 8+common.AddressLength)
+	binary.BigEndian.PutUint64(vote, uint64(timestamp))
+	return d.voteTrie.TryUpdate(delegatorAddr.Bytes(), append(vote, candidateAddr.Bytes()...))
+}
+
+// UnDelegateAt is like UnDelegate, but rejects withdrawing a vote within
+// cooldown seconds of its last change.
+func (d *DposContext) UnDelegateAt(delegatorAddr, candidateAddr common.Address, timestamp, cooldown int64) error {
+	if err := d.checkVoteCooldown(delegatorAddr, timestamp, cooldown); err != nil {
+		return err
+	}
+	return d.UnDelegate(delegatorAddr, candidateAddr)
+}
+
+// checkVoteCooldown returns ErrVoteChangeTooSoon if the delegator's current vote
+// was cast less than cooldown seconds before timestamp.
+func (d *DposContext) checkVoteCooldown(delegatorAddr common.Address, timestamp, cooldown int64) error {
+	if cooldown <= 0 {
+		return nil
+	}
+	vote, err := d.voteTrie.TryGet(delegatorAddr.Bytes())
+	if err != nil {
+		return err
+	}
+	if vote == nil {
+		return nil
+	}
+	if _, last := splitVote(vote); timestamp-last < cooldown {
+		return ErrVoteChangeTooSoon
+	}
+	return nil
+}
+
+// GetVote returns the candidate the delegator votes for, or the zero address if
+// it doesn't vote.
+func (d *DposContext) GetVote(delegatorAddr common.Address) (common.Address, error) {
+	vote, err := d.voteTrie.TryGet(delegatorAddr.Bytes())
+	if err != nil || vote == nil {
+		return common.Address{}, err
+	}
+	candidate, _ := splitVote(vote)
+	return common.BytesToAddress(candidate), nil
+}
+
+// GetVoteTime returns the time the delegator cast its current vote at, or 0 if
+// it doesn't vote or the vote was recorded without a time.
+func (d *DposContext) GetVoteTime(delegatorAddr common.Address) (int64, error) {
+	vote, err := d.voteTrie.TryGet(delegatorAddr.Bytes())
+	if err != nil || vote == nil {
+		return 0, err
+	}
+	_, timestamp := splitVote(vote)
+	return timestamp, nil
+}
+
+// splitVote splits a vote trie value into a copy of the voted candidate and the
+// time of the vote. Votes recorded without a time are reported with time 0.
+func splitVote(vote []byte) (candidate []byte, timestamp int64) {
+	if len(vote) == 8+common.AddressLength {
+		return common.CopyBytes(vote[8:]), int64(binary.BigEndian.Uint64(vote[:8]))
+	}
+	return common.CopyBytes(vote), 0
+}
+
+// Validate checks that the vote and delegate tries agree: every vote has the
+// matching delegate entry and every delegate entry the matching vote. It walks
+// both tries in full, so it is meant for debugging rather than every block.
+func (d *DposContext) Validate() error {
+	votes := trie.NewIterator(d.voteTrie.NodeIterator(nil))
+	for votes.Next() {
+		delegator := votes.Key[len(votePrefix):]
+		candidate, _ := splitVote(votes.Value)
+		key, err := delegateKey(candidate, delegator)
+		if err != nil {
+			return fmt.Errorf("invalid vote of %x: %v", delegator, err)
+		}
+		delegate, err := d.delegateTrie.TryGet(key)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(delegate, delegator) {
+			return fmt.Errorf("vote of %x for %x has no delegate entry", delegator, candidate)
+		}
+	}
+	if votes.Err != nil {
+		return votes.Err
+	}
+	delegates := trie.NewIterator(d.delegateTrie.NodeIterator(nil))
+	for delegates.Next() {
+		key := delegates.Key[len(delegatePrefix):]
+		if len(key) != 2*common.AddressLength || !bytes.Equal(key[common.AddressLength:], delegates.Value) {
+			return fmt.Errorf("invalid delegate entry %x", key)
+		}
+		candidate := key[:common.AddressLength]
+		vote, err := d.voteTrie.TryGet(delegates.Value)
+		if err != nil {
+			return err
+		}
+		if voted, _ := splitVote(vote); !bytes.Equal(voted, candidate) {
+			return fmt.Errorf("delegate entry of %x for %x has no matching vote", delegates.Value, candidate)
+		}
+	}
+	return delegates.Err
+}
+
 func (d *DposContext) Commit() (*DposContextProto, error) {
+	start := time.Now()
+	defer dposCommitTimer.UpdateSince(start)
+
+	// written reports the number of trie nodes added to the database since the
+	// previous call, used to log how much each trie contributes to the commit.
+	dirty := len(d.db.Nodes())
+	written := func() int {
+		prev := dirty
+		dirty = len(d.db.Nodes())
+		return dirty - prev
+	}
 
 	epochRoot, err := d.epochTrie.Commit(nil)
 	if err != nil {
 		return nil, err
 	}
-	d.epochTrie.TryUpdate(epochRoot[:], d.epochTrie.Get(epochRoot[:]))
-
+	epochNodes := written()
 
 	delegateRoot, err := d.delegateTrie.Commit(nil)
 	if err != nil {
 		return nil, err
 	}
-	d.delegateTrie.TryUpdate(delegateRoot[:], d.delegateTrie.Get(delegateRoot[:]))
+	delegateNodes := written()
 
 	voteRoot, err := d.voteTrie.Commit(nil)
 	if err != nil {
 		return nil, err
 	}
-	d.voteTrie.TryUpdate(voteRoot[:], d.voteTrie.Get(voteRoot[:]))
+	voteNodes := written()
 
 	candidateRoot, err := d.candidateTrie.Commit(nil)
 	if err != nil {
 		return nil, err
 	}
-	d.candidateTrie.TryUpdate(candidateRoot[:], d.candidateTrie.Get(candidateRoot[:]))
+	candidateNodes := written()
 
 	mintCntRoot, err := d.mintCntTrie.Commit(nil)
 	if err != nil {
 		return nil, err
 	}
-	d.mintCntTrie.TryUpdate(mintCntRoot[:], d.mintCntTrie.Get(mintCntRoot[:]))
+	mintCntNodes := written()
 
 	d.db.Commit(epochRoot,true)
 	d.db.Commit(delegateRoot,true)
@@ -350,6 +888,9 @@ func (d *DposContext) Commit() (*DposContextProto, error) {
 	d.db.Commit(voteRoot,true)
 	d.db.Commit(mintCntRoot,true)
 
+	log.Debug("Committed dpos context", "epoch", epochNodes, "delegate", delegateNodes, "vote", voteNodes,
+		"candidate", candidateNodes, "mintCnt", mintCntNodes, "elapsed", common.PrettyDuration(time.Since(start)))
+
 	return &DposContextProto{
 		EpochHash:     epochRoot,
 		DelegateHash:  delegateRoot,
@@ -371,6 +912,8 @@ func (dc *DposContext) SetVote(vote *trie.Trie)           { dc.voteTrie = vote }
 func (dc *DposContext) SetCandidate(candidate *trie.Trie) { dc.candidateTrie = candidate }
 func (dc *DposContext) SetMintCnt(mintCnt *trie.Trie)     { dc.mintCntTrie = mintCnt }
 
+// GetValidators returns the validators of the current epoch in the order they
+// take turns producing blocks.
 func (dc *DposContext) GetValidators() ([]common.Address, error) {
 	var validators []common.Address
 	key := []byte("validator")
@@ -381,6 +924,9 @@ func (dc *DposContext) GetValidators() ([]common.Address, error) {
 	return validators, nil
 }
 
+// SetValidators stores the validators of the current epoch. The order is kept
+// as given since it is the slot schedule of the epoch, callers have to pass a
+// deterministic one.
 func (dc *DposContext) SetValidators(validators []common.Address) error {
 	key := []byte("validator")
 	validatorsRLP, err := rlp.EncodeToBytes(validators)
@@ -390,3 +936,428 @@ func (dc *DposContext) SetValidators(validators []common.Address) error {
 	dc.epochTrie.Update(key, validatorsRLP)
 	return nil
 }
+
+// GetEpochValidators returns the validators elected for the given epoch.
+func (dc *DposContext) GetEpochValidators(epoch int64) ([]common.Address, error) {
+	var validators []common.Address
+	validatorsRLP := dc.epochTrie.Get(epochValidatorsKey(epoch))
+	if validatorsRLP == nil {
+		return nil, fmt.Errorf("no validators recorded for epoch %d", epoch)
+	}
+	if err := rlp.DecodeBytes(validatorsRLP, &validators); err != nil {
+		return nil, fmt.Errorf("failed to decode validators: %s", err)
+	}
+	return validators, nil
+}
+
+// SetEpochValidators records the validators elected for the given epoch. Unlike
+// the current validator list the record is kept across elections, until the
+// epoch leaves the history window.
+func (dc *DposContext) SetEpochValidators(epoch int64, validators []common.Address) error {
+	validatorsRLP, err := rlp.EncodeToBytes(validators)
+	if err != nil {
+		return fmt.Errorf("failed to encode validators to rlp bytes: %s", err)
+	}
+	dc.epochTrie.Update(epochValidatorsKey(epoch), validatorsRLP)
+	return nil
+}
+
+// CandidateWeight is a candidate as it stood for election: its vote weight and
+// the epoch it registered in, which breaks ties between equal weights.
+type CandidateWeight struct {
+	Address    common.Address `json:"address"`
+	Weight     *big.Int       `json:"weight"`
+	Registered uint64         `json:"registered"`
+}
+
+// GetElectionInput returns the candidates the election of the given epoch was
+// held among, ordered by their standing in the election.
+func (dc *DposContext) GetElectionInput(epoch int64) ([]CandidateWeight, error) {
+	var candidates []CandidateWeight
+	inputRLP := dc.epochTrie.Get(electionInputKey(epoch))
+	if inputRLP == nil {
+		return nil, fmt.Errorf("no election input recorded for epoch %d", epoch)
+	}
+	if err := rlp.DecodeBytes(inputRLP, &candidates); err != nil {
+		return nil, fmt.Errorf("failed to decode election input: %s", err)
+	}
+	return candidates, nil
+}
+
+// SetElectionInput records the candidates the election of the given epoch is
+// held among, so the election can be reproduced later on.
+func (dc *DposContext) SetElectionInput(epoch int64, candidates []CandidateWeight) error {
+	inputRLP, err := rlp.EncodeToBytes(candidates)
+	if err != nil {
+		return fmt.Errorf("failed to encode election input to rlp bytes: %s", err)
+	}
+	return dc.epochTrie.TryUpdate(electionInputKey(epoch), inputRLP)
+}
+
+func electionInputKey(epoch int64) []byte {
+	key := make([]byte, len("input-")+8)
+	copy(key, "input-")
+	binary.BigEndian.PutUint64(key[len("input-"):], uint64(epoch))
+	return key
+}
+
+// VoteChange is a change of the vote of a delegator. From is the zero address
+// for a first vote, To for a withdrawn one.
+type VoteChange struct {
+	Time uint64         `json:"time"`
+	From common.Address `json:"from"`
+	To   common.Address `json:"to"`
+}
+
+// GetVoteHistory returns the recorded vote changes of the delegator, oldest
+// first.
+func (dc *DposContext) GetVoteHistory(delegatorAddr common.Address) ([]VoteChange, error) {
+	historyRLP, err := dc.epochTrie.TryGet(voteHistoryKey(delegatorAddr))
+	if err != nil || historyRLP == nil {
+		return nil, err
+	}
+	var history []VoteChange
+	if err := rlp.DecodeBytes(historyRLP, &history); err != nil {
+		return nil, fmt.Errorf("failed to decode vote history: %s", err)
+	}
+	return history, nil
+}
+
+// RecordVoteChange appends the change to the vote history of the delegator,
+// dropping the oldest changes beyond the limit.
+func (dc *DposContext) RecordVoteChange(delegatorAddr common.Address, change VoteChange, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+	history, err := dc.GetVoteHistory(delegatorAddr)
+	if err != nil {
+		return err
+	}
+	history = append(history, change)
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	historyRLP, err := rlp.EncodeToBytes(history)
+	if err != nil {
+		return fmt.Errorf("failed to encode vote history to rlp bytes: %s", err)
+	}
+	return dc.epochTrie.TryUpdate(voteHistoryKey(delegatorAddr), historyRLP)
+}
+
+func voteHistoryKey(delegator common.Address) []byte {
+	return append([]byte("history-"), delegator.Bytes()...)
+}
+
+// ValidatorDiff returns the validators which joined and left the validator set
+// between the two epochs, both sorted by address.
+func (dc *DposContext) ValidatorDiff(prevEpoch, curEpoch int64) (added, removed []common.Address, err error) {
+	prev, err := dc.GetEpochValidators(prevEpoch)
+	if err != nil {
+		return nil, nil, err
+	}
+	cur, err := dc.GetEpochValidators(curEpoch)
+	if err != nil {
+		return nil, nil, err
+	}
+	added, removed = []common.Address{}, []common.Address{}
+	prevSet := make(map[common.Address]bool, len(prev))
+	for _, validator := range prev {
+		prevSet[validator] = true
+	}
+	curSet := make(map[common.Address]bool, len(cur))
+	for _, validator := range cur {
+		curSet[validator] = true
+		if !prevSet[validator] {
+			added = append(added, validator)
+		}
+	}
+	for _, validator := range prev {
+		if !curSet[validator] {
+			removed = append(removed, validator)
+		}
+	}
+	sortAddresses(added)
+	sortAddresses(removed)
+	return added, removed, nil
+}
+
+// Epochs returns the epochs election data is stored for, the validator set or
+// the election input, in ascending order. States predating the per epoch
+// records only hold the current validator set and report no epochs.
+func (dc *DposContext) Epochs() ([]int64, error) {
+	seen := make(map[int64]bool)
+	for _, prefix := range []string{"validator-", "input-"} {
+		iter := trie.NewIterator(dc.epochTrie.PrefixIterator([]byte(prefix)))
+		for iter.Next() {
+			// keys carry the trie prefix, the epoch is in the trailing bytes
+			if len(iter.Key) != len(epochPrefix)+len(prefix)+8 {
+				continue
+			}
+			seen[int64(binary.BigEndian.Uint64(iter.Key[len(iter.Key)-8:]))] = true
+		}
+		if iter.Err != nil {
+			return nil, iter.Err
+		}
+	}
+	epochs := make([]int64, 0, len(seen))
+	for epoch := range seen {
+		epochs = append(epochs, epoch)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+	return epochs, nil
+}
+
+func epochValidatorsKey(epoch int64) []byte {
+	key := make([]byte, len("validator-")+8)
+	copy(key, "validator-")
+	binary.BigEndian.PutUint64(key[len("validator-"):], uint64(epoch))
+	return key
+}
+
+// PruneEpochHistory drops the validators, election input and rewards recorded
+// for the given epoch.
+func (dc *DposContext) PruneEpochHistory(epoch int64) error {
+	for _, key := range [][]byte{epochValidatorsKey(epoch), electionInputKey(epoch), epochRewardKey(epoch)} {
+		if err := dc.epochTrie.TryDelete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenewEpochTrie replaces the epoch trie with an empty one, carrying over the
+// per account settings: payout addresses, the epochs candidates left in and
+// vote histories.
+func (dc *DposContext) RenewEpochTrie() error {
+	renewed, err := NewEpochTrie(common.Hash{}, dc.db)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range []string{"payout-", "left-", "history-"} {
+		iter := trie.NewIterator(dc.epochTrie.PrefixIterator([]byte(prefix)))
+		for iter.Next() {
+			if err := renewed.TryUpdate(iter.Key[len(epochPrefix):], iter.Value); err != nil {
+				return err
+			}
+		}
+		if iter.Err != nil {
+			return iter.Err
+		}
+	}
+	dc.epochTrie = renewed
+	return nil
+}
+
+// ExpireDepartures drops the epochs candidates left in once they no longer bar
+// them from registering again in the given epoch.
+func (dc *DposContext) ExpireDepartures(epoch, cooldown int64) error {
+	var expired [][]byte
+	iter := trie.NewIterator(dc.epochTrie.PrefixIterator([]byte("left-")))
+	for iter.Next() {
+		if len(iter.Value) != 8 || epoch-int64(binary.BigEndian.Uint64(iter.Value)) >= cooldown {
+			expired = append(expired, common.CopyBytes(iter.Key[len(epochPrefix):]))
+		}
+	}
+	if iter.Err != nil {
+		return iter.Err
+	}
+	for _, key := range expired {
+		if err := dc.epochTrie.TryDelete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortAddresses(addresses []common.Address) {
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes.Compare(addresses[i][:], addresses[j][:]) < 0
+	})
+}
+
+// GetEpochReward returns the total rewards paid to validators in the given
+// epoch, block subsidies and transaction fees alike.
+func (dc *DposContext) GetEpochReward(epoch int64) (*big.Int, error) {
+	value, err := dc.epochTrie.TryGet(epochRewardKey(epoch))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(value), nil
+}
+
+// AddEpochReward adds a reward paid in the given epoch to its total.
+func (dc *DposContext) AddEpochReward(epoch int64, reward *big.Int) error {
+	total, err := dc.GetEpochReward(epoch)
+	if err != nil {
+		return err
+	}
+	return dc.epochTrie.TryUpdate(epochRewardKey(epoch), total.Add(total, reward).Bytes())
+}
+
+func epochRewardKey(epoch int64) []byte {
+	key := make([]byte, len("reward-")+8)
+	copy(key, "reward-")
+	binary.BigEndian.PutUint64(key[len("reward-"):], uint64(epoch))
+	return key
+}
+
+// GetPayout returns the address the block rewards of the validator are paid
+// to, or the zero address if it didn't set one.
+func (dc *DposContext) GetPayout(validator common.Address) (common.Address, error) {
+	value, err := dc.epochTrie.TryGet(payoutKey(validator))
+	if err != nil {
+		return common.Address{}, err
+	}
+	return common.BytesToAddress(value), nil
+}
+
+// SetPayout sets the address the block rewards of the candidate are paid to,
+// the zero address restores paying the block coinbase.
+func (dc *DposContext) SetPayout(candidate, payout common.Address) error {
+	registered, err := dc.candidateTrie.TryGet(candidate.Bytes())
+	if err != nil {
+		return err
+	}
+	if registered == nil {
+		return errors.New("invalid candidate to set payout")
+	}
+	if payout == (common.Address{}) {
+		return dc.epochTrie.TryDelete(payoutKey(candidate))
+	}
+	return dc.epochTrie.TryUpdate(payoutKey(candidate), payout.Bytes())
+}
+
+// delegateKey returns the delegate trie key of the vote of delegator for
+// candidate, rejecting either if it isn't exactly an address long so a
+// malformed entry can't be mistaken for the key of a different vote.
+func delegateKey(candidate, delegator []byte) ([]byte, error) {
+	if len(candidate) != common.AddressLength || len(delegator) != common.AddressLength {
+		return nil, ErrInvalidDelegateKey
+	}
+	key := make([]byte, 0, 2*common.AddressLength)
+	return append(append(key, candidate...), delegator...), nil
+}
+
+func payoutKey(candidate common.Address) []byte {
+	return append([]byte("payout-"), candidate.Bytes()...)
+}
+
+// GetValidatorRanks returns the validators of the epoch ordered by their vote
+// weight rank at election, highest first. It is empty if no ranks were recorded.
+func (dc *DposContext) GetValidatorRanks() ([]common.Address, error) {
+	var ranks []common.Address
+	ranksRLP := dc.epochTrie.Get([]byte("rank"))
+	if ranksRLP == nil {
+		return ranks, nil
+	}
+	if err := rlp.DecodeBytes(ranksRLP, &ranks); err != nil {
+		return nil, fmt.Errorf("failed to decode validator ranks: %s", err)
+	}
+	return ranks, nil
+}
+
+// SetValidatorRanks records the rank order of the elected validators, an empty
+// list clears it.
+func (dc *DposContext) SetValidatorRanks(ranks []common.Address) error {
+	if len(ranks) == 0 {
+		dc.epochTrie.Delete([]byte("rank"))
+		return nil
+	}
+	ranksRLP, err := rlp.EncodeToBytes(ranks)
+	if err != nil {
+		return fmt.Errorf("failed to encode validator ranks to rlp bytes: %s", err)
+	}
+	dc.epochTrie.Update([]byte("rank"), ranksRLP)
+	return nil
+}
+
+func overrideKey(epoch int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(epoch))
+	return append([]byte("override-"), key...)
+}
+
+// GetValidatorOverride returns the validator set admins forced for the election
+// of the epoch, nil if there is none.
+func (dc *DposContext) GetValidatorOverride(epoch int64) ([]common.Address, error) {
+	var validators []common.Address
+	validatorsRLP, err := dc.epochTrie.TryGet(overrideKey(epoch))
+	if err != nil || validatorsRLP == nil {
+		return nil, err
+	}
+	if err := rlp.DecodeBytes(validatorsRLP, &validators); err != nil {
+		return nil, fmt.Errorf("failed to decode validator override: %s", err)
+	}
+	return validators, nil
+}
+
+// SetValidatorOverride records the validator set to replace the election result
+// of the epoch with, an empty set clears it.
+func (dc *DposContext) SetValidatorOverride(epoch int64, validators []common.Address) error {
+	if len(validators) == 0 {
+		return dc.epochTrie.TryDelete(overrideKey(epoch))
+	}
+	validatorsRLP, err := rlp.EncodeToBytes(validators)
+	if err != nil {
+		return fmt.Errorf("failed to encode validator override to rlp bytes: %s", err)
+	}
+	return dc.epochTrie.TryUpdate(overrideKey(epoch), validatorsRLP)
+}
+
+// MintCntProof returns the mint count of the validator in the epoch as stored
+// in the mint count trie, nil if it didn't mint, along with a merkle proof of
+// the value against the root of the trie, the MintCntHash of the block.
+func (d *DposContext) MintCntProof(epoch int64, validator common.Address) (value []byte, proof [][]byte, err error) {
+	key := mintCntKey(epoch, validator)
+	if value, err = d.mintCntTrie.TryGet(key); err != nil {
+		return nil, nil, err
+	}
+	// the trie prefixes keys itself on lookups, proofs see the full key
+	nodes := new(proofNodes)
+	if err := d.mintCntTrie.Prove(append(common.CopyBytes(mintCntPrefix), key...), 0, nodes); err != nil {
+		return nil, nil, err
+	}
+	return value, nodes.list, nil
+}
+
+// VerifyMintCntProof checks a proof returned by MintCntProof against the mint
+// count trie root and returns the proven value, nil if the proof shows the
+// validator didn't mint in the epoch.
+func VerifyMintCntProof(root common.Hash, epoch int64, validator common.Address, proof [][]byte) ([]byte, error) {
+	nodes := &proofNodes{set: make(map[common.Hash][]byte)}
+	for _, node := range proof {
+		nodes.set[crypto.Keccak256Hash(node)] = node
+	}
+	value, _, err := trie.VerifyProof(root, append(common.CopyBytes(mintCntPrefix), mintCntKey(epoch, validator)...), nodes)
+	return value, err
+}
+
+func mintCntKey(epoch int64, validator common.Address) []byte {
+	key := make([]byte, 8, 8+common.AddressLength)
+	binary.BigEndian.PutUint64(key, uint64(epoch))
+	return append(key, validator.Bytes()...)
+}
+
+// proofNodes collects the nodes of a merkle proof in order, and serves them by
+// hash for verifying it.
+type proofNodes struct {
+	list [][]byte
+	set  map[common.Hash][]byte
+}
+
+func (p *proofNodes) Put(key []byte, value []byte) error {
+	p.list = append(p.list, common.CopyBytes(value))
+	return nil
+}
+
+func (p *proofNodes) Get(key []byte) ([]byte, error) {
+	if value, ok := p.set[common.BytesToHash(key)]; ok {
+		return value, nil
+	}
+	return nil, errors.New("proof node not found")
+}
+
+func (p *proofNodes) Has(key []byte) (bool, error) {
+	_, ok := p.set[common.BytesToHash(key)]
+	return ok, nil
+}
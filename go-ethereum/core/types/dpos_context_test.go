@@ -1,10 +1,16 @@
 package types
 
 import (
+	"bytes"
+	"math/big"
+	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/happytoken/go-ethereum/common"
 	"github.com/happytoken/go-ethereum/ethdb"
+	"github.com/happytoken/go-ethereum/metrics"
+	"github.com/happytoken/go-ethereum/rlp"
 	"github.com/happytoken/go-ethereum/trie"
 	"github.com/stretchr/testify/assert"
 )
@@ -17,7 +23,7 @@ func TestDposContextSnapshot(t *testing.T) {
 
 	snapshot := dposContext.Snapshot()
 	assert.Equal(t, dposContext.Root(), snapshot.Root())
-	assert.NotEqual(t, dposContext, snapshot)
+	assert.True(t, dposContext != snapshot)
 
 	// change dposContext
 	assert.Nil(t, dposContext.BecomeCandidate(common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6c")))
@@ -26,7 +32,7 @@ func TestDposContextSnapshot(t *testing.T) {
 	// revert snapshot
 	dposContext.RevertToSnapShot(snapshot)
 	assert.Equal(t, dposContext.Root(), snapshot.Root())
-	assert.NotEqual(t, dposContext, snapshot)
+	assert.True(t, dposContext != snapshot)
 }
 
 func TestDposContextBecomeCandidate(t *testing.T) {
@@ -95,6 +101,31 @@ func TestDposContextKickoutCandidate(t *testing.T) {
 	}
 }
 
+func TestDposContextMalformedDelegateKey(t *testing.T) {
+	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	delegator := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	dposContext, err := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+
+	// a delegate entry whose delegator isn't an address can't be kicked out
+	assert.Nil(t, dposContext.delegateTrie.TryUpdate(append(candidate.Bytes(), 1, 2, 3), []byte{1, 2, 3}))
+	assert.Equal(t, ErrInvalidDelegateKey, dposContext.KickoutCandidate(candidate))
+
+	// nor can a delegator whose recorded vote isn't an address vote again
+	dposContext, err = NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	assert.Nil(t, dposContext.voteTrie.TryUpdate(delegator.Bytes(), candidate.Bytes()[:10]))
+	assert.Equal(t, ErrInvalidDelegateKey, dposContext.Delegate(delegator, candidate))
+
+	key, err := delegateKey(candidate.Bytes(), delegator.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, append(candidate.Bytes(), delegator.Bytes()...), key)
+	_, err = delegateKey(candidate.Bytes(), append(delegator.Bytes(), 0))
+	assert.Equal(t, ErrInvalidDelegateKey, err)
+}
+
 func TestDposContextDelegateAndUnDelegate(t *testing.T) {
 	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
 	newCandidate := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
@@ -156,6 +187,42 @@ func TestDposContextDelegateAndUnDelegate(t *testing.T) {
 	assert.False(t, voteIter.Next())
 }
 
+func TestDposContextDelegatorOrder(t *testing.T) {
+	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	delegators := []common.Address{
+		common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2"),
+		common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670"),
+		common.HexToAddress("0xb040353ec0f2c113d5639444f7253681aecda1f8"),
+		common.HexToAddress("0x14723a09acff6d2a60dcdf7aa4aff308fddc160c"),
+	}
+	// build the same votes in opposite orders on separate databases
+	build := func(order []common.Address) []common.Address {
+		dposContext, err := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+		assert.Nil(t, err)
+		assert.Nil(t, dposContext.BecomeCandidate(candidate))
+		for _, delegator := range order {
+			assert.Nil(t, dposContext.Delegate(delegator, candidate))
+		}
+		var listed []common.Address
+		iter := trie.NewIterator(dposContext.delegateTrie.PrefixIterator(candidate.Bytes()))
+		for iter.Next() {
+			listed = append(listed, common.BytesToAddress(iter.Value))
+		}
+		return listed
+	}
+	reversed := make([]common.Address, len(delegators))
+	for i, delegator := range delegators {
+		reversed[len(delegators)-1-i] = delegator
+	}
+	forward, backward := build(delegators), build(reversed)
+	assert.Equal(t, forward, backward)
+	if assert.Len(t, forward, len(delegators)) {
+		for i := 1; i < len(forward); i++ {
+			assert.True(t, bytes.Compare(forward[i-1].Bytes(), forward[i].Bytes()) < 0)
+		}
+	}
+}
+
 func TestDposContextValidators(t *testing.T) {
 	validators := []common.Address{
 		common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e"),
@@ -172,12 +239,926 @@ func TestDposContextValidators(t *testing.T) {
 
 	result, err := dposContext.GetValidators()
 	assert.Nil(t, err)
-	assert.Equal(t, len(validators), len(result))
-	validatorMap := map[common.Address]bool{}
-	for _, validator := range validators {
-		validatorMap[validator] = true
+	assert.Equal(t, validators, result)
+
+	// the order is the slot schedule, it survives committing and reopening
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		reopened, err := NewDposContextFromProto(trieDB, proto)
+		assert.Nil(t, err)
+		result, err = reopened.GetValidators()
+		assert.Nil(t, err)
+		assert.Equal(t, validators, result)
+		assert.Nil(t, reopened.SetValidators(result))
+		assert.Equal(t, proto.EpochHash, reopened.EpochTrie().Hash())
+	}
+}
+
+func TestDposContextCommitMetric(t *testing.T) {
+	// metrics are disabled by default, swap in a live timer for the test
+	enabled, timer := metrics.Enabled, dposCommitTimer
+	metrics.Enabled = true
+	dposCommitTimer = metrics.NewTimer()
+	defer func() { metrics.Enabled, dposCommitTimer = enabled, timer }()
+
+	db := ethdb.NewMemDatabase()
+	trieDB := trie.NewDatabase(db)
+	dposContext, err := NewDposContext(trieDB)
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.BecomeCandidate(common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")))
+
+	assert.Equal(t, int64(0), dposCommitTimer.Count())
+	_, err = dposContext.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), dposCommitTimer.Count())
+}
+
+func TestDposContextWithSnapshot(t *testing.T) {
+	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	delegator := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	db := ethdb.NewMemDatabase()
+	trieDB := trie.NewDatabase(db)
+	dposContext, err := NewDposContext(trieDB)
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+
+	// fn fails midway, all changes are reverted
+	root := dposContext.Root()
+	proto := dposContext.ToProto()
+	err = dposContext.WithSnapshot(func() error {
+		if err := dposContext.BecomeCandidate(delegator); err != nil {
+			return err
+		}
+		if err := dposContext.Delegate(delegator, candidate); err != nil {
+			return err
+		}
+		return dposContext.UnDelegate(delegator, delegator)
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, root, dposContext.Root())
+	assert.Equal(t, proto, dposContext.ToProto())
+	assert.Equal(t, trieDB, dposContext.DB())
+
+	// the reverted context is still fully usable, including commits
+	_, err = dposContext.Commit()
+	assert.Nil(t, err)
+
+	// fn succeeds, all changes are kept
+	err = dposContext.WithSnapshot(func() error {
+		return dposContext.Delegate(delegator, candidate)
+	})
+	assert.Nil(t, err)
+	assert.NotEqual(t, root, dposContext.Root())
+	vote, err := dposContext.VoteTrie().TryGet(delegator.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, candidate.Bytes(), vote)
+}
+
+func TestDposContextSnapshotKeepsDatabase(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	trieDB := trie.NewDatabase(db)
+	dposContext, err := NewDposContext(trieDB)
+	assert.Nil(t, err)
+
+	snapshot := dposContext.Snapshot()
+	assert.Equal(t, trieDB, snapshot.DB())
+	_, err = snapshot.Commit()
+	assert.Nil(t, err)
+}
+
+func TestDposContextRegisterCandidate(t *testing.T) {
+	legacy := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	candidate := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	db := ethdb.NewMemDatabase()
+	trieDB := trie.NewDatabase(db)
+	dposContext, err := NewDposContext(trieDB)
+	assert.Nil(t, err)
+
+	// candidates registered without an epoch count as registered in epoch 0
+	assert.Nil(t, dposContext.BecomeCandidate(legacy))
+	epoch, err := dposContext.CandidateEpoch(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), epoch)
+
+	assert.Nil(t, dposContext.RegisterCandidate(candidate, 5))
+	epoch, err = dposContext.CandidateEpoch(candidate)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), epoch)
+
+	// re-registering keeps the original epoch
+	assert.Nil(t, dposContext.RegisterCandidate(candidate, 7))
+	epoch, err = dposContext.CandidateEpoch(candidate)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), epoch)
+
+	// the trie value still resolves to the candidate address and can be delegated to
+	assert.Equal(t, candidate, common.BytesToAddress(dposContext.candidateTrie.Get(candidate.Bytes())))
+	assert.Nil(t, dposContext.Delegate(legacy, candidate))
+
+	_, err = dposContext.CandidateEpoch(common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670"))
+	assert.NotNil(t, err)
+}
+
+func TestDposContextDelegatorCount(t *testing.T) {
+	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	newCandidate := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	delegators := []common.Address{
+		common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670"),
+		common.HexToAddress("0xb040353ec0f2c113d5639444f7253681aecda1f8"),
+		common.HexToAddress("0x14723a09acff6d2a60dcdf7aa4aff308fddc160c"),
+	}
+	dposContext, err := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	assert.Nil(t, dposContext.BecomeCandidate(newCandidate))
+
+	// the kept count matches the one found by iterating the delegators
+	check := func(candidate common.Address, want int) {
+		count, err := dposContext.DelegatorCount(candidate)
+		assert.Nil(t, err)
+		assert.Equal(t, want, count)
+
+		stored, err := dposContext.EpochTrie().TryGet(delegatorCountKey(candidate))
+		assert.Nil(t, err)
+		assert.Nil(t, dposContext.EpochTrie().TryDelete(delegatorCountKey(candidate)))
+		count, err = dposContext.DelegatorCount(candidate)
+		assert.Nil(t, err)
+		assert.Equal(t, want, count)
+		if stored != nil {
+			assert.Nil(t, dposContext.EpochTrie().TryUpdate(delegatorCountKey(candidate), stored))
+		}
+	}
+	check(candidate, 0)
+	for _, delegator := range delegators {
+		assert.Nil(t, dposContext.Delegate(delegator, candidate))
+	}
+	assert.Nil(t, dposContext.Delegate(delegators[0], candidate))
+	check(candidate, 3)
+
+	// moving a vote moves the count
+	assert.Nil(t, dposContext.Delegate(delegators[1], newCandidate))
+	check(candidate, 2)
+	check(newCandidate, 1)
+
+	assert.Nil(t, dposContext.UnDelegate(delegators[0], candidate))
+	assert.NotNil(t, dposContext.UnDelegate(delegators[0], candidate))
+	check(candidate, 1)
+
+	assert.Nil(t, dposContext.KickoutCandidate(candidate))
+	check(candidate, 0)
+	check(newCandidate, 1)
+}
+
+func TestDposContextDelegateTwice(t *testing.T) {
+	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	delegator := common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670")
+	dposContext, err := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	assert.Nil(t, dposContext.DelegateAt(delegator, candidate, 1000, 0))
+	delegateHash, voteHash := dposContext.DelegateTrie().Hash(), dposContext.VoteTrie().Hash()
+
+	// voting for the same candidate again changes nothing, the time included
+	assert.Nil(t, dposContext.Delegate(delegator, candidate))
+	assert.Equal(t, delegateHash, dposContext.DelegateTrie().Hash())
+	assert.Equal(t, voteHash, dposContext.VoteTrie().Hash())
+	voted, err := dposContext.GetVoteTime(delegator)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), voted)
+	delegateIter := trie.NewIterator(dposContext.delegateTrie.PrefixIterator(candidate.Bytes()))
+	if assert.True(t, delegateIter.Next()) {
+		assert.Equal(t, delegator, common.BytesToAddress(delegateIter.Value))
+	}
+	assert.False(t, delegateIter.Next())
+
+	// neither do timed votes, even within the cooldown
+	assert.Nil(t, dposContext.DelegateAt(delegator, candidate, 2000, 5000))
+	assert.Equal(t, delegateHash, dposContext.DelegateTrie().Hash())
+	assert.Equal(t, voteHash, dposContext.VoteTrie().Hash())
+	voted, err = dposContext.GetVoteTime(delegator)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), voted)
+	vote, err := dposContext.GetVote(delegator)
+	assert.Nil(t, err)
+	assert.Equal(t, candidate, vote)
+}
+
+func TestDposContextVoteChangeCooldown(t *testing.T) {
+	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	newCandidate := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	delegator := common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670")
+	db := ethdb.NewMemDatabase()
+	trieDB := trie.NewDatabase(db)
+	dposContext, err := NewDposContext(trieDB)
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	assert.Nil(t, dposContext.BecomeCandidate(newCandidate))
+
+	cooldown := int64(100)
+	assert.Nil(t, dposContext.DelegateAt(delegator, candidate, 1000, cooldown))
+
+	// changing the vote within the window is rejected and leaves the vote untouched
+	assert.Equal(t, ErrVoteChangeTooSoon, dposContext.DelegateAt(delegator, newCandidate, 1000+cooldown-1, cooldown))
+	assert.Equal(t, ErrVoteChangeTooSoon, dposContext.UnDelegateAt(delegator, candidate, 1000+cooldown-1, cooldown))
+	delegateIter := trie.NewIterator(dposContext.delegateTrie.PrefixIterator(candidate.Bytes()))
+	assert.True(t, delegateIter.Next())
+	assert.Equal(t, delegator, common.BytesToAddress(delegateIter.Value))
+
+	// changing the vote after the window succeeds and restarts the window
+	assert.Nil(t, dposContext.DelegateAt(delegator, newCandidate, 1000+cooldown, cooldown))
+	delegateIter = trie.NewIterator(dposContext.delegateTrie.PrefixIterator(candidate.Bytes()))
+	assert.False(t, delegateIter.Next())
+	delegateIter = trie.NewIterator(dposContext.delegateTrie.PrefixIterator(newCandidate.Bytes()))
+	assert.True(t, delegateIter.Next())
+	assert.Equal(t, ErrVoteChangeTooSoon, dposContext.UnDelegateAt(delegator, newCandidate, 1000+cooldown+1, cooldown))
+
+	// timed votes still work with the untimed operations
+	assert.Nil(t, dposContext.UnDelegateAt(delegator, newCandidate, 1000+2*cooldown, cooldown))
+	voteIter := trie.NewIterator(dposContext.voteTrie.NodeIterator(nil))
+	assert.False(t, voteIter.Next())
+	assert.Nil(t, dposContext.DelegateAt(delegator, candidate, 1000+2*cooldown, cooldown))
+	assert.Nil(t, dposContext.KickoutCandidate(candidate))
+	voteIter = trie.NewIterator(dposContext.voteTrie.NodeIterator(nil))
+	assert.False(t, voteIter.Next())
+
+	// without a cooldown votes may change at any time
+	assert.Nil(t, dposContext.DelegateAt(delegator, newCandidate, 2000, 0))
+	assert.Nil(t, dposContext.UnDelegateAt(delegator, newCandidate, 2000, 0))
+}
+
+func TestDposContextValidatorRanks(t *testing.T) {
+	ranks := []common.Address{
+		common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e"),
+		common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2"),
+	}
+	db := ethdb.NewMemDatabase()
+	trieDB := trie.NewDatabase(db)
+	dposContext, err := NewDposContext(trieDB)
+	assert.Nil(t, err)
+
+	result, err := dposContext.GetValidatorRanks()
+	assert.Nil(t, err)
+	assert.Empty(t, result)
+
+	assert.Nil(t, dposContext.SetValidatorRanks(ranks))
+	result, err = dposContext.GetValidatorRanks()
+	assert.Nil(t, err)
+	assert.Equal(t, ranks, result)
+
+	// an empty list clears the ranks
+	assert.Nil(t, dposContext.SetValidatorRanks(nil))
+	assert.Nil(t, dposContext.EpochTrie().Get([]byte("rank")))
+}
+
+func TestDposContextValidatorDiff(t *testing.T) {
+	addr1 := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	addr2 := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	addr3 := common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670")
+	addr4 := common.HexToAddress("0x1257a3e6c62dd5d0b1a2d2a3f3f0c8e4f4c5b1a0")
+	db := ethdb.NewMemDatabase()
+	dposContext, err := NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+
+	assert.Nil(t, dposContext.SetEpochValidators(1, []common.Address{addr1, addr2, addr3}))
+	assert.Nil(t, dposContext.SetEpochValidators(2, []common.Address{addr3, addr2, addr1}))
+	assert.Nil(t, dposContext.SetEpochValidators(3, []common.Address{addr4, addr2, addr1}))
+	assert.Nil(t, dposContext.SetEpochValidators(4, []common.Address{addr2}))
+
+	validators, err := dposContext.GetEpochValidators(1)
+	assert.Nil(t, err)
+	assert.Equal(t, []common.Address{addr1, addr2, addr3}, validators)
+
+	// a reshuffled set is no change
+	added, removed, err := dposContext.ValidatorDiff(1, 2)
+	assert.Nil(t, err)
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+
+	added, removed, err = dposContext.ValidatorDiff(2, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []common.Address{addr4}, added)
+	assert.Equal(t, []common.Address{addr3}, removed)
+
+	// removals are sorted by address
+	added, removed, err = dposContext.ValidatorDiff(3, 4)
+	assert.Nil(t, err)
+	assert.Empty(t, added)
+	assert.Equal(t, []common.Address{addr4, addr1}, removed)
+
+	added, removed, err = dposContext.ValidatorDiff(4, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []common.Address{addr1, addr3}, added)
+	assert.Empty(t, removed)
+
+	// unknown epochs are reported
+	_, _, err = dposContext.ValidatorDiff(4, 5)
+	assert.NotNil(t, err)
+}
+
+func TestDposContextRootCoversEpochData(t *testing.T) {
+	validator := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	delegator := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	dposContext, err := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators([]common.Address{validator}))
+
+	// every kind of per-epoch data changes both the live and the proto root
+	for _, update := range []func() error{
+		func() error { return dposContext.SetEpochValidators(3, []common.Address{validator}) },
+		func() error { return dposContext.AddEpochReward(3, big.NewInt(10)) },
+		func() error {
+			return dposContext.SetElectionInput(3, []CandidateWeight{{Address: validator, Weight: big.NewInt(5)}})
+		},
+		func() error { return dposContext.RecordVoteChange(delegator, VoteChange{Time: 1, To: validator}, 4) },
+		func() error { return dposContext.SetValidatorRanks([]common.Address{validator}) },
+	} {
+		before := dposContext.Root()
+		assert.Nil(t, update())
+		assert.NotEqual(t, before, dposContext.Root())
+		assert.Equal(t, dposContext.Root(), dposContext.ToProto().Root())
+	}
+	// renewing the epoch trie, as elections before the epoch history block do,
+	// leaves only the per account settings in the root
+	settings, err := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	assert.Nil(t, settings.RecordVoteChange(delegator, VoteChange{Time: 1, To: validator}, 4))
+	assert.Nil(t, dposContext.RenewEpochTrie())
+	assert.Equal(t, settings.Root(), dposContext.Root())
+}
+
+func TestDposContextCommitRoots(t *testing.T) {
+	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	delegator := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	db := ethdb.NewMemDatabase()
+	dposContext, err := NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	assert.Nil(t, dposContext.Delegate(delegator, candidate))
+	assert.Nil(t, dposContext.SetValidators([]common.Address{candidate}))
+	dposContext.MintCntTrie().Update(candidate.Bytes(), []byte{1})
+
+	before := dposContext.ToProto()
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	// committing doesn't alter the tries, the returned roots are the live ones
+	assert.Equal(t, before, proto)
+	assert.Equal(t, proto, dposContext.ToProto())
+	assert.Equal(t, proto.Root(), dposContext.Root())
+
+	// the roots are stable when reopened from a fresh database handle
+	reopened, err := NewDposContextFromProto(trie.NewDatabase(db), proto)
+	assert.Nil(t, err)
+	assert.Equal(t, proto, reopened.ToProto())
+	validators, err := reopened.GetValidators()
+	assert.Nil(t, err)
+	assert.Equal(t, []common.Address{candidate}, validators)
+
+	// committing again without changes yields the same roots
+	again, err := reopened.Commit()
+	assert.Nil(t, err)
+	assert.Equal(t, proto, again)
+}
+
+func TestOpenEpochTrieOnly(t *testing.T) {
+	validators := []common.Address{
+		common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e"),
+		common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2"),
+	}
+	db := ethdb.NewMemDatabase()
+	dposContext, err := NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.SetValidators(validators))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	epochOnly, err := OpenEpochTrieOnly(proto.EpochHash, trie.NewDatabase(db))
+	assert.Nil(t, err)
+	result, err := epochOnly.GetValidators()
+	assert.Nil(t, err)
+	assert.Equal(t, validators, result)
+	assert.Nil(t, epochOnly.DelegateTrie())
+
+	// unknown roots fail to open
+	_, err = OpenEpochTrieOnly(common.HexToHash("0x01"), trie.NewDatabase(db))
+	assert.NotNil(t, err)
+}
+
+func TestDposContextCountCandidates(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	dposContext, err := NewDposContext(trie.NewDatabase(db))
+	assert.Nil(t, err)
+
+	iterated := func() int {
+		count := 0
+		iter := trie.NewIterator(dposContext.candidateTrie.NodeIterator(nil))
+		for iter.Next() {
+			count++
+		}
+		return count
+	}
+	assertCount := func(expected int) {
+		count, err := dposContext.CountCandidates()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, count)
+		assert.Equal(t, iterated(), count)
+	}
+	assertCount(0)
+
+	candidates := []common.Address{
+		common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e"),
+		common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2"),
+		common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670"),
+	}
+	assert.Nil(t, dposContext.BecomeCandidate(candidates[0]))
+	assert.Nil(t, dposContext.RegisterCandidate(candidates[1], 3))
+	assertCount(2)
+
+	// registering twice doesn't count twice
+	assert.Nil(t, dposContext.BecomeCandidate(candidates[0]))
+	assert.Nil(t, dposContext.RegisterCandidate(candidates[1], 4))
+	assertCount(2)
+
+	assert.Nil(t, dposContext.BecomeCandidate(candidates[2]))
+	assertCount(3)
+
+	// kicking out unknown candidates leaves the count alone
+	assert.Nil(t, dposContext.KickoutCandidate(candidates[1]))
+	assert.Nil(t, dposContext.KickoutCandidate(candidates[1]))
+	assertCount(2)
+
+	// states written without the count fall back to iteration
+	assert.Nil(t, dposContext.epochTrie.TryDelete([]byte("candidate-count")))
+	assertCount(2)
+	assert.Nil(t, dposContext.KickoutCandidate(candidates[0]))
+	assertCount(1)
+}
+
+func TestDposContextConcurrentCopies(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	trieDB := trie.NewDatabase(db)
+	dposContext, err := NewDposContext(trieDB)
+	assert.Nil(t, err)
+	// epoch trie only contexts can only count candidates with counts kept
+	assert.Nil(t, dposContext.KeepCounts())
+
+	var (
+		lock     sync.RWMutex
+		snapshot = dposContext.Copy()
+		done     = make(chan struct{})
+		wg       sync.WaitGroup
+	)
+	// readers each work on their own copy of the latest snapshot
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				lock.RLock()
+				reader := snapshot.Copy()
+				lock.RUnlock()
+
+				count, err := reader.CountCandidates()
+				assert.Nil(t, err)
+				delegations := 0
+				iter := trie.NewIterator(reader.DelegateTrie().NodeIterator(nil))
+				for iter.Next() {
+					delegations++
+				}
+				assert.Nil(t, iter.Err)
+				assert.Equal(t, count, delegations)
+			}
+		}()
+	}
+	// the writer keeps modifying and committing its own context
+	for i := 0; i < 100; i++ {
+		candidate := common.BytesToAddress([]byte("candidate" + strconv.Itoa(i)))
+		assert.Nil(t, dposContext.BecomeCandidate(candidate))
+		assert.Nil(t, dposContext.Delegate(common.BytesToAddress([]byte("voter"+strconv.Itoa(i))), candidate))
+		if i%10 == 0 {
+			proto, err := dposContext.Commit()
+			assert.Nil(t, err)
+			// contexts reopened from the roots resolve their nodes lazily
+			reopened, err := NewDposContextFromProto(trieDB, proto)
+			assert.Nil(t, err)
+			lock.Lock()
+			snapshot = reopened
+			lock.Unlock()
+		} else {
+			lock.Lock()
+			snapshot = dposContext.Copy()
+			lock.Unlock()
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	count, err := snapshot.CountCandidates()
+	assert.Nil(t, err)
+	assert.Equal(t, 100, count)
+
+	// epoch trie only contexts can be copied too
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+	epochOnly, err := OpenEpochTrieOnly(proto.EpochHash, trieDB)
+	assert.Nil(t, err)
+	cpy := epochOnly.Copy()
+	assert.Nil(t, cpy.DelegateTrie())
+	count, err = cpy.CountCandidates()
+	assert.Nil(t, err)
+	assert.Equal(t, 100, count)
+}
+
+func TestDposContextPayout(t *testing.T) {
+	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	payout := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	dposContext, err := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+
+	// only candidates may set a payout address
+	assert.NotNil(t, dposContext.SetPayout(candidate, payout))
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	result, err := dposContext.GetPayout(candidate)
+	assert.Nil(t, err)
+	assert.Equal(t, common.Address{}, result)
+
+	assert.Nil(t, dposContext.SetPayout(candidate, payout))
+	result, err = dposContext.GetPayout(candidate)
+	assert.Nil(t, err)
+	assert.Equal(t, payout, result)
+
+	// the zero address clears it
+	assert.Nil(t, dposContext.SetPayout(candidate, common.Address{}))
+	result, err = dposContext.GetPayout(candidate)
+	assert.Nil(t, err)
+	assert.Equal(t, common.Address{}, result)
+
+	// leaving the candidates drops it
+	assert.Nil(t, dposContext.SetPayout(candidate, payout))
+	assert.Nil(t, dposContext.KickoutCandidate(candidate))
+	result, err = dposContext.GetPayout(candidate)
+	assert.Nil(t, err)
+	assert.Equal(t, common.Address{}, result)
+}
+
+func TestDposContextReRegisterCooldown(t *testing.T) {
+	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	other := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	dposContext, err := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	cooldown := int64(2)
+
+	assert.Nil(t, dposContext.RegisterCandidateAt(candidate, 3, cooldown))
+	assert.Nil(t, dposContext.KickoutCandidateAt(candidate, 5, cooldown))
+
+	// barred for the epoch it left in and the next one
+	assert.Equal(t, ErrReRegisterTooSoon, dposContext.RegisterCandidateAt(candidate, 5, cooldown))
+	assert.Equal(t, ErrReRegisterTooSoon, dposContext.RegisterCandidateAt(candidate, 6, cooldown))
+	count, err := dposContext.CountCandidates()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	assert.Nil(t, dposContext.RegisterCandidateAt(candidate, 7, cooldown))
+	epoch, err := dposContext.CandidateEpoch(candidate)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), epoch)
+
+	// addresses that never were candidates aren't barred
+	assert.Nil(t, dposContext.KickoutCandidateAt(other, 7, cooldown))
+	assert.Nil(t, dposContext.RegisterCandidateAt(other, 7, cooldown))
+
+	// nothing is enforced without a cooldown
+	assert.Nil(t, dposContext.KickoutCandidateAt(candidate, 8, 0))
+	assert.Nil(t, dposContext.RegisterCandidateAt(candidate, 8, 0))
+}
+
+func TestDposContextElectionInput(t *testing.T) {
+	dposContext, err := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	input := []CandidateWeight{
+		{Address: common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e"), Weight: big.NewInt(20), Registered: 1},
+		{Address: common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2"), Weight: big.NewInt(10), Registered: 0},
+	}
+	assert.Nil(t, dposContext.SetElectionInput(3, input))
+	stored, err := dposContext.GetElectionInput(3)
+	assert.Nil(t, err)
+	assert.Equal(t, input, stored)
+
+	_, err = dposContext.GetElectionInput(4)
+	assert.NotNil(t, err)
+}
+
+func TestDposContextClear(t *testing.T) {
+	db := trie.NewDatabase(ethdb.NewMemDatabase())
+	dposContext, err := NewDposContext(db)
+	assert.Nil(t, err)
+	empty := dposContext.ToProto()
+
+	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	delegator := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	assert.Nil(t, dposContext.Delegate(delegator, candidate))
+	assert.Nil(t, dposContext.SetValidators([]common.Address{candidate}))
+	assert.Nil(t, dposContext.MintCntTrie().TryUpdate(candidate.Bytes(), []byte{1}))
+	populated, err := dposContext.Commit()
+	assert.Nil(t, err)
+	assert.NotEqual(t, empty.Root(), populated.Root())
+
+	assert.Nil(t, dposContext.Clear())
+	assert.Equal(t, empty, dposContext.ToProto())
+	assert.Equal(t, db, dposContext.DB())
+
+	// the populated state is still there to be reopened
+	reopened, err := NewDposContextFromProto(db, populated)
+	assert.Nil(t, err)
+	vote, err := reopened.GetVote(delegator)
+	assert.Nil(t, err)
+	assert.Equal(t, candidate, vote)
+}
+
+func TestDposContextBatchBecomeCandidate(t *testing.T) {
+	db := trie.NewDatabase(ethdb.NewMemDatabase())
+	dposContext, err := NewDposContext(db)
+	assert.Nil(t, err)
+	existing := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	assert.Nil(t, dposContext.BecomeCandidate(existing))
+
+	candidates := []common.Address{
+		existing,
+		common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2"),
+		common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670"),
+		common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670"),
+	}
+	assert.Nil(t, dposContext.BatchBecomeCandidate(candidates))
+	count, err := dposContext.CountCandidates()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	// the batch is committed, so the candidates are readable from a reopened context
+	reopened, err := NewDposContextFromProto(db, dposContext.ToProto())
+	assert.Nil(t, err)
+	for _, candidate := range candidates {
+		value, err := reopened.CandidateTrie().TryGet(candidate.Bytes())
+		assert.Nil(t, err)
+		assert.Equal(t, candidate.Bytes(), value)
+	}
+}
+
+func TestDposContextExportImportCandidates(t *testing.T) {
+	db := trie.NewDatabase(ethdb.NewMemDatabase())
+	source, err := NewDposContext(db)
+	assert.Nil(t, err)
+	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	registered := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	assert.Nil(t, source.BecomeCandidate(candidate))
+	assert.Nil(t, source.RegisterCandidate(registered, 7))
+	data, err := source.ExportCandidates()
+	assert.Nil(t, err)
+
+	target, err := NewDposContext(db)
+	assert.Nil(t, err)
+	other := common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670")
+	delegator := common.HexToAddress("0xb040353ec0f2c113d5639444f7253681aecda1f8")
+	assert.Nil(t, target.BecomeCandidate(other))
+	assert.Nil(t, target.Delegate(delegator, other))
+	delegateHash, voteHash := target.DelegateTrie().Hash(), target.VoteTrie().Hash()
+
+	// an invalid export changes nothing
+	candidateHash := target.CandidateTrie().Hash()
+	assert.NotNil(t, target.ImportCandidates([]byte{0x01}))
+	invalid, err := rlp.EncodeToBytes([]candidateEntry{{Key: other.Bytes(), Value: candidate.Bytes()}})
+	assert.Nil(t, err)
+	assert.Equal(t, ErrInvalidCandidateExport, target.ImportCandidates(invalid))
+	assert.Equal(t, candidateHash, target.CandidateTrie().Hash())
+
+	assert.Nil(t, target.ImportCandidates(data))
+	assert.Equal(t, source.CandidateTrie().Hash(), target.CandidateTrie().Hash())
+	assert.Equal(t, delegateHash, target.DelegateTrie().Hash())
+	assert.Equal(t, voteHash, target.VoteTrie().Hash())
+	count, err := target.CountCandidates()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	epoch, err := target.CandidateEpoch(registered)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), epoch)
+	value, err := target.CandidateTrie().TryGet(other.Bytes())
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	// the round trip is lossless
+	again, err := target.ExportCandidates()
+	assert.Nil(t, err)
+	assert.Equal(t, data, again)
+}
+
+func benchmarkCandidates(n int) []common.Address {
+	candidates := make([]common.Address, n)
+	for i := range candidates {
+		candidates[i] = common.BigToAddress(big.NewInt(int64(i + 1)))
+	}
+	return candidates
+}
+
+func BenchmarkBecomeCandidate(b *testing.B) {
+	candidates := benchmarkCandidates(1000)
+	for i := 0; i < b.N; i++ {
+		dposContext, _ := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+		for _, candidate := range candidates {
+			if err := dposContext.BecomeCandidate(candidate); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := dposContext.Commit(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkBatchBecomeCandidate(b *testing.B) {
+	candidates := benchmarkCandidates(1000)
+	for i := 0; i < b.N; i++ {
+		dposContext, _ := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+		if err := dposContext.BatchBecomeCandidate(candidates); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDposContextVoteHistory(t *testing.T) {
+	dposContext, err := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	delegator := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	candidates := []common.Address{
+		common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2"),
+		common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670"),
+	}
+	history, err := dposContext.GetVoteHistory(delegator)
+	assert.Nil(t, err)
+	assert.Empty(t, history)
+
+	changes := []VoteChange{
+		{Time: 10, To: candidates[0]},
+		{Time: 20, From: candidates[0], To: candidates[1]},
+		{Time: 30, From: candidates[1]},
+		{Time: 40, To: candidates[0]},
+	}
+	for _, change := range changes {
+		assert.Nil(t, dposContext.RecordVoteChange(delegator, change, 3))
+	}
+	// the oldest change is dropped beyond the limit
+	history, err = dposContext.GetVoteHistory(delegator)
+	assert.Nil(t, err)
+	assert.Equal(t, changes[1:], history)
+
+	// nothing is recorded without a limit
+	other := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	assert.Nil(t, dposContext.RecordVoteChange(other, changes[0], 0))
+	history, err = dposContext.GetVoteHistory(other)
+	assert.Nil(t, err)
+	assert.Empty(t, history)
+}
+
+func TestDposContextMintCntProof(t *testing.T) {
+	dposContext, err := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	validators := []common.Address{
+		common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e"),
+		common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2"),
 	}
-	for _, validator := range result {
-		assert.True(t, validatorMap[validator])
+	for i, validator := range validators {
+		assert.Nil(t, dposContext.mintCntTrie.TryUpdate(mintCntKey(3, validator), []byte{0, 0, 0, 0, 0, 0, 0, byte(i + 5)}))
 	}
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	value, proof, err := dposContext.MintCntProof(3, validators[1])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 6}, value)
+	proven, err := VerifyMintCntProof(proto.MintCntHash, 3, validators[1], proof)
+	assert.Nil(t, err)
+	assert.Equal(t, value, proven)
+
+	// the proof doesn't hold for another epoch or root
+	proven, err = VerifyMintCntProof(proto.MintCntHash, 4, validators[1], proof)
+	assert.True(t, err != nil || proven == nil)
+	_, err = VerifyMintCntProof(proto.EpochHash, 3, validators[1], proof)
+	assert.NotNil(t, err)
+
+	// a tampered proof is rejected
+	tampered := make([][]byte, len(proof))
+	copy(tampered, proof)
+	last := common.CopyBytes(tampered[len(tampered)-1])
+	last[len(last)-1]++
+	tampered[len(tampered)-1] = last
+	_, err = VerifyMintCntProof(proto.MintCntHash, 3, validators[1], tampered)
+	assert.NotNil(t, err)
+
+	// validators that didn't mint are proven absent
+	absent := common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670")
+	value, proof, err = dposContext.MintCntProof(3, absent)
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+	proven, err = VerifyMintCntProof(proto.MintCntHash, 3, absent, proof)
+	assert.Nil(t, err)
+	assert.Nil(t, proven)
+}
+
+func TestDposContextValidate(t *testing.T) {
+	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	newCandidate := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	delegator := common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670")
+	other := common.HexToAddress("0xb040353ec0f2c113d5639444f7253681aecda1f8")
+
+	dposContext, err := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.Validate())
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	assert.Nil(t, dposContext.BecomeCandidate(newCandidate))
+	assert.Nil(t, dposContext.Delegate(delegator, candidate))
+	assert.Nil(t, dposContext.DelegateAt(other, candidate, 10, 0))
+	assert.Nil(t, dposContext.Validate())
+
+	// the tries stay in sync through vote changes and kickouts
+	assert.Nil(t, dposContext.Delegate(other, newCandidate))
+	assert.Nil(t, dposContext.UnDelegate(delegator, candidate))
+	assert.Nil(t, dposContext.Delegate(delegator, candidate))
+	assert.Nil(t, dposContext.KickoutCandidate(candidate))
+	assert.Nil(t, dposContext.Validate())
+
+	// a vote without its delegate entry
+	broken := dposContext.Copy()
+	assert.Nil(t, broken.voteTrie.TryUpdate(delegator.Bytes(), newCandidate.Bytes()))
+	assert.NotNil(t, broken.Validate())
+
+	// a delegate entry without its vote
+	broken = dposContext.Copy()
+	assert.Nil(t, broken.voteTrie.TryDelete(other.Bytes()))
+	assert.NotNil(t, broken.Validate())
+
+	// a delegate entry for another candidate than voted for
+	broken = dposContext.Copy()
+	assert.Nil(t, broken.delegateTrie.TryUpdate(append(candidate.Bytes(), other.Bytes()...), other.Bytes()))
+	assert.NotNil(t, broken.Validate())
+
+	assert.Nil(t, dposContext.Validate())
+}
+
+func TestDposContextEpochHistory(t *testing.T) {
+	candidate := common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e")
+	payout := common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2")
+	departed := common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670")
+	validators := []common.Address{candidate}
+
+	dposContext, err := NewDposContext(trie.NewDatabase(ethdb.NewMemDatabase()))
+	assert.Nil(t, err)
+	assert.Nil(t, dposContext.BecomeCandidate(candidate))
+	assert.Nil(t, dposContext.BecomeCandidate(departed))
+	assert.Nil(t, dposContext.SetPayout(candidate, payout))
+	assert.Nil(t, dposContext.KickoutCandidateAt(departed, 3, 2))
+	assert.Nil(t, dposContext.SetValidators(validators))
+	for epoch := int64(1); epoch <= 2; epoch++ {
+		assert.Nil(t, dposContext.SetEpochValidators(epoch, validators))
+		assert.Nil(t, dposContext.SetElectionInput(epoch, []CandidateWeight{{Address: candidate, Weight: big.NewInt(1)}}))
+		assert.Nil(t, dposContext.AddEpochReward(epoch, big.NewInt(1)))
+	}
+
+	// pruning drops the records of the one epoch only
+	pruned := dposContext.Copy()
+	assert.Nil(t, pruned.PruneEpochHistory(1))
+	_, err = pruned.GetEpochValidators(1)
+	assert.NotNil(t, err)
+	_, err = pruned.GetElectionInput(1)
+	assert.NotNil(t, err)
+	reward, err := pruned.GetEpochReward(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, reward.Sign())
+	_, err = pruned.GetEpochValidators(2)
+	assert.Nil(t, err)
+
+	// a renewed trie only carries over the per account settings
+	renewed := dposContext.Copy()
+	assert.Nil(t, renewed.RenewEpochTrie())
+	got, err := renewed.GetPayout(candidate)
+	assert.Nil(t, err)
+	assert.Equal(t, payout, got)
+	assert.Equal(t, ErrReRegisterTooSoon, renewed.RegisterCandidateAt(departed, 4, 2))
+	_, err = renewed.GetEpochValidators(2)
+	assert.NotNil(t, err)
+	// the current set is left to the election to fill in
+	_, err = renewed.GetValidators()
+	assert.NotNil(t, err)
+
+	// departures expire with the cooldown
+	assert.Nil(t, renewed.ExpireDepartures(4, 2))
+	assert.Equal(t, ErrReRegisterTooSoon, renewed.RegisterCandidateAt(departed, 4, 2))
+	assert.Nil(t, renewed.ExpireDepartures(5, 2))
+	left, err := renewed.EpochTrie().TryGet(candidateLeftKey(departed))
+	assert.Nil(t, err)
+	assert.Nil(t, left)
 }
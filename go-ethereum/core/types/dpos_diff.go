@@ -0,0 +1,115 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/trie"
+)
+
+// dposDiffLimit is the maximum number of keys reported per kind of difference
+// and trie, keeping the diff of two unrelated large states bounded.
+const dposDiffLimit = 1024
+
+// DposTrieDiff lists the keys differing between the same trie of two contexts.
+type DposTrieDiff struct {
+	Added     [][]byte // Keys only present in the second trie
+	Removed   [][]byte // Keys only present in the first trie
+	Changed   [][]byte // Keys present in both with different values
+	Truncated bool     // Whether keys past dposDiffLimit were left out
+}
+
+// Empty reports whether the tries were found to be equal.
+func (d *DposTrieDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d *DposTrieDiff) add(keys *[][]byte, key, prefix []byte) {
+	if len(*keys) >= dposDiffLimit {
+		d.Truncated = true
+		return
+	}
+	*keys = append(*keys, common.CopyBytes(bytes.TrimPrefix(key, prefix)))
+}
+
+// DposDiff holds the differences between the five tries of two dpos contexts.
+type DposDiff struct {
+	Epoch     DposTrieDiff
+	Delegate  DposTrieDiff
+	Vote      DposTrieDiff
+	Candidate DposTrieDiff
+	MintCnt   DposTrieDiff
+}
+
+// Empty reports whether the contexts were found to be equal.
+func (d *DposDiff) Empty() bool {
+	return d.Epoch.Empty() && d.Delegate.Empty() && d.Vote.Empty() && d.Candidate.Empty() && d.MintCnt.Empty()
+}
+
+// DposContextDiff reports the trie entries added, removed or changed going from
+// context a to context b. The tries are walked side by side in key order, so
+// memory use doesn't grow with their size.
+func DposContextDiff(a, b *DposContext) (*DposDiff, error) {
+	diff := new(DposDiff)
+	tries := []struct {
+		name   string
+		a, b   *trie.Trie
+		prefix []byte
+		diff   *DposTrieDiff
+	}{
+		{"epoch", a.epochTrie, b.epochTrie, epochPrefix, &diff.Epoch},
+		{"delegate", a.delegateTrie, b.delegateTrie, delegatePrefix, &diff.Delegate},
+		{"vote", a.voteTrie, b.voteTrie, votePrefix, &diff.Vote},
+		{"candidate", a.candidateTrie, b.candidateTrie, candidatePrefix, &diff.Candidate},
+		{"mintCnt", a.mintCntTrie, b.mintCntTrie, mintCntPrefix, &diff.MintCnt},
+	}
+	for _, t := range tries {
+		if t.a == nil || t.b == nil {
+			return nil, fmt.Errorf("dpos context lacks the %s trie", t.name)
+		}
+		if err := diffTrie(t.a, t.b, t.prefix, t.diff); err != nil {
+			return nil, fmt.Errorf("failed to diff the %s trie: %s", t.name, err)
+		}
+	}
+	return diff, nil
+}
+
+// diffTrie merges the sorted leaves of both tries, reporting their keys without
+// the trie prefix as used by the DposContext accessors.
+func diffTrie(a, b *trie.Trie, prefix []byte, diff *DposTrieDiff) error {
+	if a.Hash() == b.Hash() {
+		return nil
+	}
+	itA := trie.NewIterator(a.NodeIterator(nil))
+	itB := trie.NewIterator(b.NodeIterator(nil))
+	okA, okB := itA.Next(), itB.Next()
+	for okA || okB {
+		cmp := 0
+		switch {
+		case !okB:
+			cmp = -1
+		case !okA:
+			cmp = 1
+		default:
+			cmp = bytes.Compare(itA.Key, itB.Key)
+		}
+		switch {
+		case cmp < 0:
+			diff.add(&diff.Removed, itA.Key, prefix)
+			okA = itA.Next()
+		case cmp > 0:
+			diff.add(&diff.Added, itB.Key, prefix)
+			okB = itB.Next()
+		default:
+			if !bytes.Equal(itA.Value, itB.Value) {
+				diff.add(&diff.Changed, itA.Key, prefix)
+			}
+			okA, okB = itA.Next(), itB.Next()
+		}
+	}
+	if itA.Err != nil {
+		return itA.Err
+	}
+	return itB.Err
+}
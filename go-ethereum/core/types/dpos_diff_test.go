@@ -0,0 +1,82 @@
+package types
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/ethdb"
+	"github.com/happytoken/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDposContextDiff(t *testing.T) {
+	candidates := []common.Address{
+		common.HexToAddress("0x44d1ce0b7cb3588bca96151fe1bc05af38f91b6e"),
+		common.HexToAddress("0xa60a3886b552ff9992cfcd208ec1152079e046c2"),
+	}
+	delegator := common.HexToAddress("0x4e080e49f62694554871e669aeb4ebe17c4a9670")
+	db := trie.NewDatabase(ethdb.NewMemDatabase())
+	a, err := NewDposContext(db)
+	assert.Nil(t, err)
+	assert.Nil(t, a.KeepCounts())
+	for _, candidate := range candidates {
+		assert.Nil(t, a.BecomeCandidate(candidate))
+	}
+	assert.Nil(t, a.Delegate(delegator, candidates[0]))
+	proto, err := a.Commit()
+	assert.Nil(t, err)
+
+	// identical states don't differ
+	b, err := NewDposContextFromProto(db, proto)
+	assert.Nil(t, err)
+	diff, err := DposContextDiff(a, b)
+	assert.Nil(t, err)
+	assert.True(t, diff.Empty())
+
+	// moving one delegation
+	assert.Nil(t, b.Delegate(delegator, candidates[1]))
+	diff, err = DposContextDiff(a, b)
+	assert.Nil(t, err)
+	assert.False(t, diff.Empty())
+	assert.Equal(t, [][]byte{append(candidates[1].Bytes(), delegator.Bytes()...)}, diff.Delegate.Added)
+	assert.Equal(t, [][]byte{append(candidates[0].Bytes(), delegator.Bytes()...)}, diff.Delegate.Removed)
+	assert.Empty(t, diff.Delegate.Changed)
+	assert.Equal(t, [][]byte{delegator.Bytes()}, diff.Vote.Changed)
+	assert.Empty(t, diff.Vote.Added)
+	assert.Empty(t, diff.Vote.Removed)
+	assert.True(t, diff.Candidate.Empty())
+	// along with the delegator counts of both candidates
+	assert.Equal(t, [][]byte{delegatorCountKey(candidates[0])}, diff.Epoch.Changed)
+	assert.Equal(t, [][]byte{delegatorCountKey(candidates[1])}, diff.Epoch.Added)
+	assert.Empty(t, diff.Epoch.Removed)
+	assert.True(t, diff.MintCnt.Empty())
+
+	// the reverse diff swaps additions and removals
+	diff, err = DposContextDiff(b, a)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{append(candidates[0].Bytes(), delegator.Bytes()...)}, diff.Delegate.Added)
+	assert.Equal(t, [][]byte{append(candidates[1].Bytes(), delegator.Bytes()...)}, diff.Delegate.Removed)
+
+	// epoch trie only contexts can't be diffed
+	epochOnly, err := OpenEpochTrieOnly(proto.EpochHash, db)
+	assert.Nil(t, err)
+	_, err = DposContextDiff(a, epochOnly)
+	assert.NotNil(t, err)
+}
+
+func TestDposContextDiffLimit(t *testing.T) {
+	db := trie.NewDatabase(ethdb.NewMemDatabase())
+	a, err := NewDposContext(db)
+	assert.Nil(t, err)
+	b, err := NewDposContext(db)
+	assert.Nil(t, err)
+	for i := 0; i < dposDiffLimit+10; i++ {
+		assert.Nil(t, b.BecomeCandidate(common.BigToAddress(big.NewInt(int64(i+1)))))
+	}
+	diff, err := DposContextDiff(a, b)
+	assert.Nil(t, err)
+	assert.Equal(t, dposDiffLimit, len(diff.Candidate.Added))
+	assert.True(t, diff.Candidate.Truncated)
+	assert.False(t, diff.Delegate.Truncated)
+}
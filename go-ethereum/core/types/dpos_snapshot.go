@@ -0,0 +1,93 @@
+package types
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/crypto"
+	"github.com/happytoken/go-ethereum/rlp"
+	"github.com/happytoken/go-ethereum/trie"
+)
+
+// dposSnapshot is the serialized form of the dpos state at a block: the roots
+// of the five tries followed by all of their nodes.
+type dposSnapshot struct {
+	Proto *DposContextProto
+	Nodes [][]byte
+}
+
+// ExportDposSnapshot writes the nodes of the five dpos tries with the given
+// roots to w, to be restored elsewhere with ImportDposSnapshot.
+func ExportDposSnapshot(db *trie.Database, proto *DposContextProto, w io.Writer) error {
+	snapshot := &dposSnapshot{Proto: proto}
+	seen := make(map[common.Hash]bool)
+	for _, root := range proto.roots() {
+		// walk the plain trie, prefixed iterators skip the nodes above the prefix
+		t, err := trie.New(root, db)
+		if err != nil {
+			return err
+		}
+		it := t.NodeIterator(nil)
+		for it.Next(true) {
+			// embedded nodes are part of their parent's blob
+			hash := it.Hash()
+			if hash == (common.Hash{}) || seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			blob, err := db.Node(hash)
+			if err != nil {
+				return err
+			}
+			snapshot.Nodes = append(snapshot.Nodes, blob)
+		}
+		if it.Error() != nil {
+			return it.Error()
+		}
+	}
+	return rlp.Encode(w, snapshot)
+}
+
+// ImportDposSnapshot reads a snapshot written by ExportDposSnapshot and stores
+// its nodes in db. It returns the roots of the snapshot, which the caller has to
+// check against a trusted block before using the state.
+func ImportDposSnapshot(db *trie.Database, r io.Reader) (*DposContextProto, error) {
+	snapshot := new(dposSnapshot)
+	if err := rlp.Decode(r, snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode dpos snapshot: %s", err)
+	}
+	if snapshot.Proto == nil {
+		return nil, fmt.Errorf("dpos snapshot without roots")
+	}
+	hashes := make([]common.Hash, 0, len(snapshot.Nodes))
+	for _, blob := range snapshot.Nodes {
+		hash := crypto.Keccak256Hash(blob)
+		db.InsertBlob(hash, blob)
+		hashes = append(hashes, hash)
+	}
+	// blobs don't track their children, so each node is flushed on its own
+	for _, hash := range hashes {
+		if err := db.Commit(hash, false); err != nil {
+			return nil, err
+		}
+	}
+	// make sure the snapshot holds the complete tries
+	for _, root := range snapshot.Proto.roots() {
+		t, err := trie.New(root, db)
+		if err != nil {
+			return nil, fmt.Errorf("incomplete dpos snapshot: %s", err)
+		}
+		it := t.NodeIterator(nil)
+		for it.Next(true) {
+		}
+		if it.Error() != nil {
+			return nil, fmt.Errorf("incomplete dpos snapshot: %s", it.Error())
+		}
+	}
+	return snapshot.Proto, nil
+}
+
+func (p *DposContextProto) roots() []common.Hash {
+	return []common.Hash{p.EpochHash, p.DelegateHash, p.VoteHash, p.CandidateHash, p.MintCntHash}
+}
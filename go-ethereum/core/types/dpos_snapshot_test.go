@@ -0,0 +1,88 @@
+package types
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/happytoken/go-ethereum/common"
+	"github.com/happytoken/go-ethereum/ethdb"
+	"github.com/happytoken/go-ethereum/rlp"
+	"github.com/happytoken/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDposSnapshotRoundTrip(t *testing.T) {
+	db := trie.NewDatabase(ethdb.NewMemDatabase())
+	dposContext, err := NewDposContext(db)
+	assert.Nil(t, err)
+
+	var validators []common.Address
+	for i := 0; i < 30; i++ {
+		candidate := common.StringToAddress("candidate" + strconv.Itoa(i))
+		assert.Nil(t, dposContext.RegisterCandidate(candidate, int64(i)))
+		for j := 0; j < 3; j++ {
+			assert.Nil(t, dposContext.Delegate(common.StringToAddress("voter"+strconv.Itoa(i)+"-"+strconv.Itoa(j)), candidate))
+		}
+		if i%2 == 0 {
+			validators = append(validators, candidate)
+		}
+		dposContext.MintCntTrie().Update(append([]byte{0, 0, 0, 0, 0, 0, 0, 1}, candidate.Bytes()...), []byte{byte(i)})
+	}
+	assert.Nil(t, dposContext.SetValidators(validators))
+	proto, err := dposContext.Commit()
+	assert.Nil(t, err)
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, ExportDposSnapshot(db, proto, buf))
+	blob := buf.Bytes()
+
+	// restore into an empty database
+	restoredDB := trie.NewDatabase(ethdb.NewMemDatabase())
+	restoredProto, err := ImportDposSnapshot(restoredDB, bytes.NewReader(blob))
+	assert.Nil(t, err)
+	assert.Equal(t, proto, restoredProto)
+	assert.Equal(t, proto.Root(), restoredProto.Root())
+
+	restored, err := NewDposContextFromProto(restoredDB, restoredProto)
+	assert.Nil(t, err)
+	result, err := restored.GetValidators()
+	assert.Nil(t, err)
+	assert.Equal(t, validators, result)
+	originals := []*trie.Trie{dposContext.EpochTrie(), dposContext.DelegateTrie(), dposContext.VoteTrie(), dposContext.CandidateTrie(), dposContext.MintCntTrie()}
+	copies := []*trie.Trie{restored.EpochTrie(), restored.DelegateTrie(), restored.VoteTrie(), restored.CandidateTrie(), restored.MintCntTrie()}
+	for i, original := range originals {
+		copied := copies[i]
+		want, got := trie.NewIterator(original.NodeIterator(nil)), trie.NewIterator(copied.NodeIterator(nil))
+		count := 0
+		for want.Next() {
+			assert.True(t, got.Next())
+			assert.Equal(t, want.Key, got.Key)
+			assert.Equal(t, want.Value, got.Value)
+			count++
+		}
+		assert.False(t, got.Next())
+		assert.True(t, count > 0)
+	}
+	epoch, err := restored.CandidateEpoch(common.StringToAddress("candidate7"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), epoch)
+
+	// the restored state is the same, so exporting it again yields the same snapshot
+	again := new(bytes.Buffer)
+	assert.Nil(t, ExportDposSnapshot(restoredDB, restoredProto, again))
+	assert.Equal(t, blob, again.Bytes())
+
+	// snapshots missing nodes are rejected
+	truncated := &dposSnapshot{Proto: proto}
+	assert.Nil(t, rlp.DecodeBytes(blob, truncated))
+	truncated.Nodes = truncated.Nodes[1:]
+	broken := new(bytes.Buffer)
+	assert.Nil(t, rlp.Encode(broken, truncated))
+	_, err = ImportDposSnapshot(trie.NewDatabase(ethdb.NewMemDatabase()), broken)
+	assert.NotNil(t, err)
+
+	// garbage is rejected
+	_, err = ImportDposSnapshot(trie.NewDatabase(ethdb.NewMemDatabase()), bytes.NewReader([]byte{0x01, 0x02}))
+	assert.NotNil(t, err)
+}
@@ -41,6 +41,8 @@ const (
 	UnregCandidate               //注销成为候选人
 	Delegate                     //用户为候选人投票
 	UnDelegate                   //撤销投票（授权proxy）
+	ValidatorOverride            //管理员强制指定验证人，payload为签名的验证人列表
+	SetPayout                    //候选人设置出块奖励的收款地址，to为收款地址
 )
 
 var (
@@ -141,7 +143,7 @@ func (tx *Transaction) Validate() error {
 		if tx.To() == nil && tx.Type() != RegCandidate && tx.Type() != UnregCandidate {
 			return errors.New("receipient was required")
 		}
-		if tx.Data() != nil {
+		if tx.Data() != nil && tx.Type() != ValidatorOverride {
 			return errors.New("payload should be empty")
 		}
 	}
@@ -22,7 +22,6 @@ import (
 
 	"github.com/happytoken/go-ethereum/common"
 	"github.com/happytoken/go-ethereum/crypto"
-	"github.com/happytoken/go-ethereum/rlp"
 )
 
 func TestEIP155Signing(t *testing.T) {
@@ -170,6 +170,10 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 
 	eth.miner = miner.New(eth, eth.chainConfig, eth.EventMux(), eth.engine, config.MinerRecommit)
 	eth.miner.SetExtra(makeExtraData(config.MinerExtraData))
+	if dposEngine, ok := eth.engine.(*dpos.Dpos); ok {
+		dposEngine.SetPendingContext(eth.miner.PendingDposContext)
+		dposEngine.StartWatchdog(eth.blockchain)
+	}
 
 	eth.APIBackend = &EthAPIBackend{eth, nil}
 	gpoParams := config.GPO
@@ -338,7 +342,15 @@ func (s *Ethereum) StartMining(local bool) error {
 			log.Error("Coinbase account unavailable locally", "err", err)
 			return fmt.Errorf("signer missing: %v", err)
 		}
-		dpos.Authorize(validator, wallet.SignHash)
+		// hand the full account to the wallet, hardware wallets need its derivation path
+		account := accounts.Account{Address: validator}
+		for _, candidate := range wallet.Accounts() {
+			if candidate.Address == validator {
+				account = candidate
+				break
+			}
+		}
+		dpos.AuthorizeAccount(account, wallet.SignHash)
 	}
 	if local {
 		// If local (CPU) mining is started, we can disable the transaction rejection
@@ -81,6 +81,99 @@ web3._extend({
 			params: 0,
 			outputFormatter: web3._extend.utils.toBigNumber
 		}),
+		new web3._extend.Method({
+			name: 'getSigner',
+			call: 'dpos_getSigner',
+			params: 1,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'getAllVoters',
+			call: 'dpos_getAllVoters',
+			params: 1,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'getAccountDelegations',
+			call: 'dpos_getAccountDelegations',
+			params: 2,
+			inputFormatter: [web3._extend.formatters.inputAddressFormatter, web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'getEpochInfo',
+			call: 'dpos_getEpochInfo',
+			params: 1,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'getDposRoots',
+			call: 'dpos_getDposRoots',
+			params: 1,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'getEpochReward',
+			call: 'dpos_getEpochReward',
+			params: 2,
+			inputFormatter: [null, web3._extend.formatters.inputBlockNumberFormatter],
+			outputFormatter: web3._extend.utils.toBigNumber
+		}),
+		new web3._extend.Method({
+			name: 'getBlockReward',
+			call: 'dpos_getBlockReward',
+			params: 1,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'getPendingVote',
+			call: 'dpos_getPendingVote',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'getPendingDelegators',
+			call: 'dpos_getPendingDelegators',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'getGenesisDposParams',
+			call: 'dpos_getGenesisDposParams',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'status',
+			call: 'dpos_status',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'missedSlots',
+			call: 'dpos_missedSlots',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'currentSlot',
+			call: 'dpos_currentSlot',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'blocksUntilElection',
+			call: 'dpos_blocksUntilElection',
+			params: 0
+		}),
+		new web3._extend.Method({
+			name: 'getElectionInput',
+			call: 'dpos_getElectionInput',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'getVoteHistory',
+			call: 'dpos_getVoteHistory',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'explainElection',
+			call: 'dpos_explainElection',
+			params: 2
+		}),
 	]
 });
 `
@@ -168,6 +261,18 @@ web3._extend({
 			call: 'admin_addPeer',
 			params: 1
 		}),
+		new web3._extend.Method({
+			name: 'pauseProduction',
+			call: 'admin_pauseProduction'
+		}),
+		new web3._extend.Method({
+			name: 'resumeProduction',
+			call: 'admin_resumeProduction'
+		}),
+		new web3._extend.Method({
+			name: 'recomputeConfirmedBlock',
+			call: 'admin_recomputeConfirmedBlock'
+		}),
 		new web3._extend.Method({
 			name: 'removePeer',
 			call: 'admin_removePeer',
@@ -233,6 +338,10 @@ web3._extend({
 			name: 'datadir',
 			getter: 'admin_datadir'
 		}),
+		new web3._extend.Property({
+			name: 'productionPaused',
+			getter: 'admin_productionPaused'
+		}),
 	]
 });
 `
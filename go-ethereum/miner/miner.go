@@ -150,6 +150,12 @@ func (self *Miner) Pending() (*types.Block, *state.StateDB) {
 	return self.worker.pending()
 }
 
+// PendingDposContext returns the dpos state of the pending block, including
+// the not yet committed candidate and vote changes, or nil if there is none.
+func (self *Miner) PendingDposContext() *types.DposContext {
+	return self.worker.pendingDposContext()
+}
+
 // PendingBlock returns the currently pending block.
 //
 // Note, to access both the pending block and the pending state
@@ -133,6 +133,7 @@ type worker struct {
 	snapshotMu    sync.RWMutex // The lock used to protect the block snapshot and state snapshot
 	snapshotBlock *types.Block
 	snapshotState *state.StateDB
+	snapshotDpos  *types.DposContext
 
 	// atomic status counters
 	running int32 // The indicator whether the consensus engine is running or not.
@@ -211,6 +212,16 @@ func (w *worker) pending() (*types.Block, *state.StateDB) {
 	return w.snapshotBlock, w.snapshotState.Copy()
 }
 
+// pendingDposContext returns the dpos state of the pending block.
+func (w *worker) pendingDposContext() *types.DposContext {
+	w.snapshotMu.RLock()
+	defer w.snapshotMu.RUnlock()
+	if w.snapshotDpos == nil {
+		return nil
+	}
+	return w.snapshotDpos.Copy()
+}
+
 // pendingBlock returns pending block.
 func (w *worker) pendingBlock() *types.Block {
 	// return a snapshot to avoid contention on currentMu mutex
@@ -238,7 +249,8 @@ func (self *worker) mintBlock(now int64,blockInterval uint64) {
 		case dpos.ErrWaitForPrevBlock,
 			dpos.ErrMintFutureBlock,
 			dpos.ErrInvalidBlockValidator,
-			dpos.ErrInvalidMintBlockTime:
+			dpos.ErrInvalidMintBlockTime,
+			dpos.ErrNotActivated:
 			log.Debug("Failed to mint the block, while ", "err", err)
 		default:
 			log.Error("Failed to mint the block", "err", err)
@@ -325,17 +337,13 @@ func (w *worker) mainLoop() {
 			// already included in the current mining block. These transactions will
 			// be automatically eliminated.
 			if !w.isRunning() && w.current != nil {
-				w.mu.RLock()
-				coinbase := w.coinbase
-				w.mu.RUnlock()
-
 				txs := make(map[common.Address]types.Transactions)
 				for _, tx := range ev.Txs {
 					acc, _ := types.Sender(w.current.signer, tx)
 					txs[acc] = append(txs[acc], tx)
 				}
 				txset := types.NewTransactionsByPriceAndNonce(w.current.signer, txs)
-				w.commitTransactions(txset, coinbase)
+				w.commitTransactions(txset)
 				w.updateSnapshot()
 			}
 			atomic.AddInt32(&w.newTxs, int32(len(ev.Txs)))
@@ -546,13 +554,15 @@ func (w *worker) updateSnapshot() {
 	)
 
 	w.snapshotState = w.current.state.Copy()
+	w.snapshotDpos = w.current.dposContext.Copy()
 }
 
-func (w *worker) commitTransaction(tx *types.Transaction, coinbase common.Address) ([]*types.Log, error) {
+func (w *worker) commitTransaction(tx *types.Transaction) ([]*types.Log, error) {
 	snap := w.current.state.Snapshot()
 	env := w.current
 	dposSnap := env.dposContext.Snapshot()
-	receipt, _, err := core.ApplyTransaction(w.config, env.dposContext, w.chain, &coinbase, w.current.gasPool, w.current.state, w.current.header, tx, &w.current.header.GasUsed, vm.Config{})
+	// credit the fees to the block author, as block processing does
+	receipt, _, err := core.ApplyTransaction(w.config, env.dposContext, w.chain, nil, w.current.gasPool, w.current.state, w.current.header, tx, &w.current.header.GasUsed, vm.Config{})
 	if err != nil {
 		w.current.state.RevertToSnapshot(snap)
 		env.dposContext.RevertToSnapShot(dposSnap)
@@ -564,7 +574,7 @@ func (w *worker) commitTransaction(tx *types.Transaction, coinbase common.Addres
 	return receipt.Logs, nil
 }
 
-func (w *worker) commitTransactions(txs *types.TransactionsByPriceAndNonce, coinbase common.Address) bool {
+func (w *worker) commitTransactions(txs *types.TransactionsByPriceAndNonce) bool {
 	// Short circuit if current is nil
 	if w.current == nil {
 		return true
@@ -604,7 +614,7 @@ func (w *worker) commitTransactions(txs *types.TransactionsByPriceAndNonce, coin
 		// Start executing the transaction
 		w.current.state.Prepare(tx.Hash(), common.Hash{}, w.current.tcount)
 
-		logs, err := w.commitTransaction(tx, coinbase)
+		logs, err := w.commitTransaction(tx)
 		switch err {
 		case core.ErrGasLimitReached:
 			// Pop the current out-of-gas transaction without shifting in the next from the account
@@ -768,13 +778,13 @@ func (w *worker) createNewWork() (){
 	}
 	if len(localTxs) > 0 {
 		txs := types.NewTransactionsByPriceAndNonce(w.current.signer, localTxs)
-		if w.commitTransactions(txs, w.coinbase) {
+		if w.commitTransactions(txs) {
 			return
 		}
 	}
 	if len(remoteTxs) > 0 {
 		txs := types.NewTransactionsByPriceAndNonce(w.current.signer, remoteTxs)
-		if w.commitTransactions(txs, w.coinbase) {
+		if w.commitTransactions(txs) {
 			return
 		}
 	}
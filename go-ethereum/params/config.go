@@ -163,13 +163,241 @@ type DposConfig struct {
 	Validators []common.Address `json:"validators"` // Genesis validator list
 	MaxValidatorSize uint64		`json:"maxValidatorSize"` //Genesis maxvalidatorSize
 	BlockInterval 	 uint64		`json:"blockInterval"`
+
+	// MinBlockInterval, if set, raises the lowest block interval the chain may
+	// be created with above the built-in minimum, guarding networks against a
+	// misconfigured interval flooding them with blocks.
+	MinBlockInterval uint64 `json:"minBlockInterval,omitempty"`
+
+	// MintDeadlineGrace is the number of seconds before the next slot within
+	// which a validator may mint even though the previous block hasn't arrived.
+	// A larger grace tolerates more network latency at the cost of a higher
+	// chance of forking when the previous block is merely late. Zero selects
+	// the default of one second.
+	MintDeadlineGrace uint64 `json:"mintDeadlineGrace,omitempty"`
+
+	// ActivationTime, if set, is the timestamp before which no blocks are
+	// minted, e.g. to launch a network at an agreed time independent of the
+	// genesis timestamp.
+	ActivationTime uint64 `json:"activationTime,omitempty"`
+
+	// ValidatorContract, if set, makes the election read the validator set
+	// from the storage of this system contract instead of tallying votes.
+	ValidatorContract *common.Address `json:"validatorContract,omitempty"`
+
+	// CandidateWarmupEpochs is the number of elections a newly registered
+	// candidate has to sit out before it may be elected. It applies to
+	// candidates registered from the CandidateEpochBlock on.
+	CandidateWarmupEpochs uint64 `json:"candidateWarmupEpochs,omitempty"`
+
+	// MinElectableWeight, if set, is the vote weight a candidate needs at least
+	// to be eligible for election, no matter how it ranks.
+	MinElectableWeight *big.Int `json:"minElectableWeight,omitempty"`
+
+	// VoteChangeCooldown is the number of seconds a delegator has to wait after
+	// voting before it may change or withdraw its vote again. It applies to
+	// votes cast from the VoteTimeBlock on.
+	VoteChangeCooldown uint64 `json:"voteChangeCooldown,omitempty"`
+
+	// VoteHistoryLength, if set, is the number of most recent vote changes kept
+	// per delegator, e.g. for auditing. Older changes are dropped.
+	VoteHistoryLength uint64 `json:"voteHistoryLength,omitempty"`
+
+	// VoteDecayHalfLife, if set, is the number of seconds after which a vote
+	// counts for half its weight in elections, decaying further the longer it
+	// goes unchanged. Votes cast before the VoteTimeBlock hold no time and
+	// count as cast at the Unix epoch.
+	VoteDecayHalfLife uint64 `json:"voteDecayHalfLife,omitempty"`
+
+	// DowntimeAllowance is the number of slots per epoch a validator may miss,
+	// e.g. for maintenance, before the misses count towards its kickout.
+	DowntimeAllowance uint64 `json:"downtimeAllowance,omitempty"`
+
+	// DisableForkRewardSwitch keeps the block reward at the frontier base
+	// instead of lowering it from the byzantium block on, for chains that don't
+	// follow Ethereum's fork schedule.
+	DisableForkRewardSwitch bool `json:"disableForkRewardSwitch,omitempty"`
+
+	// BaseFeeBurnRatio is the percentage of the transaction fees of a block
+	// burnt instead of paid to its validator, shrinking the token supply.
+	BaseFeeBurnRatio uint64 `json:"baseFeeBurnRatio,omitempty"`
+
+	// RankRewardCurve, if set, scales the block reward by the vote weight rank
+	// the minting validator was elected with. Entry i is the percentage of the
+	// block reward paid to rank i+1, ranks past the end use the last entry.
+	RankRewardCurve []uint64 `json:"rankRewardCurve,omitempty"`
+
+	// SealJitterMs is the upper bound in milliseconds of a random delay added
+	// after the slot is reached before sealing, spreading out the broadcast of
+	// blocks. The delay never reaches into the mint deadline of the next slot.
+	SealJitterMs uint64 `json:"sealJitterMs,omitempty"`
+
+	// TrieWriteGas is the gas charged per dpos trie entry a candidate or vote
+	// transaction writes or deletes from the SystemGasBlock on. Zero selects
+	// params.DposTrieWriteGas.
+	TrieWriteGas uint64 `json:"trieWriteGas,omitempty"`
+
+	// Admins may force the validator set of an epoch in an emergency with a
+	// validator override transaction signed by at least AdminThreshold of them.
+	// Overrides are disabled if either is unset.
+	Admins         []common.Address `json:"admins,omitempty"`
+	AdminThreshold uint64           `json:"adminThreshold,omitempty"`
+
+	// RequireCoinbaseEqualsValidator rejects blocks paying their rewards to an
+	// address other than the validator minting them.
+	RequireCoinbaseEqualsValidator bool `json:"requireCoinbaseEqualsValidator,omitempty"`
+
+	// EpochRewardCap, if set, is the most an epoch may pay out. The block
+	// subsidy is cut to what's left under the cap, counting the subsidies and
+	// fees already accounted to the epoch.
+	EpochRewardCap *big.Int `json:"epochRewardCap,omitempty"`
+
+	// ElectionBlockBonus, if set, is added to the reward of the block holding
+	// the election of a new epoch, compensating its validator for the work.
+	ElectionBlockBonus *big.Int `json:"electionBlockBonus,omitempty"`
+
+	// StallSlots is the number of consecutive slots that may go by without a
+	// block before the chain is reported as stalled. Zero selects the default
+	// of ten slots.
+	StallSlots uint64 `json:"stallSlots,omitempty"`
+
+	// EpochOffset moves the epoch boundaries from multiples of the epoch
+	// interval since the Unix epoch to that many seconds later, e.g. to align
+	// epochs to the genesis time. It has to be a multiple of the block interval,
+	// also once reduced modulo the epoch interval.
+	EpochOffset uint64 `json:"epochOffset,omitempty"`
+
+	// ReRegisterCooldown is the number of epochs an address that unregistered
+	// or was kicked out has to wait before it may register as candidate again.
+	ReRegisterCooldown uint64 `json:"reRegisterCooldown,omitempty"`
+
+	// EpochMode selects whether epochs are measured in wall-clock time, the
+	// default, or in blocks. Block based epochs hold BlocksPerEpoch blocks each
+	// and don't shrink when slots are missed.
+	EpochMode      EpochMode `json:"epochMode,omitempty"`
+	BlocksPerEpoch uint64    `json:"blocksPerEpoch,omitempty"`
+
+	// FinalityMode selects how blocks become irreversible: once two thirds of
+	// the validators minted on top of them, the default, or once they are
+	// FinalityDepth blocks deep.
+	FinalityMode  FinalityMode `json:"finalityMode,omitempty"`
+	FinalityDepth uint64       `json:"finalityDepth,omitempty"`
+
+	// GasLimitBoundDivisor, if set, bounds the gas limit of a block to less
+	// than its parent's limit divided by the divisor away from the parent's
+	// limit. Miners move the limit by up to 1/1024th of the parent's, so the
+	// divisor shouldn't be larger than 1024.
+	GasLimitBoundDivisor uint64 `json:"gasLimitBoundDivisor,omitempty"`
+
+	// SafeDepth, if set, makes the "safe" block of the dpos RPCs the block that
+	// many blocks below the head, unless the confirmed block is more recent.
+	// Otherwise the safe block is the confirmed one, like the finalized block.
+	SafeDepth uint64 `json:"safeDepth,omitempty"`
+
+	// LimitReorgDepth makes the chain refuse reorgs dropping more canonical
+	// blocks than lie above the confirmed block plus ReorgDepthMargin.
+	LimitReorgDepth  bool   `json:"limitReorgDepth,omitempty"`
+	ReorgDepthMargin uint64 `json:"reorgDepthMargin,omitempty"`
+
+	// CheckTrieIntegrity makes every block check that the vote and delegate
+	// tries agree after its dpos changes, logging inconsistencies. It walks
+	// both tries in full, so it is meant for debugging.
+	CheckTrieIntegrity bool `json:"checkTrieIntegrity,omitempty"`
+
+	// EpochHistoryBlock, if set, is the block from which elections keep the
+	// epoch trie instead of starting it afresh. From then on the validators,
+	// the election input and the rewards of recent epochs are recorded, along
+	// with running candidate and delegator counts. Before, elections only carry
+	// over the per account settings, like payout addresses and vote histories.
+	EpochHistoryBlock *big.Int `json:"epochHistoryBlock,omitempty"`
+
+	// VoteTimeBlock, if set, is the block from which votes record the time they
+	// were cast at in the vote trie, for the vote change cooldown and the vote
+	// decay. Before, the vote trie holds the bare candidate.
+	VoteTimeBlock *big.Int `json:"voteTimeBlock,omitempty"`
+
+	// CandidateEpochBlock, if set, is the block from which candidates record the
+	// epoch they registered in in the candidate trie, for the candidate warmup.
+	// Before, the candidate trie holds the bare address.
+	CandidateEpochBlock *big.Int `json:"candidateEpochBlock,omitempty"`
+
+	// SystemGasBlock, if set, is the block from which dpos system transactions
+	// pay TrieWriteGas for their trie writes on top of their intrinsic gas.
+	// Before, they only pay the intrinsic gas.
+	SystemGasBlock *big.Int `json:"systemGasBlock,omitempty"`
 }
 
+// FinalityMode is the rule dpos blocks are confirmed by.
+type FinalityMode string
+
+const (
+	Supermajority FinalityMode = "supermajority" // Confirmed by two thirds of the validators
+	FixedDepth    FinalityMode = "depth"         // Confirmed by a fixed number of blocks on top
+)
+
+// EpochMode is the unit dpos epochs are measured in.
+type EpochMode string
+
+const (
+	TimeBased  EpochMode = "time"  // Epochs span a fixed interval of time
+	BlockBased EpochMode = "block" // Epochs span a fixed number of blocks
+)
+
 // String implements the stringer interface, returning the consensus engine details.
 func (d *DposConfig) String() string {
 	return "dpos"
 }
 
+// Validate checks the parameters the genesis of a dpos chain is created with.
+func (d *DposConfig) Validate() error {
+	if d.MaxValidatorSize < 1 || d.MaxValidatorSize > MaxValidatorSizeLimit {
+		return fmt.Errorf("invalid dpos maxValidatorSize %d, must be between 1 and %d", d.MaxValidatorSize, MaxValidatorSizeLimit)
+	}
+	minInterval := MinBlockInterval
+	if d.MinBlockInterval > minInterval {
+		minInterval = d.MinBlockInterval
+	}
+	if d.BlockInterval < minInterval {
+		return fmt.Errorf("invalid dpos blockInterval %d, must be at least %d", d.BlockInterval, minInterval)
+	}
+	// the slot helpers count slots from multiples of the block interval, and
+	// the offset is applied modulo the epoch interval
+	if d.EpochOffset%d.BlockInterval != 0 || d.EpochOffset%DposEpochInterval%d.BlockInterval != 0 {
+		return fmt.Errorf("invalid dpos epochOffset %d, must be a multiple of the blockInterval %d within the epoch interval", d.EpochOffset, d.BlockInterval)
+	}
+	if d.FinalityMode == FixedDepth && d.FinalityDepth == 0 {
+		return fmt.Errorf("invalid dpos finalityDepth %d, must be at least 1 for depth finality", d.FinalityDepth)
+	}
+	if d.BaseFeeBurnRatio > 100 {
+		return fmt.Errorf("invalid dpos baseFeeBurnRatio %d, must be at most 100", d.BaseFeeBurnRatio)
+	}
+	return nil
+}
+
+
+// IsEpochHistory returns whether num is either equal to the epoch history block
+// or greater.
+func (d *DposConfig) IsEpochHistory(num *big.Int) bool {
+	return d != nil && isForked(d.EpochHistoryBlock, num)
+}
+
+// IsVoteTime returns whether num is either equal to the vote time block or
+// greater.
+func (d *DposConfig) IsVoteTime(num *big.Int) bool {
+	return d != nil && isForked(d.VoteTimeBlock, num)
+}
+
+// IsCandidateEpoch returns whether num is either equal to the candidate epoch
+// block or greater.
+func (d *DposConfig) IsCandidateEpoch(num *big.Int) bool {
+	return d != nil && isForked(d.CandidateEpochBlock, num)
+}
+
+// IsSystemGas returns whether num is either equal to the system gas block or
+// greater.
+func (d *DposConfig) IsSystemGas(num *big.Int) bool {
+	return d != nil && isForked(d.SystemGasBlock, num)
+}
 
 // String implements the fmt.Stringer interface.
 func (c *ChainConfig) String() string {
@@ -288,9 +516,53 @@ func (c *ChainConfig) checkCompatible(newcfg *ChainConfig, head *big.Int) *Confi
 	if isForkIncompatible(c.ConstantinopleBlock, newcfg.ConstantinopleBlock, head) {
 		return newCompatError("Constantinople fork block", c.ConstantinopleBlock, newcfg.ConstantinopleBlock)
 	}
+	if isForkIncompatible(c.epochHistoryBlock(), newcfg.epochHistoryBlock(), head) {
+		return newCompatError("dpos epoch history block", c.epochHistoryBlock(), newcfg.epochHistoryBlock())
+	}
+	if isForkIncompatible(c.voteTimeBlock(), newcfg.voteTimeBlock(), head) {
+		return newCompatError("dpos vote time block", c.voteTimeBlock(), newcfg.voteTimeBlock())
+	}
+	if isForkIncompatible(c.candidateEpochBlock(), newcfg.candidateEpochBlock(), head) {
+		return newCompatError("dpos candidate epoch block", c.candidateEpochBlock(), newcfg.candidateEpochBlock())
+	}
+	if isForkIncompatible(c.systemGasBlock(), newcfg.systemGasBlock(), head) {
+		return newCompatError("dpos system gas block", c.systemGasBlock(), newcfg.systemGasBlock())
+	}
 	return nil
 }
 
+// epochHistoryBlock returns the dpos epoch history block, nil without dpos.
+func (c *ChainConfig) epochHistoryBlock() *big.Int {
+	if c.Dpos == nil {
+		return nil
+	}
+	return c.Dpos.EpochHistoryBlock
+}
+
+// voteTimeBlock returns the dpos vote time block, nil without dpos.
+func (c *ChainConfig) voteTimeBlock() *big.Int {
+	if c.Dpos == nil {
+		return nil
+	}
+	return c.Dpos.VoteTimeBlock
+}
+
+// candidateEpochBlock returns the dpos candidate epoch block, nil without dpos.
+func (c *ChainConfig) candidateEpochBlock() *big.Int {
+	if c.Dpos == nil {
+		return nil
+	}
+	return c.Dpos.CandidateEpochBlock
+}
+
+// systemGasBlock returns the dpos system gas block, nil without dpos.
+func (c *ChainConfig) systemGasBlock() *big.Int {
+	if c.Dpos == nil {
+		return nil
+	}
+	return c.Dpos.SystemGasBlock
+}
+
 // isForkIncompatible returns true if a fork scheduled at s1 cannot be rescheduled to
 // block s2 because head is already past the fork.
 func isForkIncompatible(s1, s2, head *big.Int) bool {
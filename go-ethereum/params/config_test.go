@@ -79,3 +79,89 @@ func TestCheckCompatible(t *testing.T) {
 		}
 	}
 }
+
+func TestDposConfigValidate(t *testing.T) {
+	tests := []struct {
+		size  uint64
+		valid bool
+	}{
+		{0, false},
+		{1, true},
+		{21, true},
+		{MaxValidatorSizeLimit, true},
+		{MaxValidatorSizeLimit + 1, false},
+		{1 << 63, false},
+	}
+	for _, test := range tests {
+		err := (&DposConfig{MaxValidatorSize: test.size, BlockInterval: 10}).Validate()
+		if test.valid && err != nil {
+			t.Errorf("maxValidatorSize %d: unexpected error: %v", test.size, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("maxValidatorSize %d: expected error", test.size)
+		}
+	}
+}
+
+func TestDposConfigValidateBlockInterval(t *testing.T) {
+	tests := []struct {
+		interval, min uint64
+		valid         bool
+	}{
+		{0, 0, false},
+		{MinBlockInterval, 0, true},
+		{10, 0, true},
+		{2, 3, false},
+		{3, 3, true},
+		{10, 3, true},
+	}
+	for _, test := range tests {
+		err := (&DposConfig{MaxValidatorSize: 21, BlockInterval: test.interval, MinBlockInterval: test.min}).Validate()
+		if test.valid && err != nil {
+			t.Errorf("blockInterval %d, minimum %d: unexpected error: %v", test.interval, test.min, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("blockInterval %d, minimum %d: expected error", test.interval, test.min)
+		}
+	}
+}
+
+func TestDposConfigValidateBaseFeeBurnRatio(t *testing.T) {
+	for _, ratio := range []uint64{0, 50, 100} {
+		if err := (&DposConfig{MaxValidatorSize: 21, BlockInterval: 10, BaseFeeBurnRatio: ratio}).Validate(); err != nil {
+			t.Errorf("baseFeeBurnRatio %d: unexpected error: %v", ratio, err)
+		}
+	}
+	if err := (&DposConfig{MaxValidatorSize: 21, BlockInterval: 10, BaseFeeBurnRatio: 101}).Validate(); err == nil {
+		t.Errorf("baseFeeBurnRatio 101: expected error")
+	}
+}
+
+func TestDposConfigValidateEpochOffset(t *testing.T) {
+	for _, offset := range []uint64{0, 10, 3600} {
+		if err := (&DposConfig{MaxValidatorSize: 21, BlockInterval: 10, EpochOffset: offset}).Validate(); err != nil {
+			t.Errorf("epochOffset %d: unexpected error: %v", offset, err)
+		}
+	}
+	for _, offset := range []uint64{5, 3605} {
+		if err := (&DposConfig{MaxValidatorSize: 21, BlockInterval: 10, EpochOffset: offset}).Validate(); err == nil {
+			t.Errorf("epochOffset %d: expected error", offset)
+		}
+	}
+	// with intervals not dividing the epoch interval the reduced offset counts
+	if err := (&DposConfig{MaxValidatorSize: 21, BlockInterval: 7, EpochOffset: 700}).Validate(); err != nil {
+		t.Errorf("epochOffset 700: unexpected error: %v", err)
+	}
+	if err := (&DposConfig{MaxValidatorSize: 21, BlockInterval: 7, EpochOffset: 86401}).Validate(); err == nil {
+		t.Errorf("epochOffset 86401: expected error")
+	}
+}
+
+func TestDposConfigValidateFinalityDepth(t *testing.T) {
+	if err := (&DposConfig{MaxValidatorSize: 21, BlockInterval: 10, FinalityMode: FixedDepth}).Validate(); err == nil {
+		t.Errorf("depth finality without a depth: expected error")
+	}
+	if err := (&DposConfig{MaxValidatorSize: 21, BlockInterval: 10, FinalityMode: FixedDepth, FinalityDepth: 12}).Validate(); err != nil {
+		t.Errorf("depth finality: unexpected error: %v", err)
+	}
+}
@@ -78,6 +78,11 @@ const (
 	Bn256ScalarMulGas       uint64 = 40000  // Gas needed for an elliptic curve scalar multiplication
 	Bn256PairingBaseGas     uint64 = 100000 // Base price for an elliptic curve pairing check
 	Bn256PairingPerPointGas uint64 = 80000  // Per-point price for an elliptic curve pairing check
+
+	DposTrieWriteGas      uint64 = 20000 // Per dpos trie entry written or deleted by a dpos system transaction.
+	MaxValidatorSizeLimit uint64 = 1024  // Upper bound of the maximum number of validators of a dpos chain.
+	MinBlockInterval      uint64 = 1     // Lowest number of seconds between the blocks of a dpos chain.
+	DposEpochInterval     uint64 = 86400 // Number of seconds a time based dpos epoch spans.
 )
 
 var (
@@ -132,6 +132,10 @@ func (t *Trie) NodeIterator(start []byte) NodeIterator {
 
 // PrefixIterator returns an iterator that returns nodes of the trie which has the prefix path specificed
 // Iteration starts at the key after the given start key.
+//
+// Like NodeIterator, the leaves are visited in ascending key order. The order
+// depends only on the keys present, never on the order they were inserted in,
+// so every node holding the same trie iterates it identically.
 func (t *Trie) PrefixIterator(prefix []byte) NodeIterator {
 	if t.prefix != nil {
 		prefix = append(t.prefix, prefix...)